@@ -0,0 +1,205 @@
+package wshelper
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// kick a user, the reason is sent as a REPLY_NOTIFY before the connection is closed
+func (wsh *WebSocketHelper) Kick(key string, reason string) error {
+	conn, ok := wsh.pool.Get(key)
+	if !ok {
+		return Errorf(ERR_NOT_FOUND, "user '%s' not online", key)
+	}
+	e := wsh.Reply(conn, REPLY, _json.Reply{
+		ReplyType: REPLY_NOTIFY,
+		Desc:      "kicked",
+		Notice:    reason,
+	})
+	wsh.Offline(key, conn)
+	conn.Close()
+	wsh.Logger().Info("kick", "key", key, "reason", reason)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	return nil
+}
+
+// send a system notice as a REPLY_NOTIFY to all connections, online or not. the number of connections sent is returned
+func (wsh *WebSocketHelper) Broadcast(notice string) (int, error) {
+	var errors []error
+	var sent int
+	for _, conn := range wsh.pool.conns() {
+		e := wsh.Reply(conn, REPLY, _json.Reply{
+			ReplyType: REPLY_NOTIFY,
+			Desc:      "notice",
+			Notice:    notice,
+		})
+		if e != nil {
+			errors = append(errors, e)
+			continue
+		}
+		sent++
+	}
+	if len(errors) > 0 {
+		return sent, errorx.GroupErrors(errors...)
+	}
+	return sent, nil
+}
+
+// an admin api to inspect and manage live connections, mount it under a prefix and keep it private:
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", wsh.AdminHandler(token)))
+//
+// requests should carry 'Authorization: Bearer <token>'. an empty token rejects all requests,
+// unless AllowUnauthenticated() is passed to serve them without auth.
+// keys in paths are escaped by url.PathEscape, so keys containing '/' are reachable.
+//
+//	GET  /connections              all connections
+//	GET  /connections/{key}        the connection of a user
+//	POST /connections/{key}/kick   kick a user, body {"reason": "..."}
+//	PUT  /connections/{key}/debug  set debug mode of a user, body {"debug": true}
+//	POST /broadcast                send a notice to all, body {"notice": "..."}
+//	GET  /commands                 command hash -> command
+//	GET  /settings                 current Settings
+//	PUT  /settings                 update Settings, bad values are rejected with 400
+func (wsh *WebSocketHelper) AdminHandler(token string, opts ...AdminOption) http.Handler {
+	var o adminOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	switch {
+	case token == "" && o.allowUnauthenticated:
+		wsh.Logger().Warn("admin api is not authenticated")
+	case token == "":
+		wsh.Logger().Warn("admin api rejects all requests for no token")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" && !o.allowUnauthenticated {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "admin token not set"})
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		path := strings.Trim(r.URL.EscapedPath(), "/")
+		parts := strings.Split(path, "/")
+		for i, part := range parts {
+			unescaped, e := url.PathUnescape(part)
+			if e != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+				return
+			}
+			parts[i] = unescaped
+		}
+		switch {
+		case path == "connections" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, wsh.pool.Connections())
+		case len(parts) == 2 && parts[0] == "connections" && r.Method == http.MethodGet:
+			info, ok := wsh.pool.ConnectionOf(parts[1])
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not online"})
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		case len(parts) == 3 && parts[0] == "connections" && parts[2] == "kick" && r.Method == http.MethodPost:
+			var in struct {
+				Reason string `json:"reason"`
+			}
+			if r.ContentLength != 0 {
+				if e := json.NewDecoder(r.Body).Decode(&in); e != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+					return
+				}
+			}
+			if e := wsh.Kick(parts[1], in.Reason); e != nil {
+				if typed, ok := e.(*Error); ok && typed.Code == ERR_NOT_FOUND {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": typed.Message})
+					return
+				}
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": e.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"kicked": parts[1]})
+		case len(parts) == 3 && parts[0] == "connections" && parts[2] == "debug" && r.Method == http.MethodPut:
+			var in struct {
+				Debug bool `json:"debug"`
+			}
+			if e := json.NewDecoder(r.Body).Decode(&in); e != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+				return
+			}
+			conn, ok := wsh.pool.Get(parts[1])
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not online"})
+				return
+			}
+			wsh.pool.SetDebug(conn, in.Debug)
+			writeJSON(w, http.StatusOK, map[string]bool{"debug": in.Debug})
+		case path == "broadcast" && r.Method == http.MethodPost:
+			var in struct {
+				Notice string `json:"notice"`
+			}
+			if e := json.NewDecoder(r.Body).Decode(&in); e != nil || in.Notice == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "notice required"})
+				return
+			}
+			sent, e := wsh.Broadcast(in.Notice)
+			rs := map[string]interface{}{"sent": sent}
+			if e != nil {
+				rs["error"] = e.Error()
+			}
+			writeJSON(w, http.StatusOK, rs)
+		case path == "commands" && r.Method == http.MethodGet:
+			wsh.M.RLock()
+			commands := make(map[string]int, len(wsh.commandHash))
+			for hash, command := range wsh.commandHash {
+				commands[hash] = command
+			}
+			wsh.M.RUnlock()
+			writeJSON(w, http.StatusOK, commands)
+		case path == "settings" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, wsh.Settings())
+		case path == "settings" && r.Method == http.MethodPut:
+			// fields not in the body keep their current values
+			s := wsh.Settings()
+			if e := json.NewDecoder(r.Body).Decode(&s); e != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+				return
+			}
+			if e := wsh.UpdateSettings(s); e != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, wsh.Settings())
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	})
+}
+
+// options of AdminHandler
+type AdminOption func(o *adminOptions)
+
+type adminOptions struct {
+	allowUnauthenticated bool
+}
+
+// serve the admin api without auth when the token is empty, only for a listener nobody else reaches
+func AllowUnauthenticated() AdminOption {
+	return func(o *adminOptions) {
+		o.allowUnauthenticated = true
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
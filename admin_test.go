@@ -0,0 +1,76 @@
+package wshelper
+
+import (
+	"encoding/json"
+	"eyas/wshelper/util"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	ts := newTestServer(t, wsh)
+	c := loginTest(t, wsh, ts, "tom", "")
+
+	admin := wsh.AdminHandler("secret")
+	do := func(method string, path string, body string) (int, string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/connections", nil))
+	util.Assertf(w.Code == 401, t, "want 401 without token but got %d", w.Code)
+
+	code, body := do("GET", "/connections", "")
+	var infos []ConnInfo
+	json.Unmarshal([]byte(body), &infos)
+	util.Assertf(code == 200 && len(infos) == 1 && infos[0].Key == "tom", t, "bad connections %d %s", code, body)
+	util.Assertf(infos[0].Serializer == "json" && infos[0].FramesIn == 1 && infos[0].FramesOut == 1, t, "bad stats %s", body)
+
+	code, _ = do("GET", "/connections/jack", "")
+	util.Assertf(code == 404, t, "want 404 but got %d", code)
+	// keys with '/' are escaped
+	loginTest(t, wsh, ts, "org/bob", "")
+	code, body = do("GET", "/connections/"+url.PathEscape("org/bob"), "")
+	util.Assertf(code == 200 && strings.Contains(body, `"org/bob"`), t, "bad connection %d %s", code, body)
+	code, body = do("PUT", "/connections/org%2Fbob/debug", `{"debug":true}`)
+	util.Assertf(code == 200, t, "bad debug %d %s", code, body)
+	server, _ := wsh.pool.Get("org/bob")
+	util.Assertf(wsh.pool.IsDebug(server), t, "org/bob should be in debug mode")
+
+	code, body = do("GET", "/commands", "")
+	util.Assertf(code == 200 && strings.Contains(body, wsh.genCommandHash(TEST_LOGIN)), t, "bad commands %d %s", code, body)
+
+	code, body = do("POST", "/broadcast", `{"notice":"maintenance at 2am"}`)
+	util.Assertf(code == 200 && strings.Contains(body, `"sent":2`), t, "bad broadcast %d %s", code, body)
+	reply := c.Reply()
+	util.Assertf(reply.ReplyType == REPLY_NOTIFY && reply.Notice == "maintenance at 2am", t, "bad notice %+v", reply)
+
+	code, body = do("PUT", "/settings", `{"max_online_conn":-1}`)
+	util.Assertf(code == 400, t, "want 400 but got %d %s", code, body)
+
+	code, body = do("POST", "/connections/tom/kick", `{"reason":"spam"}`)
+	util.Assertf(code == 200, t, "bad kick %d %s", code, body)
+	reply = c.Reply()
+	util.Assertf(reply.ReplyType == REPLY_NOTIFY && reply.Desc == "kicked" && reply.Notice == "spam", t, "bad kick notice %+v", reply)
+	_, ok := wsh.pool.Get("tom")
+	util.Assertf(!ok, t, "tom should be offline")
+}
+
+func TestAdminHandler_NoToken(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	w := httptest.NewRecorder()
+	wsh.AdminHandler("").ServeHTTP(w, httptest.NewRequest("GET", "/connections", nil))
+	util.Assertf(w.Code == 401, t, "want 401 without a token set but got %d", w.Code)
+
+	w = httptest.NewRecorder()
+	wsh.AdminHandler("", AllowUnauthenticated()).ServeHTTP(w, httptest.NewRequest("GET", "/connections", nil))
+	util.Assertf(w.Code == 200, t, "want 200 if unauthenticated allowed but got %d", w.Code)
+}
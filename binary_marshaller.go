@@ -0,0 +1,75 @@
+package wshelper
+
+import (
+	"bytes"
+	"github.com/fwhezfwhez/errorx"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+)
+
+// an realization of Marshaller by MessagePack.
+// struct fields are named by their json tags, so model/json structs work the same as with Jsoner
+type Msgpacker struct {
+}
+
+// marshal
+func (m Msgpacker) Marshal(obj interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	if e := enc.Encode(obj); e != nil {
+		return nil, errorx.New(e)
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshal
+func (m Msgpacker) Unmarshal(data []byte, dest interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if e := dec.Decode(dest); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// type name
+func (m Msgpacker) TypeName() string {
+	return "msgpack"
+}
+
+var (
+	// times keep nanoseconds as Jsoner does
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	// maps in interface{} are decoded to map[string]interface{} as Jsoner does
+	cborDec, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+)
+
+// an realization of Marshaller by CBOR.
+// struct fields are named by their json tags when no cbor tags, so model/json structs work the same as with Jsoner
+type Cborer struct {
+}
+
+// marshal
+func (c Cborer) Marshal(obj interface{}) ([]byte, error) {
+	b, e := cborEnc.Marshal(obj)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	return b, nil
+}
+
+// unmarshal
+func (c Cborer) Unmarshal(data []byte, dest interface{}) error {
+	if e := cborDec.Unmarshal(data, dest); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// type name
+func (c Cborer) TypeName() string {
+	return "cbor"
+}
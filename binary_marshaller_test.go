@@ -0,0 +1,74 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryMarshaller(t *testing.T) {
+	for _, m := range []Marshaller{Msgpacker{}, Cborer{}} {
+		for _, sample := range jsonSamples() {
+			b, e := m.Marshal(sample)
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			got := reflect.New(reflect.TypeOf(sample).Elem()).Interface()
+			if e = m.Unmarshal(b, got); e != nil {
+				t.Fatal(e.Error())
+			}
+			if !equalModel(reflect.ValueOf(sample), reflect.ValueOf(got)) {
+				t.Fatalf("%s: want %+v but got %+v", m.TypeName(), sample, got)
+			}
+		}
+
+		// named by json tags
+		b, e := m.Marshal(_json.FileAck{FileId: "f1", Seq: 1})
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		var fields map[string]interface{}
+		if e = m.Unmarshal(b, &fields); e != nil {
+			t.Fatal(e.Error())
+		}
+		if fields["file_id"] != "f1" {
+			t.Fatalf("%s: want field 'file_id' but got %v", m.TypeName(), fields)
+		}
+	}
+}
+
+// like reflect.DeepEqual, but times are compared by instant since decoders may give them another location
+func equalModel(a reflect.Value, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	if a.Type() == timeType {
+		return a.Interface().(time.Time).Equal(b.Interface().(time.Time))
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return equalModel(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !equalModel(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !equalModel(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
@@ -26,6 +26,28 @@ const (
 	ADD_ONE_REMARK    // remark a friend
 	ADD_ROOM_REMARK   //remark a room
 	ADD_GROUP_REMART  //remart a group
+
+	FILE_UPLOAD_INIT  // initiate or resume a chunked upload
+	FILE_UPLOAD_CHUNK // send a numbered chunk of an upload
+	FILE_DOWNLOAD     // download a stored file from a chunk on
+	FILE_ACK          // server acknowledges an upload chunk
+
+	OFFLINE_MESSAGE // server delivers a message saved while the user was offline
+	OFFLINE_ACK     // client acknowledges offline messages
+
+	REPLY            // server replies a model.Reply
+	RELIABLE_MESSAGE // server delivers a message with an id, which should be acked
+	MESSAGE_ACK      // client acknowledges a message is delivered or read
+
+	HISTORY // query a page of history, server replies a page
+
+	HEARTBEAT // client keeps the connection alive, server replies HEARTBEAT
+
+	SUBSCRIBE   // subscribe a topic or a pattern
+	UNSUBSCRIBE // unsubscribe a topic or a pattern subscribed
+	PUBLISH     // server delivers a message published to a topic subscribed
+
+	builtinEnd // not a command, built-in commands are below it, add new ones above
 )
 
 // SubCommands
@@ -0,0 +1,248 @@
+package wshelper
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// the query parameter to negotiate compression, like ws://host/ws?compress=deflate
+const COMPRESS_QUERY = "compress"
+
+// the flag of an uncompressed message on a compressing connection
+const FLAG_RAW byte = 0
+
+// compress message bodies.
+// once a connection negotiates a compressor, every message both ways carries a flag byte right after the 32 bit command hash,
+// FLAG_RAW for a body sent as it is, Flag() for a compressed body. bodies shorter than the threshold of the pool are not compressed
+type Compressor interface {
+	// name to negotiate by '?compress='
+	Name() string
+	// flag following the command hash of a compressed message
+	Flag() byte
+	Compress(src []byte) ([]byte, error)
+	// decompress, websocket.ErrFrameTooLarge if the result is larger than max
+	Decompress(src []byte, max int) ([]byte, error)
+}
+
+// deflate compressor, flag 1
+type Deflate struct{}
+
+// name
+func (Deflate) Name() string {
+	return "deflate"
+}
+
+// flag
+func (Deflate) Flag() byte {
+	return 1
+}
+
+// compress
+func (Deflate) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, e := flate.NewWriter(&buf, flate.DefaultCompression)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	if _, e = w.Write(src); e != nil {
+		return nil, errorx.New(e)
+	}
+	if e = w.Close(); e != nil {
+		return nil, errorx.New(e)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress
+func (Deflate) Decompress(src []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readMax(r, max)
+}
+
+// gzip compressor, flag 2
+type Gzip struct{}
+
+// name
+func (Gzip) Name() string {
+	return "gzip"
+}
+
+// flag
+func (Gzip) Flag() byte {
+	return 2
+}
+
+// compress
+func (Gzip) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, e := w.Write(src); e != nil {
+		return nil, errorx.New(e)
+	}
+	if e := w.Close(); e != nil {
+		return nil, errorx.New(e)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress
+func (Gzip) Decompress(src []byte, max int) ([]byte, error) {
+	r, e := gzip.NewReader(bytes.NewReader(src))
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	defer r.Close()
+	return readMax(r, max)
+}
+
+// read all but no more than max bytes, max <= 0 means no limit
+func readMax(r io.Reader, max int) ([]byte, error) {
+	if max <= 0 {
+		b, e := ioutil.ReadAll(r)
+		if e != nil {
+			return nil, errorx.New(e)
+		}
+		return b, nil
+	}
+	b, e := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	if len(b) > max {
+		return nil, websocket.ErrFrameTooLarge
+	}
+	return b, nil
+}
+
+// register a compressor which connections can negotiate by its Name(), Deflate and Gzip are registered on NewWsHelper
+func (wsh *WebSocketHelper) RegisterCompressor(c Compressor) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.compressors[c.Name()] = c
+}
+
+// decide the compressor of a new connection by the query parameter, nil for no compression.
+// a compressor not registered is an error, so that the client would not send compressed messages the server can't read
+func (wsh *WebSocketHelper) negotiateCompressor(conn *websocket.Conn) (Compressor, error) {
+	req := conn.Request()
+	if req == nil {
+		return nil, nil
+	}
+	name := req.URL.Query().Get(COMPRESS_QUERY)
+	if name == "" {
+		return nil, nil
+	}
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	c, ok := wsh.compressors[name]
+	if !ok {
+		return nil, errorx.NewFromStringf("unsupported compressor '%s'", name)
+	}
+	return c, nil
+}
+
+// set the compressor of a connection, nil to remove
+func (cp *ConnectionPool) SetCompressor(conn *websocket.Conn, c Compressor) {
+	if c == nil {
+		cp.compressors.Delete(conn)
+		return
+	}
+	cp.compressors.Store(conn, c)
+}
+
+// set the min body size to compress
+func (cp *ConnectionPool) SetCompressThreshold(threshold int) {
+	atomic.StoreInt64(&cp.compressThreshold, int64(threshold))
+}
+
+func (cp *ConnectionPool) compressorOf(conn *websocket.Conn) (Compressor, int) {
+	threshold := int(atomic.LoadInt64(&cp.compressThreshold))
+	c, ok := cp.compressors.Load(conn)
+	if !ok {
+		return nil, threshold
+	}
+	return c.(Compressor), threshold
+}
+
+// add the compression flag and compress the body if the connection negotiated a compressor
+func (cp *ConnectionPool) encode(conn *websocket.Conn, data []byte) ([]byte, error) {
+	c, threshold := cp.compressorOf(conn)
+	if c == nil || len(data) < 32 {
+		return data, nil
+	}
+	var rs = make([]byte, 0, len(data)+1)
+	rs = append(rs, data[:32]...)
+	if len(data)-32 < threshold {
+		rs = append(rs, FLAG_RAW)
+		return append(rs, data[32:]...), nil
+	}
+	body, e := c.Compress(data[32:])
+	if e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	rs = append(rs, c.Flag())
+	return append(rs, body...), nil
+}
+
+// strip the compression flag and decompress the body if the connection negotiated a compressor
+func (cp *ConnectionPool) decode(conn *websocket.Conn, data []byte) ([]byte, error) {
+	c, _ := cp.compressorOf(conn)
+	if c == nil || len(data) < 32 {
+		return data, nil
+	}
+	if len(data) < 33 {
+		return nil, Errorf(ERR_BAD_REQUEST, "required a compression flag after the command hash but got length '%d'", len(data))
+	}
+	switch data[32] {
+	case FLAG_RAW:
+		return append(data[:32:32], data[33:]...), nil
+	case c.Flag():
+		body, e := c.Decompress(data[33:], conn.MaxPayloadBytes)
+		if e == websocket.ErrFrameTooLarge {
+			return nil, e
+		}
+		if e != nil {
+			return nil, Errorf(ERR_BAD_REQUEST, "bad compressed body: %s", e.Error())
+		}
+		return append(data[:32:32], body...), nil
+	}
+	return nil, Errorf(ERR_BAD_REQUEST, "unknown compression flag '%d'", data[32])
+}
+
+// send a raw message to a connection, compressed if the connection negotiated a compressor.
+// a debug-only reply is skipped if the connection is not in debug mode
+func (cp *ConnectionPool) Write(conn *websocket.Conn, data []byte) error {
+	data, debug := splitDebugFlag(data)
+	if debug && !cp.IsDebug(conn) {
+		return nil
+	}
+	data, e := cp.encode(conn, data)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	if e = websocket.Message.Send(conn, data); e != nil {
+		if e != io.EOF {
+			cp.metricsOf().drop(DROP_ERROR)
+		}
+		return e
+	}
+	cp.metricsOf().frameOut(data)
+	cp.statsOf(conn).out(len(data))
+	return nil
+}
+
+// receive a raw message from a connection, decompressed if the connection negotiated a compressor
+func (cp *ConnectionPool) Read(conn *websocket.Conn) ([]byte, error) {
+	var buf []byte
+	if e := websocket.Message.Receive(conn, &buf); e != nil {
+		return nil, e
+	}
+	return cp.decode(conn, buf)
+}
@@ -0,0 +1,49 @@
+package wshelper
+
+import (
+	"bytes"
+	"golang.org/x/net/websocket"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	pool := NewConnectionPool()
+	pool.SetCompressThreshold(64)
+	hash := []byte(strings.Repeat("A", 32))
+	small := append(append([]byte{}, hash...), []byte("hi")...)
+	large := append(append([]byte{}, hash...), bytes.Repeat([]byte("hello "), 100)...)
+
+	for _, c := range []Compressor{Deflate{}, Gzip{}} {
+		conn := &websocket.Conn{}
+		pool.SetCompressor(conn, c)
+
+		for _, data := range [][]byte{small, large} {
+			encoded, e := pool.encode(conn, data)
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			if len(data) == len(large) && (encoded[32] != c.Flag() || len(encoded) >= len(data)) {
+				t.Fatalf("%s: want the large body compressed", c.Name())
+			}
+			if len(data) == len(small) && encoded[32] != FLAG_RAW {
+				t.Fatalf("%s: want the small body raw", c.Name())
+			}
+			decoded, e := pool.decode(conn, encoded)
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Fatalf("%s: want %q but got %q", c.Name(), data, decoded)
+			}
+		}
+
+		// decompressed size is bounded by MaxPayloadBytes
+		encoded, _ := pool.encode(conn, large)
+		conn.MaxPayloadBytes = 100
+		if _, e := pool.decode(conn, encoded); e == nil {
+			t.Fatalf("%s: want an error decompressing beyond MaxPayloadBytes", c.Name())
+		}
+		pool.SetCompressor(conn, nil)
+	}
+}
@@ -0,0 +1,154 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"strconv"
+	"sync"
+)
+
+// the order key of a frame. frames of ordered commands with the same key are handled in the order they arrive,
+// whatever their commands are, so keys of different commands can share an order like "peer:bob"
+type OrderKeyFunc func(rawBytes []byte, cache map[string]interface{}) string
+
+// mark a command ordered when Options.Concurrency > 1, its frames are handled in order by key.
+// nil key orders all frames of the command. SEND_ONE is ordered by its peer on NewWsHelper
+func (wsh *WebSocketHelper) SetOrdered(command int, key OrderKeyFunc) {
+	if key == nil {
+		key = func(rawBytes []byte, cache map[string]interface{}) string {
+			return "command:" + strconv.Itoa(command)
+		}
+	}
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.orderKeys[command] = key
+}
+
+// the order key of a frame, false if its command is not ordered
+func (wsh *WebSocketHelper) orderKeyOf(command int, raw []byte, cache map[string]interface{}) (string, bool) {
+	wsh.M.RLock()
+	f, ok := wsh.orderKeys[command]
+	wsh.M.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return f(raw, cache), true
+}
+
+// the order key of SEND_ONE, frames to the same peer are in order
+func (wsh *WebSocketHelper) sendOneOrderKey(rawBytes []byte, cache map[string]interface{}) string {
+	var in _json.SendOne
+	// a bad frame is replied by the handler, it's ordered with others anyway
+	if wsh.SerializerOf(ConnOf(cache)).Unmarshal(rawBytes[32:], &in) == nil {
+		// the handler gets it by CoreFrom without decoding again
+		cache[cacheCore] = decodedCore{raw: rawBytes, v: &in}
+	}
+	return "peer:" + in.To
+}
+
+// the core struct of a frame decoded before its handler
+type decodedCore struct {
+	raw []byte
+	// a pointer to the struct
+	v interface{}
+}
+
+// whether it's decoded from the frame buf
+func (c decodedCore) of(buf []byte) bool {
+	return len(buf) > 0 && len(buf) == len(c.raw) && &buf[0] == &c.raw[0]
+}
+
+// handles frames of a connection concurrently up to a limit, frames of the same order key in order
+type connWorkers struct {
+	// a slot is taken by each frame queued or running, the reader blocks when it's full
+	slots chan struct{}
+	wg    *sync.WaitGroup
+	m     *sync.Mutex
+	// order key -> frames queued, a key exists while its frames are being drained
+	lanes map[string][]func()
+}
+
+func newConnWorkers(limit int) *connWorkers {
+	return &connWorkers{
+		slots: make(chan struct{}, limit),
+		wg:    &sync.WaitGroup{},
+		m:     &sync.Mutex{},
+		lanes: make(map[string][]func()),
+	}
+}
+
+// run a job, it blocks until a slot is free
+func (w *connWorkers) dispatch(key string, ordered bool, job func()) {
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	run := func() {
+		defer func() {
+			<-w.slots
+			w.wg.Done()
+		}()
+		job()
+	}
+	if !ordered {
+		go run()
+		return
+	}
+	w.m.Lock()
+	if queue, ok := w.lanes[key]; ok {
+		w.lanes[key] = append(queue, run)
+		w.m.Unlock()
+		return
+	}
+	w.lanes[key] = nil
+	w.m.Unlock()
+	go w.drain(key, run)
+}
+
+// run jobs of a key one by one until none is queued
+func (w *connWorkers) drain(key string, run func()) {
+	for {
+		run()
+		w.m.Lock()
+		queue := w.lanes[key]
+		if len(queue) == 0 {
+			delete(w.lanes, key)
+			w.m.Unlock()
+			return
+		}
+		run, w.lanes[key] = queue[0], queue[1:]
+		w.m.Unlock()
+	}
+}
+
+// wait for all jobs done
+func (w *connWorkers) wait() {
+	w.wg.Wait()
+}
+
+// serve a frame by a worker. handlers get a copy of the connection cache, values shared by frames are in SharedOf(cache).
+// the connection is closed
+// when the error policy says so, and the reader ends on it
+func (wsh *WebSocketHelper) serveAsync(w *connWorkers, conn *websocket.Conn, raw []byte, cache map[string]interface{}, span Span, handleE func(error)) {
+	frameCache := make(map[string]interface{}, len(cache))
+	for k, v := range cache {
+		frameCache[k] = v
+	}
+	command := wsh.CommandOf(raw)
+	key, ordered := wsh.orderKeyOf(command, raw, frameCache)
+	w.dispatch(key, ordered, func() {
+		defer func() {
+			if e := recover(); e != nil {
+				wsh.Logger().Error("recover from panic", "panic", fmt.Sprintf("%v", e), "remote", conn.RemoteAddr())
+				conn.Close()
+			}
+		}()
+		er := wsh.serve(conn, raw, frameCache)
+		if er != nil {
+			span.RecordError(er)
+		}
+		span.End()
+		if er != nil && !wsh.handleError(conn, er, handleE) {
+			conn.Close()
+		}
+	})
+}
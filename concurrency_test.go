@@ -0,0 +1,103 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrency(t *testing.T) {
+	const SLOW = 1000
+	wsh := NewWsHelper(nil, WithConcurrency(8))
+	var m sync.Mutex
+	var sent []string
+	wsh.HandleFunc(SLOW, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		time.Sleep(300 * time.Millisecond)
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Desc: "slow"})
+	})
+	wsh.HandleFunc(SEND_ONE, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return NewError(ERR_BAD_REQUEST, "bad json")
+		}
+		// earlier messages take longer, they'd be overtaken if not ordered
+		n, _ := strconv.Atoi(in.Message)
+		time.Sleep(time.Duration(5-n) * 10 * time.Millisecond)
+		m.Lock()
+		sent = append(sent, in.To+in.Message)
+		m.Unlock()
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Desc: in.To + in.Message})
+	})
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+
+	c.Send(SLOW, `{}`)
+	for i := 1; i <= 3; i++ {
+		c.Send(SEND_ONE, `{"to":"bob","message":"`+strconv.Itoa(i)+`"}`)
+	}
+	c.Send(SEND_ONE, `{"to":"tom","message":"4"}`)
+
+	var replies []string
+	for i := 0; i < 5; i++ {
+		replies = append(replies, c.Reply().Desc)
+	}
+	// the slow command blocks nothing, messages to bob keep their order, tom's overtakes them
+	util.Assertf(replies[4] == "slow", t, "want the slow reply last but got %v", replies)
+	util.Assertf(replies[0] == "tom4", t, "want tom's reply first but got %v", replies)
+	util.Assertf(strings.Join(replies[1:4], ",") == "bob1,bob2,bob3", t, "want bob's replies in order but got %v", replies)
+	m.Lock()
+	util.Assertf(strings.Join(sent, ",") == "tom4,bob1,bob2,bob3", t, "bad order %v", sent)
+	m.Unlock()
+}
+
+func TestConnWorkersBackPressure(t *testing.T) {
+	w := newConnWorkers(2)
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		w.dispatch("", false, func() { <-release })
+	}
+	dispatched := make(chan struct{})
+	go func() {
+		w.dispatch("", false, func() {})
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("want dispatch blocked when the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("want dispatch going on when a slot is free")
+	}
+	close(release)
+	w.wait()
+}
+
+// frames handled by workers share values by SharedOf(cache), values set in the cache are their own
+func TestConcurrencySharedCache(t *testing.T) {
+	const SET, GET = 1000, 1001
+	wsh := NewWsHelper(nil, WithConcurrency(4))
+	wsh.HandleFunc(SET, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		cache["user"] = "tom"
+		SharedOf(cache).Store("user", "tom")
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE})
+	})
+	wsh.HandleFunc(GET, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		_, inCache := cache["user"]
+		shared, _ := SharedOf(cache).Load("user")
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Desc: fmt.Sprintf("%v %v", inCache, shared)})
+	})
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+	c.Send(SET, `{}`)
+	c.Reply()
+	c.Send(GET, `{}`)
+	reply := c.Reply()
+	util.Assertf(reply.Desc == "false tom", t, "want the shared value only but got '%s'", reply.Desc)
+}
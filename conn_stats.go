@@ -0,0 +1,137 @@
+package wshelper
+
+import (
+	"golang.org/x/net/websocket"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// statistics of a connection served by the dispatcher
+type ConnStats struct {
+	ConnectedAt time.Time
+	Serializer  string
+	Compressor  string
+
+	// unix nano
+	lastActivity int64
+	framesIn     uint64
+	framesOut    uint64
+	bytesIn      uint64
+	bytesOut     uint64
+}
+
+func (s *ConnStats) in(size int) {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	atomic.AddUint64(&s.framesIn, 1)
+	atomic.AddUint64(&s.bytesIn, uint64(size))
+}
+
+func (s *ConnStats) out(size int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.framesOut, 1)
+	atomic.AddUint64(&s.bytesOut, uint64(size))
+}
+
+// a snapshot of a connection
+type ConnInfo struct {
+	Key          string    `json:"key"` // empty if not Online
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"` // when the last message was read
+	Serializer   string    `json:"serializer"`
+	Compressor   string    `json:"compressor"`
+	FramesIn     uint64    `json:"frames_in"`
+	FramesOut    uint64    `json:"frames_out"`
+	BytesIn      uint64    `json:"bytes_in"`
+	BytesOut     uint64    `json:"bytes_out"`
+	Tags         Tags      `json:"tags,omitempty"`
+	Debug        bool      `json:"debug,omitempty"`
+}
+
+// start tracking a connection
+func (cp *ConnectionPool) track(conn *websocket.Conn, serializer string, compressor string) *ConnStats {
+	now := time.Now()
+	s := &ConnStats{ConnectedAt: now, Serializer: serializer, Compressor: compressor, lastActivity: now.UnixNano()}
+	cp.stats.Store(conn, s)
+	return s
+}
+
+// stop tracking a closed connection, and remove its key if it's still the connection of the key
+func (cp *ConnectionPool) untrack(conn *websocket.Conn) {
+	cp.stats.Delete(conn)
+	cp.tags.Delete(conn)
+	cp.debug.Delete(conn)
+	if key, ok := cp.KeyOf(conn); ok {
+		cp.keys.Delete(conn)
+		cp.removeIf(key, conn)
+	}
+}
+
+func (cp *ConnectionPool) statsOf(conn *websocket.Conn) *ConnStats {
+	s, _ := cp.stats.Load(conn)
+	stats, _ := s.(*ConnStats)
+	return stats
+}
+
+func (cp *ConnectionPool) infoOf(conn *websocket.Conn, s *ConnStats) ConnInfo {
+	key, _ := cp.KeyOf(conn)
+	info := ConnInfo{
+		Key:          key,
+		ConnectedAt:  s.ConnectedAt,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+		Serializer:   s.Serializer,
+		Compressor:   s.Compressor,
+		FramesIn:     atomic.LoadUint64(&s.framesIn),
+		FramesOut:    atomic.LoadUint64(&s.framesOut),
+		BytesIn:      atomic.LoadUint64(&s.bytesIn),
+		BytesOut:     atomic.LoadUint64(&s.bytesOut),
+		Tags:         cp.Tags(conn),
+		Debug:        cp.IsDebug(conn),
+	}
+	if req := conn.Request(); req != nil {
+		info.RemoteAddr = req.RemoteAddr
+	}
+	return info
+}
+
+// snapshots of all connections served by the dispatcher, in the order they connected
+func (cp *ConnectionPool) Connections() []ConnInfo {
+	rs := make([]ConnInfo, 0)
+	cp.stats.Range(func(conn, s interface{}) bool {
+		rs = append(rs, cp.infoOf(conn.(*websocket.Conn), s.(*ConnStats)))
+		return true
+	})
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].ConnectedAt.Before(rs[j].ConnectedAt)
+	})
+	return rs
+}
+
+// the snapshot of the connection of a key
+func (cp *ConnectionPool) ConnectionOf(key string) (ConnInfo, bool) {
+	conn, ok := cp.Get(key)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	s := cp.statsOf(conn)
+	if s == nil {
+		return ConnInfo{Key: key}, true
+	}
+	return cp.infoOf(conn, s), true
+}
+
+// connections served by the dispatcher
+func (cp *ConnectionPool) conns() []*websocket.Conn {
+	var rs []*websocket.Conn
+	cp.stats.Range(func(conn, s interface{}) bool {
+		rs = append(rs, conn.(*websocket.Conn))
+		return true
+	})
+	return rs
+}
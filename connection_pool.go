@@ -2,42 +2,110 @@ package wshelper
 
 import (
 	"context"
-	"fmt"
 	"github.com/fwhezfwhez/errorx"
 	"golang.org/x/net/websocket"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// the default number of shards of a pool
+const DEFAULT_POOL_SHARDS = 32
+
+// connections online are kept in shards by key, each guarded by its own lock,
+// and states of connections in sync.Maps, so reads on the way of a message take no pool-wide lock.
+// the exported Pool map of the single-map pool is gone with M guarding it: cp.Pool[key] becomes cp.Get(key),
+// ranging it becomes cp.Range, and cp.Snapshot() is a copy of it
 type ConnectionPool struct {
 	Full bool
-	Pool map[string]*websocket.Conn
-	M    *sync.RWMutex
+	// guards settings of the pool, not connections
+	M *sync.RWMutex
+
+	shards []*poolShard
+	// connections online, atomic
+	length int64
+	// *websocket.Conn -> key, reverse index of shards
+	keys sync.Map
+	// *websocket.Conn -> Compressor negotiated by the connection
+	compressors sync.Map
+	// *websocket.Conn -> *ConnStats, connections served by the dispatcher, online or not
+	stats sync.Map
+	// *websocket.Conn -> Tags, copied on write under tagsM
+	tags  sync.Map
+	tagsM sync.Mutex
+	// *websocket.Conn -> struct{}, connections in debug mode receiving debug-only replies
+	debug sync.Map
+
+	// messages to offline users are saved here, nil means dropped
+	offline OfflineStore
+	// the min body size to compress, atomic
+	compressThreshold int64
+	// the pool is set full when connections exceed it
+	maxOnline int
+	// logs nothing by default, NewWsHelper sets the logger of wsh
+	logger Logger
+	// *Metrics, nil until EnableMetrics
+	metrics atomic.Value
+}
+
+// key -> connection of a shard
+type poolShard struct {
+	m     sync.RWMutex
+	conns map[string]*websocket.Conn
 }
 
-// new a concurrently safe pool to restore connections
+// new a concurrently safe pool to restore connections, of DEFAULT_POOL_SHARDS shards
 func NewConnectionPool() *ConnectionPool {
-	return &ConnectionPool{
-		Pool: make(map[string]*websocket.Conn),
-		M:    &sync.RWMutex{},
+	return NewShardedConnectionPool(DEFAULT_POOL_SHARDS)
+}
+
+// new a pool of n shards, n <= 0 means DEFAULT_POOL_SHARDS. keys are spread over shards by hash,
+// so more shards mean less contention between users. 1 shard is a single map under a single lock
+func NewShardedConnectionPool(n int) *ConnectionPool {
+	if n <= 0 {
+		n = DEFAULT_POOL_SHARDS
+	}
+	cp := &ConnectionPool{
+		M:      &sync.RWMutex{},
+		shards: make([]*poolShard, n),
+
+		compressThreshold: 1 * KB,
+		maxOnline:         50000,
+		logger:            NopLogger{},
+	}
+	for i := range cp.shards {
+		cp.shards[i] = &poolShard{conns: make(map[string]*websocket.Conn)}
 	}
+	return cp
+}
+
+// the shard of a key by fnv-1a
+func (cp *ConnectionPool) shardOf(key string) *poolShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return cp.shards[h%uint32(len(cp.shards))]
 }
 
 // get length
 func (cp *ConnectionPool) Length() int {
-	cp.M.RLock()
-	defer cp.M.RUnlock()
-	return len(cp.Pool)
+	return int(atomic.LoadInt64(&cp.length))
 }
 
-// add
+// add, a key online already keeps its connection
 func (cp *ConnectionPool) Add(key string, conn *websocket.Conn) {
-	if !cp.IfExist(key) {
-		cp.M.Lock()
-		defer cp.M.Unlock()
-		cp.Pool[key] = conn
+	shard := cp.shardOf(key)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	if _, ok := shard.conns[key]; ok {
+		return
 	}
+	shard.conns[key] = conn
+	cp.keys.Store(conn, key)
+	atomic.AddInt64(&cp.length, 1)
 }
 
 func (cp *ConnectionPool) SetFull(state bool) {
@@ -48,27 +116,132 @@ func (cp *ConnectionPool) SetFull(state bool) {
 
 // delete
 func (cp *ConnectionPool) Remove(key string) {
-	if cp.IfExist(key) {
-		cp.M.Lock()
-		defer cp.M.Unlock()
-		delete(cp.Pool, key)
+	cp.removeIf(key, nil)
+}
+
+// remove a key, only if its connection is conn when conn is not nil
+func (cp *ConnectionPool) removeIf(key string, conn *websocket.Conn) {
+	shard := cp.shardOf(key)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	con, ok := shard.conns[key]
+	if !ok || conn != nil && con != conn {
+		return
 	}
+	delete(shard.conns, key)
+	cp.keys.Delete(con)
+	cp.tags.Delete(con)
+	atomic.AddInt64(&cp.length, -1)
 }
 
 // get
 func (cp *ConnectionPool) Get(key string) (*websocket.Conn, bool) {
-	cp.M.RLock()
-	defer cp.M.RUnlock()
-	con, ok := cp.Pool[key]
+	shard := cp.shardOf(key)
+	shard.m.RLock()
+	defer shard.m.RUnlock()
+	con, ok := shard.conns[key]
 	return con, ok
 }
 
+// get the key of a connection
+func (cp *ConnectionPool) KeyOf(conn *websocket.Conn) (string, bool) {
+	key, ok := cp.keys.Load(conn)
+	if !ok {
+		return "", false
+	}
+	return key.(string), true
+}
+
+// call f on each key online until it returns false. a shard is locked only while it's copied,
+// so f can call methods of the pool. keys added or removed meanwhile may be seen or not
+func (cp *ConnectionPool) Range(f func(key string, conn *websocket.Conn) bool) {
+	var keys []string
+	var conns []*websocket.Conn
+	for _, shard := range cp.shards {
+		keys, conns = keys[:0], conns[:0]
+		shard.m.RLock()
+		for key, conn := range shard.conns {
+			keys = append(keys, key)
+			conns = append(conns, conn)
+		}
+		shard.m.RUnlock()
+		for i := range keys {
+			if !f(keys[i], conns[i]) {
+				return
+			}
+		}
+	}
+}
+
+// a copy of the connections online by key, like the Pool map of the single-map pool.
+//
+// Deprecated: it copies every shard, use Get or Range
+func (cp *ConnectionPool) Snapshot() map[string]*websocket.Conn {
+	rs := make(map[string]*websocket.Conn, cp.Length())
+	cp.Range(func(key string, conn *websocket.Conn) bool {
+		rs[key] = conn
+		return true
+	})
+	return rs
+}
+
+// set the store to save messages to offline users
+func (cp *ConnectionPool) SetOfflineStore(store OfflineStore) {
+	cp.M.Lock()
+	defer cp.M.Unlock()
+	cp.offline = store
+}
+
+// save a message to an offline user, it's dropped if no offline store set
+func (cp *ConnectionPool) saveOffline(data []byte, to string) error {
+	cp.M.RLock()
+	store := cp.offline
+	cp.M.RUnlock()
+	if store == nil {
+		cp.metricsOf().drop(DROP_OFFLINE)
+		return nil
+	}
+	// debug-only replies are not saved for offline users
+	if _, debug := splitDebugFlag(data); debug {
+		return nil
+	}
+	return store.Push(to, data)
+}
+
 // whether a key exists
 func (cp *ConnectionPool) IfExist(key string) bool {
+	_, ok := cp.Get(key)
+	return ok
+}
+
+// set the max connections online, beyond which the supervisor sets the pool full
+func (cp *ConnectionPool) SetMaxOnline(max int) {
+	cp.M.Lock()
+	defer cp.M.Unlock()
+	cp.maxOnline = max
+}
+
+// get the max connections online
+func (cp *ConnectionPool) MaxOnline() int {
 	cp.M.RLock()
 	defer cp.M.RUnlock()
-	_, ok := cp.Pool[key]
-	return ok
+	return cp.maxOnline
+}
+
+// set the logger, nil means NopLogger
+func (cp *ConnectionPool) SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	cp.M.Lock()
+	defer cp.M.Unlock()
+	cp.logger = l
+}
+
+func (cp *ConnectionPool) loggerOf() Logger {
+	cp.M.RLock()
+	defer cp.M.RUnlock()
+	return cp.logger
 }
 
 // a supervisor to keep pool stable
@@ -76,13 +249,14 @@ func (cp *ConnectionPool) Supervisor() context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func(ctx context.Context) {
-		fmt.Println("supervisor for connection pool has been auto-started")
+		cp.loggerOf().Debug("connection pool supervisor started")
 		for {
 			select {
 			case <-ctx.Done():
-				fmt.Println("connection pool supervisor successfully canceled")
+				cp.loggerOf().Debug("connection pool supervisor canceled")
+				return
 			default:
-				if cp.Length() > v.GetInt("maxOnlineConnPerPool") {
+				if cp.Length() > cp.MaxOnline() {
 					// the max num of conn is weakly consistent, it's ok to overweight not far,so no need to add lock here
 					cp.SetFull(true)
 				} else {
@@ -95,20 +269,47 @@ func (cp *ConnectionPool) Supervisor() context.CancelFunc {
 	return cancel
 }
 
-// send msg to a user
+// write to a connection in a span of the frame ctx
+func (cp *ConnectionPool) WriteContext(ctx context.Context, conn *websocket.Conn, data []byte) error {
+	_, span := StartSpan(ctx, SPAN_WRITE)
+	span.SetAttributes("bytes", len(data))
+	e := cp.Write(conn, data)
+	if e != nil {
+		span.RecordError(e)
+	}
+	span.End()
+	return e
+}
+
+// send msg to a user, if the user is offline, msg will be saved to the offline store
 func (cp *ConnectionPool) SendOne(data []byte, to string) error {
-	cp.M.RLock()
+	return cp.SendOneContext(context.Background(), data, to)
+}
+
+// SendOne in a span of the frame ctx, handlers pass wshelper.ContextOf(cache)
+func (cp *ConnectionPool) SendOneContext(ctx context.Context, data []byte, to string) error {
 	con, ok := cp.Get(to)
-	cp.M.RUnlock()
 	if !ok {
-		return nil
+		return cp.saveOffline(data, to)
 	}
-	return websocket.Message.Send(con, data)
+	e := cp.WriteContext(ctx, con, data)
+	if e == io.EOF {
+		return cp.saveOffline(data, to)
+	}
+	return e
 }
 
-// eof and user offline is not regarded as error, since record will be saved to database,
-// when user off-line or connection closed by client, this real-time chat  does nothing
+// eof and user offline is not regarded as error, since msg will be saved to the offline store,
+// and delivered when the user is online again
 func (cp *ConnectionPool) SendMany(data []byte, tos ... string) error {
+	return cp.SendManyContext(context.Background(), data, tos...)
+}
+
+// SendMany in a span of the frame ctx, handlers pass wshelper.ContextOf(cache)
+func (cp *ConnectionPool) SendManyContext(ctx context.Context, data []byte, tos ...string) error {
+	ctx, span := StartSpan(ctx, SPAN_SEND_MANY)
+	span.SetAttributes("targets", len(tos), "bytes", len(data))
+	defer span.End()
 	var er = make(chan error, len(tos))
 	var wg = sync.WaitGroup{}
 	wg.Add(len(tos))
@@ -116,22 +317,28 @@ func (cp *ConnectionPool) SendMany(data []byte, tos ... string) error {
 	for _, to := range tos {
 		go func(to string, wg *sync.WaitGroup) {
 			defer wg.Done()
-			cp.M.RLock()
 			con, ok := cp.Get(to)
-			cp.M.RUnlock()
 			if !ok {
+				if e := cp.saveOffline(data, to); e != nil {
+					er <- errorx.Wrap(e)
+				}
 				return
 			}
 
-			e := websocket.Message.Send(con, data)
+			e := cp.WriteContext(ctx, con, data)
 			if e != nil {
 				if e != io.EOF {
 					er <- errorx.New(e)
+					return
+				}
+				if e = cp.saveOffline(data, to); e != nil {
+					er <- errorx.Wrap(e)
 				}
 			}
 		}(to, &wg)
 	}
 	wg.Wait()
+	close(er)
 	var errors = make([]error, 0, len(tos))
 L:
 	for {
@@ -141,5 +348,8 @@ L:
 		}
 		errors = append(errors,e)
 	}
+	if len(errors) > 0 {
+		span.RecordError(errors[0])
+	}
 	return errorx.GroupErrors(errors...)
 }
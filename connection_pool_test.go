@@ -0,0 +1,197 @@
+package wshelper
+
+import (
+	"bufio"
+	"eyas/wshelper/util"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedConnectionPool(t *testing.T) {
+	pool := NewShardedConnectionPool(4)
+	conns := make([]*websocket.Conn, 10)
+	for i := range conns {
+		conns[i] = &websocket.Conn{}
+		pool.Add("user"+strconv.Itoa(i), conns[i])
+	}
+	// a key online keeps its connection
+	pool.Add("user0", &websocket.Conn{})
+	util.Assertf(pool.Length() == 10, t, "want 10 online but got %d", pool.Length())
+	conn, ok := pool.Get("user3")
+	util.Assertf(ok && conn == conns[3], t, "bad connection of user3")
+	key, ok := pool.KeyOf(conns[0])
+	util.Assertf(ok && key == "user0", t, "want user0 but got '%s'", key)
+	snapshot := pool.Snapshot()
+	util.Assertf(len(snapshot) == 10 && snapshot["user0"] == conns[0], t, "bad snapshot %v", snapshot)
+
+	pool.Remove("user3")
+	_, ok = pool.KeyOf(conns[3])
+	util.Assertf(!pool.IfExist("user3") && !ok && pool.Length() == 9, t, "user3 should be removed")
+	// untracking a connection removes its key only if it's still the connection of the key
+	pool.Add("user3", conns[4])
+	pool.untrack(conns[3])
+	util.Assertf(pool.IfExist("user3"), t, "user3 should be kept")
+
+	var n int
+	pool.Range(func(key string, conn *websocket.Conn) bool {
+		// the pool can be used inside Range
+		pool.Get(key)
+		n++
+		return true
+	})
+	util.Assertf(n == 10, t, "want 10 ranged but got %d", n)
+	n = 0
+	pool.Range(func(key string, conn *websocket.Conn) bool {
+		n++
+		return n < 3
+	})
+	util.Assertf(n == 3, t, "want range stopped at 3 but got %d", n)
+}
+
+// a net.Conn discarding what's written
+type discardConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *discardConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+func (c *discardConn) Close() error { return nil }
+
+// a hijackable writer handing the connection to the websocket server
+type hijackWriter struct {
+	httptest.ResponseRecorder
+	conn *discardConn
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// server side connections writing to nowhere, so that benchmarks measure the pool rather than the network
+func discardConns(n int) ([]*websocket.Conn, func()) {
+	closed := make(chan struct{})
+	accepted := make(chan *websocket.Conn)
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		accepted <- conn
+		<-closed
+	}}
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		go server.ServeHTTP(&hijackWriter{conn: &discardConn{closed: closed}}, r)
+		conns[i] = <-accepted
+	}
+	return conns, func() { close(closed) }
+}
+
+// the pool before sharding as the baseline, a single map and the states of connections under one RWMutex,
+// which every write takes twice, to get the connection and its compressor
+type singleMapPool struct {
+	m           sync.RWMutex
+	pool        map[string]*websocket.Conn
+	keys        map[*websocket.Conn]string
+	compressors map[*websocket.Conn]Compressor
+}
+
+func (p *singleMapPool) Add(key string, conn *websocket.Conn) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.pool[key]; !ok {
+		p.pool[key] = conn
+		p.keys[conn] = key
+	}
+}
+
+func (p *singleMapPool) Remove(key string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.keys, p.pool[key])
+	delete(p.pool, key)
+}
+
+func (p *singleMapPool) SendOne(data []byte, to string) error {
+	p.m.RLock()
+	conn, ok := p.pool[to]
+	p.m.RUnlock()
+	if !ok {
+		return nil
+	}
+	p.m.RLock()
+	_ = p.compressors[conn]
+	p.m.RUnlock()
+	return websocket.Message.Send(conn, data)
+}
+
+// mixed Add/Remove/SendOne over the single-map pool as the baseline, and over a single shard and more shards
+func BenchmarkConnectionPool(b *testing.B) {
+	conns, closeAll := discardConns(64)
+	defer closeAll()
+	const users = 10000
+	keys := make([]string, users)
+	for i := range keys {
+		keys[i] = "user" + strconv.Itoa(i)
+	}
+	data := []byte(strings.Repeat("a", 32) + `{"message":"hi"}`)
+
+	type pool interface {
+		Add(key string, conn *websocket.Conn)
+		Remove(key string)
+		SendOne(data []byte, to string) error
+	}
+	pools := []func() pool{func() pool {
+		return &singleMapPool{
+			pool:        make(map[string]*websocket.Conn),
+			keys:        make(map[*websocket.Conn]string),
+			compressors: make(map[*websocket.Conn]Compressor),
+		}
+	}}
+	names := []string{"single-map"}
+	for _, shards := range []int{1, DEFAULT_POOL_SHARDS, 256} {
+		shards := shards
+		pools = append(pools, func() pool { return NewShardedConnectionPool(shards) })
+		names = append(names, "shards="+strconv.Itoa(shards))
+	}
+
+	for n, newPool := range pools {
+		b.Run(names[n], func(b *testing.B) {
+			pool := newPool()
+			for i, key := range keys {
+				pool.Add(key, conns[i%len(conns)])
+			}
+			var seq uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// goroutines start at different users
+				i := atomic.AddUint64(&seq, 1) * 7919
+				for pb.Next() {
+					i++
+					key := keys[i%users]
+					switch i % 10 {
+					case 0:
+						pool.Remove(key)
+					case 1:
+						pool.Add(key, conns[i%uint64(len(conns))])
+					default:
+						pool.SendOne(data, key)
+					}
+				}
+			})
+		})
+	}
+}
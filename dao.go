@@ -1 +1,27 @@
 package wshelper
+
+import (
+	"eyas/wshelper/dao"
+	"github.com/fwhezfwhez/errorx"
+)
+
+// open the dao.Store set by Options.DaoDriver and Options.DaoDSN, tables are created if Options.DaoMigrate is true.
+// the driver package should be imported, like _ "eyas/wshelper/dao/mysql". if the driver is empty, a memory store is opened
+func (wsh *WebSocketHelper) OpenStore() (dao.Store, error) {
+	opts := wsh.Options()
+	driver := opts.DaoDriver
+	if driver == "" {
+		driver = "memory"
+	}
+	store, e := dao.Open(driver, opts.DaoDSN)
+	if e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	if opts.DaoMigrate {
+		if e = store.Migrate(); e != nil {
+			store.Close()
+			return nil, errorx.Wrap(e)
+		}
+	}
+	return store, nil
+}
@@ -1,4 +1,7 @@
 // doc:
-// according to the db specifc, to replace wshelper/dao.go with  /mysql/dao.go or /postgres/dao.go
+// dao defines Store, everything wshelper persists: users, friendships, groups, rooms, messages and offline inbox.
+// a store is selected at runtime by driver name, 'memory' is built in, 'mysql' and 'postgres' are registered by importing
+// eyas/wshelper/dao/mysql and eyas/wshelper/dao/postgres, both are database/sql based on SqlStore with their own Dialect.
+// wsh.OpenStore() opens the store set by Options.DaoDriver and Options.DaoDSN.
+// tables are defined in migrations/*.sql of both packages, applied by Store.Migrate or by a migration tool.
 package dao
-
@@ -0,0 +1,383 @@
+package dao
+
+import (
+	"github.com/fwhezfwhez/errorx"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// an in-memory reference realization of Store, used for testing
+type MemoryStore struct {
+	m        *sync.RWMutex
+	lastId   int64
+	channels map[string][]Message
+
+	users   map[string]User
+	friends map[string]map[string]Friendship
+	groups  map[string]Group
+	rooms   map[string]Room
+	// group id/room id -> user keys
+	groupMembers map[string]map[string]bool
+	roomMembers  map[string]map[string]bool
+
+	lastSeq int64
+	inboxes map[string][]InboxMessage
+}
+
+// new a memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		m:            &sync.RWMutex{},
+		channels:     make(map[string][]Message),
+		users:        make(map[string]User),
+		friends:      make(map[string]map[string]Friendship),
+		groups:       make(map[string]Group),
+		rooms:        make(map[string]Room),
+		groupMembers: make(map[string]map[string]bool),
+		roomMembers:  make(map[string]map[string]bool),
+		inboxes:      make(map[string][]InboxMessage),
+	}
+}
+
+func channelKey(channelType int, channelId string) string {
+	return strconv.Itoa(channelType) + "/" + channelId
+}
+
+// migrate, nothing to do
+func (s *MemoryStore) Migrate() error {
+	return nil
+}
+
+// close, nothing to do
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// save user
+func (s *MemoryStore) SaveUser(u User) error {
+	if u.Key == "" {
+		return errorx.NewFromString("user key required")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if old, ok := s.users[u.Key]; ok {
+		u.CreatedAt = old.CreatedAt
+	} else if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	s.users[u.Key] = u
+	return nil
+}
+
+// get user
+func (s *MemoryStore) GetUser(key string) (User, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	u, ok := s.users[key]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// delete user
+func (s *MemoryStore) DeleteUser(key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.users, key)
+	return nil
+}
+
+// add friend
+func (s *MemoryStore) AddFriend(f Friendship) error {
+	if f.UserKey == "" || f.FriendKey == "" {
+		return errorx.NewFromString("user key and friend key required")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.friends[f.UserKey] == nil {
+		s.friends[f.UserKey] = make(map[string]Friendship)
+	}
+	if old, ok := s.friends[f.UserKey][f.FriendKey]; ok {
+		f.CreatedAt = old.CreatedAt
+	} else if f.CreatedAt.IsZero() {
+		f.CreatedAt = time.Now()
+	}
+	s.friends[f.UserKey][f.FriendKey] = f
+	return nil
+}
+
+// remove friend
+func (s *MemoryStore) RemoveFriend(userKey string, friendKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.friends[userKey], friendKey)
+	return nil
+}
+
+// list friends, ordered by friend key
+func (s *MemoryStore) ListFriends(userKey string) ([]Friendship, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	var rs = make([]Friendship, 0, len(s.friends[userKey]))
+	for _, f := range s.friends[userKey] {
+		rs = append(rs, f)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].FriendKey < rs[j].FriendKey })
+	return rs, nil
+}
+
+// save group
+func (s *MemoryStore) SaveGroup(g Group) error {
+	if g.Id == "" {
+		return errorx.NewFromString("group id required")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if old, ok := s.groups[g.Id]; ok {
+		g.CreatedAt = old.CreatedAt
+	} else if g.CreatedAt.IsZero() {
+		g.CreatedAt = time.Now()
+	}
+	s.groups[g.Id] = g
+	return nil
+}
+
+// get group
+func (s *MemoryStore) GetGroup(id string) (Group, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return Group{}, ErrNotFound
+	}
+	return g, nil
+}
+
+// delete group
+func (s *MemoryStore) DeleteGroup(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.groups, id)
+	delete(s.groupMembers, id)
+	return nil
+}
+
+// join group
+func (s *MemoryStore) JoinGroup(groupId string, userKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return join(s.groupMembers, groupId, userKey, s.groups[groupId].Id != "")
+}
+
+// leave group
+func (s *MemoryStore) LeaveGroup(groupId string, userKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.groupMembers[groupId], userKey)
+	return nil
+}
+
+// group members, ordered by user key
+func (s *MemoryStore) GroupMembers(groupId string) ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return members(s.groupMembers, groupId), nil
+}
+
+// save room
+func (s *MemoryStore) SaveRoom(r Room) error {
+	if r.Id == "" {
+		return errorx.NewFromString("room id required")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if old, ok := s.rooms[r.Id]; ok {
+		r.CreatedAt = old.CreatedAt
+	} else if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	s.rooms[r.Id] = r
+	return nil
+}
+
+// get room
+func (s *MemoryStore) GetRoom(id string) (Room, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	r, ok := s.rooms[id]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	return r, nil
+}
+
+// delete room
+func (s *MemoryStore) DeleteRoom(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.rooms, id)
+	delete(s.roomMembers, id)
+	return nil
+}
+
+// join room
+func (s *MemoryStore) JoinRoom(roomId string, userKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return join(s.roomMembers, roomId, userKey, s.rooms[roomId].Id != "")
+}
+
+// leave room
+func (s *MemoryStore) LeaveRoom(roomId string, userKey string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.roomMembers[roomId], userKey)
+	return nil
+}
+
+// room members, ordered by user key
+func (s *MemoryStore) RoomMembers(roomId string) ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return members(s.roomMembers, roomId), nil
+}
+
+func join(all map[string]map[string]bool, id string, userKey string, exist bool) error {
+	if !exist {
+		return ErrNotFound
+	}
+	if all[id] == nil {
+		all[id] = make(map[string]bool)
+	}
+	all[id][userKey] = true
+	return nil
+}
+
+func members(all map[string]map[string]bool, id string) []string {
+	var rs = make([]string, 0, len(all[id]))
+	for k := range all[id] {
+		rs = append(rs, k)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// save message
+func (s *MemoryStore) SaveMessage(msg *Message) error {
+	if msg.ChannelId == "" {
+		return errorx.NewFromString("message channel id required")
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastId++
+	msg.Id = s.lastId
+	key := channelKey(msg.ChannelType, msg.ChannelId)
+	s.channels[key] = append(s.channels[key], *msg)
+	return nil
+}
+
+// history
+func (s *MemoryStore) History(q HistoryQuery) ([]Message, bool, error) {
+	limit := q.NormalLimit()
+	s.m.RLock()
+	defer s.m.RUnlock()
+	channel := s.channels[channelKey(q.ChannelType, q.ChannelId)]
+
+	var rs = make([]Message, 0, limit)
+	if q.After > 0 {
+		i := sort.Search(len(channel), func(i int) bool { return channel[i].Id > q.After })
+		for ; i < len(channel); i++ {
+			if !q.Match(channel[i]) {
+				continue
+			}
+			if len(rs) == limit {
+				return rs, true, nil
+			}
+			rs = append(rs, channel[i])
+		}
+		return rs, false, nil
+	}
+
+	i := len(channel) - 1
+	if q.Before > 0 {
+		i = sort.Search(len(channel), func(i int) bool { return channel[i].Id >= q.Before }) - 1
+	}
+	var hasMore bool
+	for ; i >= 0; i-- {
+		if !q.Match(channel[i]) {
+			continue
+		}
+		if len(rs) == limit {
+			hasMore = true
+			break
+		}
+		rs = append(rs, channel[i])
+	}
+	// ascending
+	for l, r := 0, len(rs)-1; l < r; l, r = l+1, r-1 {
+		rs[l], rs[r] = rs[r], rs[l]
+	}
+	return rs, hasMore, nil
+}
+
+// push inbox
+func (s *MemoryStore) PushInbox(userKey string, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastSeq++
+	s.inboxes[userKey] = append(s.inboxes[userKey], InboxMessage{
+		Seq:     s.lastSeq,
+		UserKey: userKey,
+		Data:    data,
+		SavedAt: time.Now(),
+	})
+	return nil
+}
+
+// list inbox
+func (s *MemoryStore) ListInbox(userKey string, since time.Time) ([]InboxMessage, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	var rs = make([]InboxMessage, 0, len(s.inboxes[userKey]))
+	for _, msg := range s.inboxes[userKey] {
+		if msg.SavedAt.After(since) {
+			rs = append(rs, msg)
+		}
+	}
+	return rs, nil
+}
+
+// ack inbox
+func (s *MemoryStore) AckInbox(userKey string, seq int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.filterInbox(userKey, func(msg InboxMessage) bool { return msg.Seq > seq })
+}
+
+// expire inbox
+func (s *MemoryStore) ExpireInbox(userKey string, before time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.filterInbox(userKey, func(msg InboxMessage) bool { return !msg.SavedAt.Before(before) })
+}
+
+// keep messages matching f
+func (s *MemoryStore) filterInbox(userKey string, keep func(msg InboxMessage) bool) error {
+	var rs = s.inboxes[userKey][:0]
+	for _, msg := range s.inboxes[userKey] {
+		if keep(msg) {
+			rs = append(rs, msg)
+		}
+	}
+	if len(rs) == 0 {
+		delete(s.inboxes, userKey)
+		return nil
+	}
+	s.inboxes[userKey] = rs
+	return nil
+}
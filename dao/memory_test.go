@@ -0,0 +1,72 @@
+package dao
+
+import (
+	"testing"
+)
+
+func TestMemoryStore_History(t *testing.T) {
+	s := NewMemoryStore()
+	channel := OneToOneChannel("tom", "bob")
+	for i := 0; i < 10; i++ {
+		subType := 1
+		if i%2 == 1 {
+			subType = 2
+		}
+		if e := s.SaveMessage(&Message{ChannelType: CHANNEL_ONE, ChannelId: channel, From: "tom", To: "bob", SubType: subType}); e != nil {
+			t.Fatal(e.Error())
+		}
+	}
+	s.SaveMessage(&Message{ChannelType: CHANNEL_GROUP, ChannelId: "g1", SubType: 1})
+
+	cases := []struct {
+		q       HistoryQuery
+		ids     []int64
+		hasMore bool
+	}{
+		{HistoryQuery{Limit: 3}, []int64{8, 9, 10}, true},
+		{HistoryQuery{Before: 3, Limit: 3}, []int64{1, 2}, false},
+		{HistoryQuery{After: 7, Limit: 3}, []int64{8, 9, 10}, false},
+		{HistoryQuery{After: 2, Limit: 3}, []int64{3, 4, 5}, true},
+		{HistoryQuery{Before: 9, Limit: 2, SubTypes: []int{2}}, []int64{6, 8}, true},
+	}
+	for i, c := range cases {
+		c.q.ChannelType = CHANNEL_ONE
+		c.q.ChannelId = channel
+		msgs, hasMore, e := s.History(c.q)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		if hasMore != c.hasMore || len(msgs) != len(c.ids) {
+			t.Fatalf("case %d: want %v more %v but got %d msgs more %v", i, c.ids, c.hasMore, len(msgs), hasMore)
+		}
+		for j, msg := range msgs {
+			if msg.Id != c.ids[j] {
+				t.Fatalf("case %d: want %v but got id %d at %d", i, c.ids, msg.Id, j)
+			}
+		}
+	}
+}
+
+func TestMemoryStore_Groups(t *testing.T) {
+	var s Store = NewMemoryStore()
+	if e := s.JoinGroup("g1", "tom"); e != ErrNotFound {
+		t.Fatalf("want ErrNotFound but got %v", e)
+	}
+	if e := s.SaveGroup(Group{Id: "g1", Name: "family", Owner: "tom"}); e != nil {
+		t.Fatal(e.Error())
+	}
+	s.JoinGroup("g1", "tom")
+	s.JoinGroup("g1", "bob")
+	s.JoinGroup("g1", "bob")
+	members, _ := s.GroupMembers("g1")
+	if len(members) != 2 || members[0] != "bob" {
+		t.Fatalf("want [bob tom] but got %v", members)
+	}
+	s.DeleteGroup("g1")
+	if _, e := s.GetGroup("g1"); e != ErrNotFound {
+		t.Fatalf("want ErrNotFound but got %v", e)
+	}
+	if members, _ = s.GroupMembers("g1"); len(members) != 0 {
+		t.Fatalf("want no members but got %v", members)
+	}
+}
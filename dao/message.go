@@ -0,0 +1,91 @@
+package dao
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// channel types a message belongs to
+const (
+	CHANNEL_ONE   = 1 + iota // one-to-one chat
+	CHANNEL_GROUP            // chat group
+	CHANNEL_ROOM             // chat room
+)
+
+// the default and max limit of a history page
+const (
+	DEFAULT_HISTORY_LIMIT = 20
+	MAX_HISTORY_LIMIT     = 100
+)
+
+// a persisted chat message
+type Message struct {
+	// assigned by store when saved, increasing
+	Id          int64
+	ChannelType int
+	// group id, room id, or OneToOneChannel(from, to)
+	ChannelId string
+	From      string
+	To        string
+	// TEXT, VOICE, IMAGE ...
+	SubType int
+	Body    []byte
+	SendAt  time.Time
+}
+
+// a history query, pages are cut by message id.
+// Before > 0 gets messages right before it, After > 0 gets messages right after it,
+// neither gets the latest messages. messages are always returned in ascending order of id
+type HistoryQuery struct {
+	ChannelType int
+	ChannelId   string
+	Before      int64
+	After       int64
+	Limit       int
+	// empty means all sub types
+	SubTypes []int
+}
+
+// persist and query messages
+type MessageStore interface {
+	// save a message, msg.Id will be set
+	SaveMessage(msg *Message) error
+	// get a page of history, hasMore tells whether more messages exist beyond the page in the query direction
+	History(q HistoryQuery) (msgs []Message, hasMore bool, e error)
+}
+
+// escape keys of a one-to-one channel
+var channelKeyEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// the channel id of a one-to-one chat, same for both sides.
+// keys are joined by ':', with '\' and ':' in them escaped by '\' so that different pairs never collide
+func OneToOneChannel(a string, b string) string {
+	keys := []string{a, b}
+	sort.Strings(keys)
+	return channelKeyEscaper.Replace(keys[0]) + ":" + channelKeyEscaper.Replace(keys[1])
+}
+
+// limit in range (0, MAX_HISTORY_LIMIT]
+func (q HistoryQuery) NormalLimit() int {
+	if q.Limit <= 0 {
+		return DEFAULT_HISTORY_LIMIT
+	}
+	if q.Limit > MAX_HISTORY_LIMIT {
+		return MAX_HISTORY_LIMIT
+	}
+	return q.Limit
+}
+
+// whether a message is of the wanted sub types
+func (q HistoryQuery) Match(msg Message) bool {
+	if len(q.SubTypes) == 0 {
+		return true
+	}
+	for _, t := range q.SubTypes {
+		if t == msg.SubType {
+			return true
+		}
+	}
+	return false
+}
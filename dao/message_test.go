@@ -0,0 +1,19 @@
+package dao
+
+import (
+	"testing"
+)
+
+func TestOneToOneChannel(t *testing.T) {
+	if OneToOneChannel("tom", "bob") != "bob:tom" || OneToOneChannel("bob", "tom") != "bob:tom" {
+		t.Fatalf("want 'bob:tom' for both sides but got '%s'", OneToOneChannel("tom", "bob"))
+	}
+	seen := make(map[string][2]string)
+	for _, pair := range [][2]string{{"a:b", "c"}, {"a", "b:c"}, {`a\`, "b"}, {"a", `\b`}, {`a\:b`, "c"}, {`a\`, ":b"}} {
+		channel := OneToOneChannel(pair[0], pair[1])
+		if other, ok := seen[channel]; ok {
+			t.Fatalf("%v and %v collide as '%s'", pair, other, channel)
+		}
+		seen[channel] = pair
+	}
+}
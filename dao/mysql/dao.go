@@ -1 +1,73 @@
+// mysql realization of dao.Store, registered as dao driver 'mysql'.
+// a mysql driver should be imported, and parseTime=true is required in dsn, like:
+//
+//	import _ "github.com/go-sql-driver/mysql"
+//	import _ "eyas/wshelper/dao/mysql"
+//	store, e := dao.Open("mysql", "user:password@tcp(127.0.0.1:3306)/wshelper?parseTime=true")
 package mysql
+
+import (
+	"database/sql"
+	"embed"
+	"eyas/wshelper/dao"
+	"github.com/fwhezfwhez/errorx"
+	"strings"
+)
+
+func init() {
+	dao.Register("mysql", Open)
+}
+
+// open a mysql store
+func Open(dsn string) (dao.Store, error) {
+	db, e := sql.Open("mysql", dsn)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	return dao.NewSqlStore(db, Dialect{}), nil
+}
+
+// mysql dialect
+type Dialect struct{}
+
+// placeholder
+func (Dialect) Placeholder(i int) string {
+	return "?"
+}
+
+// upsert
+func (Dialect) Upsert(table string, cols []string, keys []string, updates []string) string {
+	values := "(?" + strings.Repeat(", ?", len(cols)-1) + ")"
+	if len(updates) == 0 {
+		return "INSERT IGNORE INTO " + table + " (" + strings.Join(cols, ", ") + ") VALUES " + values
+	}
+	var sets = make([]string, 0, len(updates))
+	for _, col := range updates {
+		sets = append(sets, col+" = VALUES("+col+")")
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(cols, ", ") + ") VALUES " + values +
+		" ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// returning
+func (Dialect) Returning() bool {
+	return false
+}
+
+// schema
+func (Dialect) Schema() []string {
+	return SCHEMA
+}
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// tables of wshelper, the statements of migrations/*.up.sql in order.
+// the same files can be applied by migration tools instead of Migrate
+var SCHEMA = func() []string {
+	stmts, e := dao.ReadMigrations(migrations, "migrations/*.up.sql")
+	if e != nil {
+		panic(e)
+	}
+	return stmts
+}()
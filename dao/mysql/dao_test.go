@@ -0,0 +1,32 @@
+package mysql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDialect_Upsert(t *testing.T) {
+	var d Dialect
+	got := d.Upsert("ws_friend", []string{"user_key", "friend_key", "remark"}, []string{"user_key", "friend_key"}, []string{"remark"})
+	want := "INSERT INTO ws_friend (user_key, friend_key, remark) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE remark = VALUES(remark)"
+	if got != want {
+		t.Fatalf("want '%s' but got '%s'", want, got)
+	}
+	got = d.Upsert("ws_group_member", []string{"channel_id", "user_key"}, []string{"channel_id", "user_key"}, nil)
+	want = "INSERT IGNORE INTO ws_group_member (channel_id, user_key) VALUES (?, ?)"
+	if got != want {
+		t.Fatalf("want '%s' but got '%s'", want, got)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	tables := []string{"ws_user", "ws_friend", "ws_group", "ws_group_member", "ws_room", "ws_room_member", "ws_message", "ws_inbox"}
+	if len(SCHEMA) != len(tables) {
+		t.Fatalf("want %d statements but got %d: %q", len(tables), len(SCHEMA), SCHEMA)
+	}
+	for i, table := range tables {
+		if !strings.HasPrefix(SCHEMA[i], "CREATE TABLE IF NOT EXISTS "+table+" (") || strings.HasSuffix(SCHEMA[i], ";") {
+			t.Fatalf("bad statement of '%s': %s", table, SCHEMA[i])
+		}
+	}
+}
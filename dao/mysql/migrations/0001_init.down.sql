@@ -0,0 +1,10 @@
+-- drop tables of wshelper
+
+DROP TABLE IF EXISTS ws_inbox;
+DROP TABLE IF EXISTS ws_message;
+DROP TABLE IF EXISTS ws_room_member;
+DROP TABLE IF EXISTS ws_room;
+DROP TABLE IF EXISTS ws_group_member;
+DROP TABLE IF EXISTS ws_group;
+DROP TABLE IF EXISTS ws_friend;
+DROP TABLE IF EXISTS ws_user;
@@ -0,0 +1,64 @@
+-- tables of wshelper
+
+CREATE TABLE IF NOT EXISTS ws_user (
+	user_key   VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	created_at DATETIME(6)  NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_friend (
+	user_key   VARCHAR(64)  NOT NULL,
+	friend_key VARCHAR(64)  NOT NULL,
+	list_group VARCHAR(64)  NOT NULL DEFAULT '',
+	remark     VARCHAR(128) NOT NULL DEFAULT '',
+	created_at DATETIME(6)  NOT NULL,
+	PRIMARY KEY (user_key, friend_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_group (
+	id         VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	owner      VARCHAR(64)  NOT NULL DEFAULT '',
+	created_at DATETIME(6)  NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_group_member (
+	channel_id VARCHAR(64) NOT NULL,
+	user_key   VARCHAR(64) NOT NULL,
+	joined_at  DATETIME(6) NOT NULL,
+	PRIMARY KEY (channel_id, user_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_room (
+	id         VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	owner      VARCHAR(64)  NOT NULL DEFAULT '',
+	created_at DATETIME(6)  NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_room_member (
+	channel_id VARCHAR(64) NOT NULL,
+	user_key   VARCHAR(64) NOT NULL,
+	joined_at  DATETIME(6) NOT NULL,
+	PRIMARY KEY (channel_id, user_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_message (
+	id           BIGINT       NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	channel_type INT          NOT NULL,
+	channel_id   VARCHAR(160) NOT NULL,
+	from_key     VARCHAR(64)  NOT NULL DEFAULT '',
+	to_key       VARCHAR(64)  NOT NULL DEFAULT '',
+	sub_type     INT          NOT NULL DEFAULT 0,
+	body         MEDIUMBLOB,
+	send_at      DATETIME(6)  NOT NULL,
+	INDEX idx_ws_message_channel (channel_type, channel_id, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ws_inbox (
+	seq      BIGINT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_key VARCHAR(64) NOT NULL,
+	data     MEDIUMBLOB,
+	saved_at DATETIME(6) NOT NULL,
+	INDEX idx_ws_inbox_user (user_key, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
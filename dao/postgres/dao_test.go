@@ -0,0 +1,43 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDialect_Upsert(t *testing.T) {
+	var d Dialect
+	got := d.Upsert("ws_friend", []string{"user_key", "friend_key", "remark"}, []string{"user_key", "friend_key"}, []string{"remark"})
+	want := "INSERT INTO ws_friend (user_key, friend_key, remark) VALUES (?, ?, ?) ON CONFLICT (user_key, friend_key) DO UPDATE SET remark = EXCLUDED.remark"
+	if got != want {
+		t.Fatalf("want '%s' but got '%s'", want, got)
+	}
+	got = d.Upsert("ws_group_member", []string{"channel_id", "user_key"}, []string{"channel_id", "user_key"}, nil)
+	want = "INSERT INTO ws_group_member (channel_id, user_key) VALUES (?, ?) ON CONFLICT (channel_id, user_key) DO NOTHING"
+	if got != want {
+		t.Fatalf("want '%s' but got '%s'", want, got)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	prefixes := []string{
+		"CREATE TABLE IF NOT EXISTS ws_user (",
+		"CREATE TABLE IF NOT EXISTS ws_friend (",
+		"CREATE TABLE IF NOT EXISTS ws_group (",
+		"CREATE TABLE IF NOT EXISTS ws_group_member (",
+		"CREATE TABLE IF NOT EXISTS ws_room (",
+		"CREATE TABLE IF NOT EXISTS ws_room_member (",
+		"CREATE TABLE IF NOT EXISTS ws_message (",
+		"CREATE INDEX IF NOT EXISTS idx_ws_message_channel ",
+		"CREATE TABLE IF NOT EXISTS ws_inbox (",
+		"CREATE INDEX IF NOT EXISTS idx_ws_inbox_user ",
+	}
+	if len(SCHEMA) != len(prefixes) {
+		t.Fatalf("want %d statements but got %d: %q", len(prefixes), len(SCHEMA), SCHEMA)
+	}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(SCHEMA[i], prefix) || strings.HasSuffix(SCHEMA[i], ";") {
+			t.Fatalf("want '%s' but got: %s", prefix, SCHEMA[i])
+		}
+	}
+}
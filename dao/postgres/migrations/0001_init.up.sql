@@ -0,0 +1,66 @@
+-- tables of wshelper
+
+CREATE TABLE IF NOT EXISTS ws_user (
+	user_key   VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	created_at TIMESTAMP    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_friend (
+	user_key   VARCHAR(64)  NOT NULL,
+	friend_key VARCHAR(64)  NOT NULL,
+	list_group VARCHAR(64)  NOT NULL DEFAULT '',
+	remark     VARCHAR(128) NOT NULL DEFAULT '',
+	created_at TIMESTAMP    NOT NULL,
+	PRIMARY KEY (user_key, friend_key)
+);
+
+CREATE TABLE IF NOT EXISTS ws_group (
+	id         VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	owner      VARCHAR(64)  NOT NULL DEFAULT '',
+	created_at TIMESTAMP    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_group_member (
+	channel_id VARCHAR(64) NOT NULL,
+	user_key   VARCHAR(64) NOT NULL,
+	joined_at  TIMESTAMP   NOT NULL,
+	PRIMARY KEY (channel_id, user_key)
+);
+
+CREATE TABLE IF NOT EXISTS ws_room (
+	id         VARCHAR(64)  NOT NULL PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL DEFAULT '',
+	owner      VARCHAR(64)  NOT NULL DEFAULT '',
+	created_at TIMESTAMP    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_room_member (
+	channel_id VARCHAR(64) NOT NULL,
+	user_key   VARCHAR(64) NOT NULL,
+	joined_at  TIMESTAMP   NOT NULL,
+	PRIMARY KEY (channel_id, user_key)
+);
+
+CREATE TABLE IF NOT EXISTS ws_message (
+	id           BIGSERIAL    NOT NULL PRIMARY KEY,
+	channel_type INT          NOT NULL,
+	channel_id   VARCHAR(160) NOT NULL,
+	from_key     VARCHAR(64)  NOT NULL DEFAULT '',
+	to_key       VARCHAR(64)  NOT NULL DEFAULT '',
+	sub_type     INT          NOT NULL DEFAULT 0,
+	body         BYTEA,
+	send_at      TIMESTAMP    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ws_message_channel ON ws_message (channel_type, channel_id, id);
+
+CREATE TABLE IF NOT EXISTS ws_inbox (
+	seq      BIGSERIAL   NOT NULL PRIMARY KEY,
+	user_key VARCHAR(64) NOT NULL,
+	data     BYTEA,
+	saved_at TIMESTAMP   NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ws_inbox_user ON ws_inbox (user_key, seq);
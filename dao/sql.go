@@ -0,0 +1,426 @@
+package dao
+
+import (
+	"database/sql"
+	"github.com/fwhezfwhez/errorx"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// sql differences between databases, queries handed to a dialect use '?' as placeholders
+type Dialect interface {
+	// placeholder of the i-th arg, starts from 1
+	Placeholder(i int) string
+	// an insert updating 'updates' columns when 'keys' conflict, or ignoring the conflict if no updates
+	Upsert(table string, cols []string, keys []string, updates []string) string
+	// whether an insert supports 'RETURNING id', otherwise LastInsertId is used
+	Returning() bool
+	// statements creating tables if not exist
+	Schema() []string
+}
+
+var _ Store = (*SqlStore)(nil)
+
+// a database/sql realization of Store, the sql differences are left to dialect
+type SqlStore struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// new a sql store
+func NewSqlStore(db *sql.DB, dialect Dialect) *SqlStore {
+	return &SqlStore{DB: db, Dialect: dialect}
+}
+
+// replace '?' with the placeholders of the dialect
+func (s *SqlStore) rebind(query string) string {
+	var b strings.Builder
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(s.Dialect.Placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SqlStore) exec(query string, args ...interface{}) error {
+	if _, e := s.DB.Exec(s.rebind(query), args...); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+func (s *SqlStore) upsert(table string, cols []string, keys []string, updates []string, args ...interface{}) error {
+	return s.exec(s.Dialect.Upsert(table, cols, keys, updates), args...)
+}
+
+func nowIfZero(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
+
+// migrate
+func (s *SqlStore) Migrate() error {
+	for _, stmt := range s.Dialect.Schema() {
+		if _, e := s.DB.Exec(stmt); e != nil {
+			return errorx.New(e)
+		}
+	}
+	return nil
+}
+
+// read statements of sql files matching pattern in fsys, in the order of file names.
+// statements end with ';' at the end of a line, lines starting with '--' are comments
+func ReadMigrations(fsys fs.FS, pattern string) ([]string, error) {
+	files, e := fs.Glob(fsys, pattern)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	var stmts []string
+	for _, file := range files {
+		b, e := fs.ReadFile(fsys, file)
+		if e != nil {
+			return nil, errorx.New(e)
+		}
+		var stmt []string
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "--") {
+				continue
+			}
+			line = strings.TrimRight(line, " \t\r")
+			if !strings.HasSuffix(line, ";") {
+				stmt = append(stmt, line)
+				continue
+			}
+			stmt = append(stmt, strings.TrimSuffix(line, ";"))
+			stmts = append(stmts, strings.TrimSpace(strings.Join(stmt, "\n")))
+			stmt = stmt[:0]
+		}
+		if rest := strings.TrimSpace(strings.Join(stmt, "\n")); rest != "" {
+			return nil, errorx.NewFromStringf("'%s' ends without ';'", file)
+		}
+	}
+	return stmts, nil
+}
+
+// close
+func (s *SqlStore) Close() error {
+	return s.DB.Close()
+}
+
+// save user
+func (s *SqlStore) SaveUser(u User) error {
+	return s.upsert("ws_user", []string{"user_key", "name", "created_at"}, []string{"user_key"}, []string{"name"},
+		u.Key, u.Name, nowIfZero(u.CreatedAt))
+}
+
+// get user
+func (s *SqlStore) GetUser(key string) (User, error) {
+	var u User
+	e := s.DB.QueryRow(s.rebind("SELECT user_key, name, created_at FROM ws_user WHERE user_key = ?"), key).
+		Scan(&u.Key, &u.Name, &u.CreatedAt)
+	if e == sql.ErrNoRows {
+		return User{}, ErrNotFound
+	}
+	if e != nil {
+		return User{}, errorx.New(e)
+	}
+	return u, nil
+}
+
+// delete user
+func (s *SqlStore) DeleteUser(key string) error {
+	return s.exec("DELETE FROM ws_user WHERE user_key = ?", key)
+}
+
+// add friend
+func (s *SqlStore) AddFriend(f Friendship) error {
+	return s.upsert("ws_friend", []string{"user_key", "friend_key", "list_group", "remark", "created_at"},
+		[]string{"user_key", "friend_key"}, []string{"list_group", "remark"},
+		f.UserKey, f.FriendKey, f.ListGroup, f.Remark, nowIfZero(f.CreatedAt))
+}
+
+// remove friend
+func (s *SqlStore) RemoveFriend(userKey string, friendKey string) error {
+	return s.exec("DELETE FROM ws_friend WHERE user_key = ? AND friend_key = ?", userKey, friendKey)
+}
+
+// list friends, ordered by friend key
+func (s *SqlStore) ListFriends(userKey string) ([]Friendship, error) {
+	rows, e := s.DB.Query(s.rebind("SELECT user_key, friend_key, list_group, remark, created_at FROM ws_friend WHERE user_key = ? ORDER BY friend_key"), userKey)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	defer rows.Close()
+	var rs = make([]Friendship, 0, 10)
+	for rows.Next() {
+		var f Friendship
+		if e = rows.Scan(&f.UserKey, &f.FriendKey, &f.ListGroup, &f.Remark, &f.CreatedAt); e != nil {
+			return nil, errorx.New(e)
+		}
+		rs = append(rs, f)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, errorx.New(e)
+	}
+	return rs, nil
+}
+
+// groups and rooms share the same table layout
+func (s *SqlStore) saveChannel(table string, id string, name string, owner string, createdAt time.Time) error {
+	return s.upsert(table, []string{"id", "name", "owner", "created_at"}, []string{"id"}, []string{"name", "owner"},
+		id, name, owner, nowIfZero(createdAt))
+}
+
+func (s *SqlStore) getChannel(table string, id string, name *string, owner *string, createdAt *time.Time) error {
+	e := s.DB.QueryRow(s.rebind("SELECT name, owner, created_at FROM "+table+" WHERE id = ?"), id).
+		Scan(name, owner, createdAt)
+	if e == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+func (s *SqlStore) deleteChannel(table string, memberTable string, id string) error {
+	tx, e := s.DB.Begin()
+	if e != nil {
+		return errorx.New(e)
+	}
+	if _, e = tx.Exec(s.rebind("DELETE FROM "+memberTable+" WHERE channel_id = ?"), id); e != nil {
+		tx.Rollback()
+		return errorx.New(e)
+	}
+	if _, e = tx.Exec(s.rebind("DELETE FROM "+table+" WHERE id = ?"), id); e != nil {
+		tx.Rollback()
+		return errorx.New(e)
+	}
+	if e = tx.Commit(); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+func (s *SqlStore) join(table string, memberTable string, id string, userKey string) error {
+	var n int
+	if e := s.DB.QueryRow(s.rebind("SELECT COUNT(1) FROM "+table+" WHERE id = ?"), id).Scan(&n); e != nil {
+		return errorx.New(e)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return s.upsert(memberTable, []string{"channel_id", "user_key", "joined_at"}, []string{"channel_id", "user_key"}, nil,
+		id, userKey, time.Now())
+}
+
+func (s *SqlStore) members(memberTable string, id string) ([]string, error) {
+	rows, e := s.DB.Query(s.rebind("SELECT user_key FROM "+memberTable+" WHERE channel_id = ? ORDER BY user_key"), id)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	defer rows.Close()
+	var rs = make([]string, 0, 10)
+	for rows.Next() {
+		var key string
+		if e = rows.Scan(&key); e != nil {
+			return nil, errorx.New(e)
+		}
+		rs = append(rs, key)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, errorx.New(e)
+	}
+	return rs, nil
+}
+
+// save group
+func (s *SqlStore) SaveGroup(g Group) error {
+	return s.saveChannel("ws_group", g.Id, g.Name, g.Owner, g.CreatedAt)
+}
+
+// get group
+func (s *SqlStore) GetGroup(id string) (Group, error) {
+	g := Group{Id: id}
+	if e := s.getChannel("ws_group", id, &g.Name, &g.Owner, &g.CreatedAt); e != nil {
+		return Group{}, e
+	}
+	return g, nil
+}
+
+// delete group
+func (s *SqlStore) DeleteGroup(id string) error {
+	return s.deleteChannel("ws_group", "ws_group_member", id)
+}
+
+// join group
+func (s *SqlStore) JoinGroup(groupId string, userKey string) error {
+	return s.join("ws_group", "ws_group_member", groupId, userKey)
+}
+
+// leave group
+func (s *SqlStore) LeaveGroup(groupId string, userKey string) error {
+	return s.exec("DELETE FROM ws_group_member WHERE channel_id = ? AND user_key = ?", groupId, userKey)
+}
+
+// group members, ordered by user key
+func (s *SqlStore) GroupMembers(groupId string) ([]string, error) {
+	return s.members("ws_group_member", groupId)
+}
+
+// save room
+func (s *SqlStore) SaveRoom(r Room) error {
+	return s.saveChannel("ws_room", r.Id, r.Name, r.Owner, r.CreatedAt)
+}
+
+// get room
+func (s *SqlStore) GetRoom(id string) (Room, error) {
+	r := Room{Id: id}
+	if e := s.getChannel("ws_room", id, &r.Name, &r.Owner, &r.CreatedAt); e != nil {
+		return Room{}, e
+	}
+	return r, nil
+}
+
+// delete room
+func (s *SqlStore) DeleteRoom(id string) error {
+	return s.deleteChannel("ws_room", "ws_room_member", id)
+}
+
+// join room
+func (s *SqlStore) JoinRoom(roomId string, userKey string) error {
+	return s.join("ws_room", "ws_room_member", roomId, userKey)
+}
+
+// leave room
+func (s *SqlStore) LeaveRoom(roomId string, userKey string) error {
+	return s.exec("DELETE FROM ws_room_member WHERE channel_id = ? AND user_key = ?", roomId, userKey)
+}
+
+// room members, ordered by user key
+func (s *SqlStore) RoomMembers(roomId string) ([]string, error) {
+	return s.members("ws_room_member", roomId)
+}
+
+// save message
+func (s *SqlStore) SaveMessage(msg *Message) error {
+	if msg.ChannelId == "" {
+		return errorx.NewFromString("message channel id required")
+	}
+	msg.SendAt = nowIfZero(msg.SendAt)
+	query := "INSERT INTO ws_message (channel_type, channel_id, from_key, to_key, sub_type, body, send_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{msg.ChannelType, msg.ChannelId, msg.From, msg.To, msg.SubType, msg.Body, msg.SendAt}
+	if s.Dialect.Returning() {
+		if e := s.DB.QueryRow(s.rebind(query+" RETURNING id"), args...).Scan(&msg.Id); e != nil {
+			return errorx.New(e)
+		}
+		return nil
+	}
+	rs, e := s.DB.Exec(s.rebind(query), args...)
+	if e != nil {
+		return errorx.New(e)
+	}
+	if msg.Id, e = rs.LastInsertId(); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// history
+func (s *SqlStore) History(q HistoryQuery) ([]Message, bool, error) {
+	limit := q.NormalLimit()
+	query := "SELECT id, channel_type, channel_id, from_key, to_key, sub_type, body, send_at FROM ws_message WHERE channel_type = ? AND channel_id = ?"
+	args := []interface{}{q.ChannelType, q.ChannelId}
+	if len(q.SubTypes) > 0 {
+		query += " AND sub_type IN (?" + strings.Repeat(", ?", len(q.SubTypes)-1) + ")"
+		for _, t := range q.SubTypes {
+			args = append(args, t)
+		}
+	}
+	var asc = q.After > 0
+	switch {
+	case asc:
+		query += " AND id > ? ORDER BY id ASC"
+		args = append(args, q.After)
+	case q.Before > 0:
+		query += " AND id < ? ORDER BY id DESC"
+		args = append(args, q.Before)
+	default:
+		query += " ORDER BY id DESC"
+	}
+	// one more to know whether has more
+	query += " LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, e := s.DB.Query(s.rebind(query), args...)
+	if e != nil {
+		return nil, false, errorx.New(e)
+	}
+	defer rows.Close()
+	var rs = make([]Message, 0, limit+1)
+	for rows.Next() {
+		var msg Message
+		if e = rows.Scan(&msg.Id, &msg.ChannelType, &msg.ChannelId, &msg.From, &msg.To, &msg.SubType, &msg.Body, &msg.SendAt); e != nil {
+			return nil, false, errorx.New(e)
+		}
+		rs = append(rs, msg)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, false, errorx.New(e)
+	}
+
+	hasMore := len(rs) > limit
+	if hasMore {
+		rs = rs[:limit]
+	}
+	if !asc {
+		for l, r := 0, len(rs)-1; l < r; l, r = l+1, r-1 {
+			rs[l], rs[r] = rs[r], rs[l]
+		}
+	}
+	return rs, hasMore, nil
+}
+
+// push inbox
+func (s *SqlStore) PushInbox(userKey string, data []byte) error {
+	return s.exec("INSERT INTO ws_inbox (user_key, data, saved_at) VALUES (?, ?, ?)", userKey, data, time.Now())
+}
+
+// list inbox
+func (s *SqlStore) ListInbox(userKey string, since time.Time) ([]InboxMessage, error) {
+	rows, e := s.DB.Query(s.rebind("SELECT seq, user_key, data, saved_at FROM ws_inbox WHERE user_key = ? AND saved_at > ? ORDER BY seq"), userKey, since)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	defer rows.Close()
+	var rs = make([]InboxMessage, 0, 10)
+	for rows.Next() {
+		var msg InboxMessage
+		if e = rows.Scan(&msg.Seq, &msg.UserKey, &msg.Data, &msg.SavedAt); e != nil {
+			return nil, errorx.New(e)
+		}
+		rs = append(rs, msg)
+	}
+	if e = rows.Err(); e != nil {
+		return nil, errorx.New(e)
+	}
+	return rs, nil
+}
+
+// ack inbox
+func (s *SqlStore) AckInbox(userKey string, seq int64) error {
+	return s.exec("DELETE FROM ws_inbox WHERE user_key = ? AND seq <= ?", userKey, seq)
+}
+
+// expire inbox
+func (s *SqlStore) ExpireInbox(userKey string, before time.Time) error {
+	return s.exec("DELETE FROM ws_inbox WHERE user_key = ? AND saved_at < ?", userKey, before)
+}
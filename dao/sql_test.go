@@ -0,0 +1,287 @@
+package dao_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"eyas/wshelper/dao"
+	"eyas/wshelper/dao/mysql"
+	"eyas/wshelper/dao/postgres"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a database/sql driver recording statements, queries answer rows queued by dsn
+type fakeDriver struct {
+	m     sync.Mutex
+	stmts map[string][]string
+	rows  map[string][][][]driver.Value
+}
+
+var fake = &fakeDriver{stmts: make(map[string][]string), rows: make(map[string][][][]driver.Value)}
+
+func init() {
+	sql.Register("dao_fake", fake)
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	return fakeConn{dsn: dsn}, nil
+}
+
+func (d *fakeDriver) record(dsn string, stmt string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.stmts[dsn] = append(d.stmts[dsn], stmt)
+}
+
+// statements recorded since the last call
+func (d *fakeDriver) take(dsn string) []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	stmts := d.stmts[dsn]
+	d.stmts[dsn] = nil
+	return stmts
+}
+
+// rows answering the next query
+func (d *fakeDriver) answer(dsn string, rows ...[]driver.Value) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.rows[dsn] = append(d.rows[dsn], rows)
+}
+
+func (d *fakeDriver) next(dsn string) [][]driver.Value {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if len(d.rows[dsn]) == 0 {
+		return nil
+	}
+	rows := d.rows[dsn][0]
+	d.rows[dsn] = d.rows[dsn][1:]
+	return rows
+}
+
+type fakeConn struct {
+	dsn string
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{dsn: c.dsn, query: query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	fake.record(c.dsn, "BEGIN")
+	return c, nil
+}
+
+func (c fakeConn) Commit() error {
+	fake.record(c.dsn, "COMMIT")
+	return nil
+}
+
+func (c fakeConn) Rollback() error {
+	fake.record(c.dsn, "ROLLBACK")
+	return nil
+}
+
+type fakeStmt struct {
+	dsn   string
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+// the statement with its args, like 'DELETE FROM ws_user WHERE user_key = ? [tom]'
+func (s fakeStmt) record(args []driver.Value) {
+	var vals = make([]string, 0, len(args))
+	for _, arg := range args {
+		if _, ok := arg.(time.Time); ok {
+			arg = "now"
+		}
+		vals = append(vals, fmt.Sprint(arg))
+	}
+	fake.record(s.dsn, s.query+" ["+strings.Join(vals, " ")+"]")
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.record(args)
+	return fakeResult{}, nil
+}
+
+// every insert gets id 7
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) {
+	return 7, nil
+}
+
+func (fakeResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.record(args)
+	return &fakeRows{rows: fake.next(s.dsn)}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// a sql store of the dialect on a fake database of dsn
+func fakeStore(t *testing.T, dialect dao.Dialect, dsn string) *dao.SqlStore {
+	db, e := sql.Open("dao_fake", dsn)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	// a single connection keeps statements in order
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return dao.NewSqlStore(db, dialect)
+}
+
+func assertStmts(t *testing.T, dsn string, want ...string) {
+	t.Helper()
+	if got := fake.take(dsn); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want statements:\n%s\nbut got:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestSqlStore_MySQL(t *testing.T) {
+	const dsn = "mysql"
+	s := fakeStore(t, mysql.Dialect{}, dsn)
+
+	if e := s.SaveUser(dao.User{Key: "tom", Name: "Tom"}); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "INSERT INTO ws_user (user_key, name, created_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name) [tom Tom now]")
+
+	// the id is the last insert id
+	msg := dao.Message{ChannelType: dao.CHANNEL_GROUP, ChannelId: "g1", From: "tom", SubType: 1, Body: []byte("hi")}
+	if e := s.SaveMessage(&msg); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "INSERT INTO ws_message (channel_type, channel_id, from_key, to_key, sub_type, body, send_at) VALUES (?, ?, ?, ?, ?, ?, ?) [2 g1 tom  1 [104 105] now]")
+	if msg.Id != 7 {
+		t.Fatalf("want id 7 but got %d", msg.Id)
+	}
+
+	// one more row than the limit tells there are more
+	now := time.Now()
+	fake.answer(dsn,
+		[]driver.Value{int64(9), int64(2), "g1", "tom", "", int64(1), []byte("c"), now},
+		[]driver.Value{int64(8), int64(2), "g1", "tom", "", int64(1), []byte("b"), now},
+		[]driver.Value{int64(7), int64(2), "g1", "tom", "", int64(1), []byte("a"), now},
+	)
+	msgs, hasMore, e := s.History(dao.HistoryQuery{ChannelType: dao.CHANNEL_GROUP, ChannelId: "g1", Before: 10, Limit: 2, SubTypes: []int{1, 2}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "SELECT id, channel_type, channel_id, from_key, to_key, sub_type, body, send_at FROM ws_message WHERE channel_type = ? AND channel_id = ? AND sub_type IN (?, ?) AND id < ? ORDER BY id DESC LIMIT ? [2 g1 1 2 10 3]")
+	if !hasMore || len(msgs) != 2 || msgs[0].Id != 8 || msgs[1].Id != 9 || string(msgs[1].Body) != "c" {
+		t.Fatalf("want messages 8, 9 and more but got %+v %v", msgs, hasMore)
+	}
+
+	fake.answer(dsn, []driver.Value{int64(1)})
+	if e := s.JoinGroup("g1", "bob"); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn,
+		"SELECT COUNT(1) FROM ws_group WHERE id = ? [g1]",
+		"INSERT IGNORE INTO ws_group_member (channel_id, user_key, joined_at) VALUES (?, ?, ?) [g1 bob now]",
+	)
+
+	if e := s.DeleteGroup("g1"); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn,
+		"BEGIN",
+		"DELETE FROM ws_group_member WHERE channel_id = ? [g1]",
+		"DELETE FROM ws_group WHERE id = ? [g1]",
+		"COMMIT",
+	)
+	if e := s.DeleteUser("tom"); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "DELETE FROM ws_user WHERE user_key = ? [tom]")
+}
+
+func TestSqlStore_Postgres(t *testing.T) {
+	const dsn = "postgres"
+	s := fakeStore(t, postgres.Dialect{}, dsn)
+
+	if e := s.SaveUser(dao.User{Key: "tom", Name: "Tom"}); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "INSERT INTO ws_user (user_key, name, created_at) VALUES ($1, $2, $3) ON CONFLICT (user_key) DO UPDATE SET name = EXCLUDED.name [tom Tom now]")
+
+	// the id is returned by the insert
+	fake.answer(dsn, []driver.Value{int64(9)})
+	msg := dao.Message{ChannelType: dao.CHANNEL_ROOM, ChannelId: "r1", From: "tom", SubType: 1}
+	if e := s.SaveMessage(&msg); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "INSERT INTO ws_message (channel_type, channel_id, from_key, to_key, sub_type, body, send_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id [3 r1 tom  1 [] now]")
+	if msg.Id != 9 {
+		t.Fatalf("want id 9 but got %d", msg.Id)
+	}
+
+	now := time.Now()
+	fake.answer(dsn, []driver.Value{int64(10), int64(3), "r1", "tom", "", int64(1), []byte("d"), now})
+	msgs, hasMore, e := s.History(dao.HistoryQuery{ChannelType: dao.CHANNEL_ROOM, ChannelId: "r1", After: 9})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "SELECT id, channel_type, channel_id, from_key, to_key, sub_type, body, send_at FROM ws_message WHERE channel_type = $1 AND channel_id = $2 AND id > $3 ORDER BY id ASC LIMIT $4 [3 r1 9 21]")
+	if hasMore || len(msgs) != 1 || msgs[0].Id != 10 {
+		t.Fatalf("want message 10 but got %+v %v", msgs, hasMore)
+	}
+
+	if e := s.DeleteRoom("r1"); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn,
+		"BEGIN",
+		"DELETE FROM ws_room_member WHERE channel_id = $1 [r1]",
+		"DELETE FROM ws_room WHERE id = $1 [r1]",
+		"COMMIT",
+	)
+	if e := s.RemoveFriend("tom", "bob"); e != nil {
+		t.Fatal(e.Error())
+	}
+	assertStmts(t, dsn, "DELETE FROM ws_friend WHERE user_key = $1 AND friend_key = $2 [tom bob]")
+}
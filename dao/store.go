@@ -0,0 +1,149 @@
+package dao
+
+import (
+	"errors"
+	"github.com/fwhezfwhez/errorx"
+	"sort"
+	"sync"
+	"time"
+)
+
+// returned when a user, group or room does not exist
+var ErrNotFound = errors.New("dao: not found")
+
+type User struct {
+	Key       string
+	Name      string
+	CreatedAt time.Time
+}
+
+type Friendship struct {
+	UserKey   string
+	FriendKey string
+	// friend group, like 'family', 'workmate'...
+	ListGroup string
+	Remark    string
+	CreatedAt time.Time
+}
+
+type Group struct {
+	Id        string
+	Name      string
+	Owner     string
+	CreatedAt time.Time
+}
+
+type Room struct {
+	Id        string
+	Name      string
+	Owner     string
+	CreatedAt time.Time
+}
+
+// a message in the offline inbox of a user
+type InboxMessage struct {
+	// increasing per user
+	Seq     int64
+	UserKey string
+	Data    []byte
+	SavedAt time.Time
+}
+
+type UserStore interface {
+	// insert or update a user
+	SaveUser(u User) error
+	GetUser(key string) (User, error)
+	DeleteUser(key string) error
+}
+
+type FriendStore interface {
+	// insert or update a friendship, it's one-way from UserKey to FriendKey
+	AddFriend(f Friendship) error
+	RemoveFriend(userKey string, friendKey string) error
+	ListFriends(userKey string) ([]Friendship, error)
+}
+
+type GroupStore interface {
+	// insert or update a group
+	SaveGroup(g Group) error
+	GetGroup(id string) (Group, error)
+	// delete a group and its members
+	DeleteGroup(id string) error
+	JoinGroup(groupId string, userKey string) error
+	LeaveGroup(groupId string, userKey string) error
+	GroupMembers(groupId string) ([]string, error)
+}
+
+type RoomStore interface {
+	// insert or update a room
+	SaveRoom(r Room) error
+	GetRoom(id string) (Room, error)
+	// delete a room and its members
+	DeleteRoom(id string) error
+	JoinRoom(roomId string, userKey string) error
+	LeaveRoom(roomId string, userKey string) error
+	RoomMembers(roomId string) ([]string, error)
+}
+
+type InboxStore interface {
+	PushInbox(userKey string, data []byte) error
+	// list messages saved after 'since' in order of seq
+	ListInbox(userKey string, since time.Time) ([]InboxMessage, error)
+	// remove messages whose seq <= 'seq'
+	AckInbox(userKey string, seq int64) error
+	// remove messages saved before 'before'
+	ExpireInbox(userKey string, before time.Time) error
+}
+
+// all data wshelper persists
+type Store interface {
+	UserStore
+	FriendStore
+	GroupStore
+	RoomStore
+	MessageStore
+	InboxStore
+
+	// create tables if not exist
+	Migrate() error
+	Close() error
+}
+
+var (
+	m       sync.RWMutex
+	openers = map[string]func(dsn string) (Store, error){
+		"memory": func(dsn string) (Store, error) {
+			return NewMemoryStore(), nil
+		},
+	}
+)
+
+// register a store opener by driver name, it's called in init() of dao/mysql and dao/postgres, like database/sql drivers
+func Register(driver string, opener func(dsn string) (Store, error)) {
+	m.Lock()
+	defer m.Unlock()
+	openers[driver] = opener
+}
+
+// open a store by driver name, 'memory' is always available
+func Open(driver string, dsn string) (Store, error) {
+	m.RLock()
+	opener, ok := openers[driver]
+	m.RUnlock()
+	if !ok {
+		return nil, errorx.NewFromStringf("unknown dao driver '%s', forgot to import it?", driver)
+	}
+	return opener(dsn)
+}
+
+// registered driver names
+func Drivers() []string {
+	m.RLock()
+	defer m.RUnlock()
+	var rs = make([]string, 0, len(openers))
+	for k := range openers {
+		rs = append(rs, k)
+	}
+	sort.Strings(rs)
+	return rs
+}
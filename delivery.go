@@ -0,0 +1,315 @@
+package wshelper
+
+import (
+	"context"
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// receipt states
+const (
+	RECEIPT_DELIVERED = 1 + iota
+	RECEIPT_READ
+)
+
+// a message waiting for the ack of its receiver
+type pending struct {
+	msgId string
+	from  string
+	to    string
+	// packed RELIABLE_MESSAGE
+	frame     []byte
+	sentAt    time.Time
+	retries   int
+	delivered bool
+}
+
+// Delivery guarantees at-least-once delivery.
+// each message is assigned an id and wrapped in a RELIABLE_MESSAGE, it will be resent on a timer and when the receiver is Online
+// until the receiver replies MESSAGE_ACK. receivers may get a message more than once: they should ack every copy,
+// since an earlier ack may be lost, and handle the message of an id once, like by a Deduper.
+// the sender is notified by a REPLY frame of REPLY_NOTIFY carrying a Receipt when its message is delivered and read.
+type Delivery struct {
+	wsh *WebSocketHelper
+	// resend a message if not acked in Interval
+	Interval time.Duration
+	// give up a message after resent MaxRetries times
+	MaxRetries int
+
+	m       *sync.Mutex
+	pending map[string]*pending
+	seq     uint64
+}
+
+// new a delivery, interval<=0 means 10 seconds, maxRetries<=0 means 5
+func NewDelivery(wsh *WebSocketHelper, interval time.Duration, maxRetries int) *Delivery {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if maxRetries <= 0 {
+		maxRetries = 5
+	}
+	return &Delivery{
+		wsh:        wsh,
+		Interval:   interval,
+		MaxRetries: maxRetries,
+		m:          &sync.Mutex{},
+		pending:    make(map[string]*pending),
+	}
+}
+
+// generate an unique message id
+func (d *Delivery) genMsgId() string {
+	seq := atomic.AddUint64(&d.seq, 1)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(seq, 36)
+}
+
+// send obj as a message of command from 'from' to 'to', the message id is returned.
+// debug-only replies are sent as wsh.Send, without a message id and not resent
+func (d *Delivery) Send(from string, to string, command int, obj interface{}) (string, error) {
+	if command == REPLY && d.wsh.debugOnly(obj) {
+		return "", d.wsh.Send(to, command, obj)
+	}
+	data, e := d.wsh.Pack(command, obj)
+	if e != nil {
+		return "", errorx.Wrap(e)
+	}
+	msgId := d.genMsgId()
+	frame, e := d.wsh.Pack(RELIABLE_MESSAGE, _json.Envelope{
+		MsgId:  msgId,
+		From:   from,
+		SendAt: time.Now(),
+		Data:   data,
+	})
+	if e != nil {
+		return "", errorx.Wrap(e)
+	}
+
+	d.m.Lock()
+	d.pending[msgId] = &pending{msgId: msgId, from: from, to: to, frame: frame, sentAt: time.Now()}
+	d.m.Unlock()
+	return msgId, d.wsh.SendFrame(to, frame)
+}
+
+// resend all unacked messages to a user, called when the user is Online
+func (d *Delivery) Resend(to string) error {
+	d.m.Lock()
+	var frames [][]byte
+	for _, p := range d.pending {
+		if p.to == to && !p.delivered {
+			p.sentAt = time.Now()
+			frames = append(frames, p.frame)
+		}
+	}
+	d.m.Unlock()
+
+	for _, frame := range frames {
+		if e := d.wsh.SendFrame(to, frame); e != nil {
+			return errorx.Wrap(e)
+		}
+	}
+	return nil
+}
+
+// the receiver acknowledged a message, the sender will be notified
+func (d *Delivery) Ack(receiver string, msgId string, state int) error {
+	d.m.Lock()
+	p, ok := d.pending[msgId]
+	if !ok || p.to != receiver {
+		d.m.Unlock()
+		return nil
+	}
+	if state == RECEIPT_READ {
+		delete(d.pending, msgId)
+	} else {
+		if p.delivered {
+			d.m.Unlock()
+			return nil
+		}
+		// keep it to route the read receipt later
+		p.delivered = true
+		p.sentAt = time.Now()
+		p.frame = nil
+	}
+	d.m.Unlock()
+
+	if p.from == "" {
+		return nil
+	}
+	desc := "delivered"
+	if state == RECEIPT_READ {
+		desc = "read"
+	}
+	// packed for the sender's connection, not re-encoded from wsh.Serializer
+	return d.wsh.Send(p.from, REPLY, _json.Reply{
+		ReplyType: REPLY_NOTIFY,
+		Desc:      desc,
+		ReplyValue: _json.Receipt{
+			MsgId: msgId,
+			To:    receiver,
+			State: state,
+			At:    time.Now(),
+		},
+	})
+}
+
+// number of messages not acked yet
+func (d *Delivery) Pending() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var n int
+	for _, p := range d.pending {
+		if !p.delivered {
+			n++
+		}
+	}
+	return n
+}
+
+// resend messages not acked in Interval to online receivers, and forget delivered messages not read in MaxRetries*Interval.
+// a retry of an offline receiver is counted without sending, so a message is given up after MaxRetries whether the receiver
+// is online or not. an offline receiver gets it from the offline store, or by Resend if it's Online before given up
+func (d *Delivery) retransmit() {
+	now := time.Now()
+	var resend []*pending
+	var dropped int
+	d.m.Lock()
+	for id, p := range d.pending {
+		if now.Sub(p.sentAt) < d.Interval {
+			continue
+		}
+		if p.delivered {
+			if now.Sub(p.sentAt) > time.Duration(d.MaxRetries)*d.Interval {
+				delete(d.pending, id)
+			}
+			continue
+		}
+		if p.retries >= d.MaxRetries {
+			delete(d.pending, id)
+			dropped++
+			continue
+		}
+		p.retries++
+		p.sentAt = now
+		if d.wsh.pool.IfExist(p.to) {
+			resend = append(resend, p)
+		}
+	}
+	d.m.Unlock()
+	if dropped > 0 {
+		d.wsh.Logger().Warn("messages not acked are given up", "count", dropped, "retries", d.MaxRetries)
+	}
+
+	// it runs in the supervisor, a failed write is logged and retried on the next round
+	for _, p := range resend {
+		if e := d.wsh.SendFrame(p.to, p.frame); e != nil {
+			d.wsh.Logger().Warn("retransmit", "to", p.to, "msg_id", p.msgId, "error", e)
+		}
+	}
+}
+
+// a supervisor to retransmit unacked messages on a timer
+func (d *Delivery) Supervisor() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func(ctx context.Context) {
+		ticker := time.NewTicker(d.Interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				d.wsh.Logger().Debug("delivery supervisor canceled")
+				return
+			case <-ticker.C:
+				d.retransmit()
+			}
+		}
+	}(ctx)
+	return cancel
+}
+
+// enable at-least-once delivery, use the returned Delivery to send messages.
+// the interval and max retries are Options.RetransmitInterval and Options.MaxRetransmit,
+// the retransmit supervisor is started and can be stopped by the returned cancel func
+func (wsh *WebSocketHelper) EnableDelivery() (*Delivery, context.CancelFunc) {
+	opts := wsh.Options()
+	d := NewDelivery(wsh, opts.RetransmitInterval, opts.MaxRetransmit)
+	wsh.M.Lock()
+	wsh.delivery = d
+	wsh.M.Unlock()
+	wsh.HandleFunc(MESSAGE_ACK, wsh.handleMessageAck)
+	return d, d.Supervisor()
+}
+
+func (wsh *WebSocketHelper) handleMessageAck(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.MessageAck
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad message ack: %s", e.Error())
+	}
+	key, ok := pool.KeyOf(ConnOf(cache))
+	if !ok {
+		return NewError(ERR_UNAUTHORIZED, "message ack from a connection not online")
+	}
+	state := RECEIPT_DELIVERED
+	if in.Read {
+		state = RECEIPT_READ
+	}
+	wsh.M.RLock()
+	d := wsh.delivery
+	wsh.M.RUnlock()
+	return d.Ack(key, in.MsgId, state)
+}
+
+// Deduper drops duplicated RELIABLE_MESSAGEs on the client side by message id.
+// it remembers the last Size ids, a message resent after Size newer ones is taken as new,
+// so Size should cover the messages received in MaxRetries*Interval of the Delivery
+type Deduper struct {
+	Size int
+
+	m    *sync.Mutex
+	seen map[string]struct{}
+	// ids in the order they're seen, a ring of Size
+	ids  []string
+	next int
+}
+
+// new a deduper remembering the last size ids, size<=0 means 1024
+func NewDeduper(size int) *Deduper {
+	if size <= 0 {
+		size = 1024
+	}
+	return &Deduper{
+		Size: size,
+		m:    &sync.Mutex{},
+		seen: make(map[string]struct{}, size),
+		ids:  make([]string, 0, size),
+	}
+}
+
+// whether a message id is seen before, it's remembered if not. handle the message only if it returns false:
+//
+//	var env _json.Envelope
+//	// ... decode the RELIABLE_MESSAGE into env, and reply MESSAGE_ACK of env.MsgId whether it's a duplicate or not
+//	if !deduper.Seen(env.MsgId) {
+//		handle(env.Data)
+//	}
+func (d *Deduper) Seen(msgId string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if _, ok := d.seen[msgId]; ok {
+		return true
+	}
+	if len(d.ids) < d.Size {
+		d.ids = append(d.ids, msgId)
+	} else {
+		delete(d.seen, d.ids[d.next])
+		d.ids[d.next] = msgId
+		d.next = (d.next + 1) % d.Size
+	}
+	d.seen[msgId] = struct{}{}
+	return false
+}
@@ -0,0 +1,107 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"testing"
+	"time"
+)
+
+func TestDelivery(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	store := wsh.EnableOffline(NewMemoryOfflineStore(time.Hour))
+	d := NewDelivery(wsh, time.Second, 3)
+
+	msgId, e := d.Send("tom", "bob", SEND_ONE, _json.SendOne{From: "tom", To: "bob", Message: "hi"})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	util.Assertf(d.Pending() == 1, t, "want 1 pending but got %d", d.Pending())
+
+	// ack from a wrong receiver is ignored
+	d.Ack("jack", msgId, RECEIPT_DELIVERED)
+	util.Assertf(d.Pending() == 1, t, "want 1 pending but got %d", d.Pending())
+
+	d.Ack("bob", msgId, RECEIPT_DELIVERED)
+	util.Assertf(d.Pending() == 0, t, "want 0 pending but got %d", d.Pending())
+	d.Ack("bob", msgId, RECEIPT_READ)
+
+	box, _ := store.List("tom")
+	util.Assertf(len(box) == 2, t, "want 2 receipts but got %d", len(box))
+	util.Assertf(string(box[0].Data[:32]) == wsh.genCommandHash(REPLY), t, "want a REPLY but got %s", box[0].Data[:32])
+	var reply _json.Reply
+	if e = wsh.CoreOf(box[1].Data, &reply); e != nil {
+		t.Fatal(e.Error())
+	}
+	util.Assertf(reply.ReplyType == REPLY_NOTIFY && reply.Desc == "read", t, "bad receipt %+v", reply)
+}
+
+func TestDeliveryRetransmit(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	bob := loginTest(t, wsh, newTestServer(t, wsh), "bob", "")
+	d := NewDelivery(wsh, 100*time.Millisecond, 2)
+	cancel := d.Supervisor()
+	defer cancel()
+
+	msgId, e := d.Send("tom", "bob", SEND_ONE, _json.SendOne{From: "tom", To: "bob", Message: "hi"})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	// sent once and resent twice on the timer, then given up
+	for i := 0; i < 3; i++ {
+		var env _json.Envelope
+		util.Assertf(bob.ReceiveInto(&env) == wsh.genCommandHash(RELIABLE_MESSAGE), t, "want a RELIABLE_MESSAGE")
+		util.Assertf(env.MsgId == msgId, t, "want message '%s' but got '%s'", msgId, env.MsgId)
+	}
+	util.Assertf(bob.Silent(300*time.Millisecond), t, "want no more retransmission after MaxRetries")
+	util.Assertf(d.Pending() == 0, t, "want given up but got %d pending", d.Pending())
+
+	// an offline receiver is given up after MaxRetries too
+	d.Send("tom", "jack", SEND_ONE, _json.SendOne{From: "tom", To: "jack", Message: "hi"})
+	time.Sleep(500 * time.Millisecond)
+	util.Assertf(d.Pending() == 0, t, "want the message to jack given up but got %d pending", d.Pending())
+}
+
+func TestDeliveryResendOnline(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	d, cancel := wsh.EnableDelivery()
+	defer cancel()
+
+	// bob is offline and there's no offline store, the message is kept pending
+	msgId, _ := d.Send("tom", "bob", SEND_ONE, _json.SendOne{From: "tom", To: "bob", Message: "hi"})
+	bob := dialTest(t, wsh, newTestServer(t, wsh), "")
+	bob.Send(TEST_LOGIN, `{"from":"bob"}`)
+	var env _json.Envelope
+	util.Assertf(bob.ReceiveInto(&env) == wsh.genCommandHash(RELIABLE_MESSAGE), t, "want the message resent on login")
+	util.Assertf(env.MsgId == msgId, t, "want message '%s' but got '%s'", msgId, env.MsgId)
+	bob.Reply()
+
+	bob.Send(MESSAGE_ACK, `{"msg_id":"`+msgId+`"}`)
+	time.Sleep(50 * time.Millisecond)
+	util.Assertf(d.Pending() == 0, t, "want acked but got %d pending", d.Pending())
+}
+
+func TestDeliveryRetransmitWriteError(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	d := NewDelivery(wsh, 50*time.Millisecond, 2)
+	// a connection closed under the pool fails writes with an error other than io.EOF
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+	wsh.pool.Add("jack", c.Conn)
+	c.Conn.Close()
+
+	d.Send("tom", "jack", SEND_ONE, _json.SendOne{From: "tom", To: "jack", Message: "hi"})
+	time.Sleep(100 * time.Millisecond)
+	// handleE is Panic by default, the supervisor must not reach it
+	d.retransmit()
+	util.Assertf(d.Pending() == 1, t, "want the message kept for the next round but got %d pending", d.Pending())
+}
+
+func TestDeduper(t *testing.T) {
+	d := NewDeduper(2)
+	util.Assertf(!d.Seen("a") && !d.Seen("b"), t, "want new ids not seen")
+	util.Assertf(d.Seen("a") && d.Seen("b"), t, "want duplicates seen")
+	// the oldest is forgotten beyond Size
+	util.Assertf(!d.Seen("c") && !d.Seen("a") && d.Seen("c"), t, "want 'a' forgotten after 2 newer ids")
+}
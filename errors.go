@@ -0,0 +1,158 @@
+package wshelper
+
+import (
+	"errors"
+	"eyas/wshelper/model/json"
+	"fmt"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"reflect"
+)
+
+// codes of errors replied to clients
+const (
+	ERR_INTERNAL = 1 + iota
+	ERR_BAD_REQUEST
+	ERR_UNKNOWN_COMMAND
+	ERR_PAYLOAD_TOO_LARGE
+	ERR_RATE_LIMITED
+	ERR_UNAUTHORIZED
+	ERR_NOT_FOUND
+)
+
+// what the dispatcher does after an error is replied
+const (
+	// the policy set for the code by SetErrorPolicy, or POLICY_CONTINUE
+	POLICY_DEFAULT = iota
+	// go on reading the next message
+	POLICY_CONTINUE
+	// close the connection
+	POLICY_CLOSE
+)
+
+// an error replied to the client as a REPLY frame of REPLY_ERROR carrying a _json.Error.
+// handlers return it as it is, or wrapped by errorx or fmt.Errorf("%w"), for the dispatcher to recognize.
+// errors of other types are handled by handleE, replied as ERR_INTERNAL and the connection is closed
+type Error struct {
+	Code      int
+	Message   string
+	Retryable bool
+	// POLICY_DEFAULT, POLICY_CONTINUE or POLICY_CLOSE
+	Policy int
+}
+
+// new an error of code
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// new an error of code with a formatted message
+func Errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// error
+func (e *Error) Error() string {
+	return fmt.Sprintf("error '%d': %s", e.Code, e.Message)
+}
+
+// the *Error in er. errors.As follows Unwrap, errors wrapping another in an exported field E without Unwrap,
+// like errorx.Error, are followed too
+func asError(er error) (*Error, bool) {
+	for er != nil {
+		var typed *Error
+		if errors.As(er, &typed) {
+			return typed, true
+		}
+		v := reflect.Indirect(reflect.ValueOf(er))
+		if v.Kind() != reflect.Struct {
+			break
+		}
+		f := v.FieldByName("E")
+		if !f.IsValid() || f.Type() != errorType {
+			break
+		}
+		er, _ = f.Interface().(error)
+	}
+	return nil, false
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// keep an *Error as it is for the dispatcher to reply it, wrap other errors by errorx
+func wrapError(e error) error {
+	if _, ok := e.(*Error); ok {
+		return e
+	}
+	return errorx.Wrap(e)
+}
+
+// set the error retryable
+func (e *Error) Retry() *Error {
+	e.Retryable = true
+	return e
+}
+
+// close the connection after the error is replied
+func (e *Error) Fatal() *Error {
+	e.Policy = POLICY_CLOSE
+	return e
+}
+
+// set the policy of errors of a code not setting their own policy
+func (wsh *WebSocketHelper) SetErrorPolicy(code int, policy int) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.errorPolicies[code] = policy
+}
+
+func (wsh *WebSocketHelper) policyOf(e *Error) int {
+	if e.Policy != POLICY_DEFAULT {
+		return e.Policy
+	}
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	if policy, ok := wsh.errorPolicies[e.Code]; ok && policy != POLICY_DEFAULT {
+		return policy
+	}
+	return POLICY_CONTINUE
+}
+
+// reply an error to the client
+func (wsh *WebSocketHelper) ReplyError(conn *websocket.Conn, e *Error) error {
+	return wsh.Reply(conn, REPLY, _json.Reply{
+		ReplyType: REPLY_ERROR,
+		Desc:      "error",
+		Tip:       e.Message,
+		ReplyValue: _json.Error{
+			Code:      e.Code,
+			Message:   e.Message,
+			Retryable: e.Retryable,
+		},
+	})
+}
+
+// handle an error of serving a message, false if the connection should be closed
+func (wsh *WebSocketHelper) handleError(conn *websocket.Conn, er error, handleE func(error)) bool {
+	if er == io.EOF {
+		return false
+	}
+	typed, ok := asError(er)
+	if !ok {
+		wsh.Logger().Error("serve message", "error", er, "remote", conn.RemoteAddr())
+		wsh.metricsOf().replyError(ERR_INTERNAL)
+		handleE(er)
+		wsh.ReplyError(conn, NewError(ERR_INTERNAL, "internal error").Retry())
+		return false
+	}
+	wsh.Logger().Debug("reply error", "code", typed.Code, "message", typed.Message, "remote", conn.RemoteAddr())
+	wsh.metricsOf().replyError(typed.Code)
+	if e := wsh.ReplyError(conn, typed); e != nil {
+		if e != io.EOF {
+			handleE(e)
+		}
+		return false
+	}
+	return wsh.policyOf(typed) == POLICY_CONTINUE
+}
@@ -0,0 +1,199 @@
+package wshelper
+
+import (
+	"encoding/json"
+	"errors"
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"fmt"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrorReply(t *testing.T) {
+	const NOT_FOUND, FORBIDDEN, BROKEN = 1000, 1001, 1002
+	wsh := NewWsHelper(nil)
+	wsh.SetErrorPolicy(ERR_UNAUTHORIZED, POLICY_CLOSE)
+	wsh.HandleFunc(NOT_FOUND, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		return NewError(ERR_NOT_FOUND, "no such user")
+	})
+	wsh.HandleFunc(FORBIDDEN, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		return NewError(ERR_UNAUTHORIZED, "login first")
+	})
+	wsh.HandleFunc(BROKEN, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		return errors.New("db down")
+	})
+	var handled int32
+	ts := httptest.NewServer(websocket.Handler(wsh.Dispatcher(func(e error) { atomic.AddInt32(&handled, 1) })))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	exchange := func(conn *websocket.Conn, data []byte) _json.Error {
+		if e := websocket.Message.Send(conn, data); e != nil {
+			t.Fatal(e.Error())
+		}
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if e := websocket.Message.Receive(conn, &buf); e != nil {
+			t.Fatal(e.Error())
+		}
+		var reply _json.Reply
+		if e := wsh.CoreOf(buf, &reply); e != nil {
+			t.Fatal(e.Error())
+		}
+		if reply.ReplyType != REPLY_ERROR {
+			t.Fatalf("want reply type '%d' but got '%d'", REPLY_ERROR, reply.ReplyType)
+		}
+		var rs _json.Error
+		b, _ := json.Marshal(reply.ReplyValue)
+		json.Unmarshal(b, &rs)
+		return rs
+	}
+	closed := func(conn *websocket.Conn) bool {
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return websocket.Message.Receive(conn, &buf) != nil
+	}
+
+	conn, e := websocket.Dial(url, "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn.Close()
+	if rs := exchange(conn, []byte(strings.Repeat("0", 32))); rs.Code != ERR_UNKNOWN_COMMAND {
+		t.Fatalf("want code '%d' but got '%d'", ERR_UNKNOWN_COMMAND, rs.Code)
+	}
+	if rs := exchange(conn, []byte("short")); rs.Code != ERR_BAD_REQUEST {
+		t.Fatalf("want code '%d' but got '%d'", ERR_BAD_REQUEST, rs.Code)
+	}
+	if rs := exchange(conn, []byte(wsh.genCommandHash(NOT_FOUND))); rs.Code != ERR_NOT_FOUND || rs.Message != "no such user" {
+		t.Fatalf("unexpected error %+v", rs)
+	}
+	// by the policy of the code
+	if rs := exchange(conn, []byte(wsh.genCommandHash(FORBIDDEN))); rs.Code != ERR_UNAUTHORIZED {
+		t.Fatalf("want code '%d' but got '%d'", ERR_UNAUTHORIZED, rs.Code)
+	}
+	if !closed(conn) {
+		t.Fatal("want the connection closed after ERR_UNAUTHORIZED")
+	}
+
+	conn2, e := websocket.Dial(url, "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn2.Close()
+	if rs := exchange(conn2, []byte(wsh.genCommandHash(BROKEN))); rs.Code != ERR_INTERNAL || !rs.Retryable {
+		t.Fatalf("unexpected error %+v", rs)
+	}
+	if !closed(conn2) {
+		t.Fatal("want the connection closed after an untyped error")
+	}
+	if atomic.LoadInt32(&handled) != 1 {
+		t.Fatalf("want only the untyped error handled but got '%d'", handled)
+	}
+}
+
+func TestBuiltinBadInput(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	wsh.EnableFileTransfer(LocalFileStorage{Dir: t.TempDir()})
+	_, cancel := wsh.EnableDelivery()
+	defer cancel()
+	wsh.EnableHistory(nil)
+	wsh.EnableOffline(NewMemoryOfflineStore(time.Hour))
+	wsh.EnablePubSub()
+	ts := newTestServer(t, wsh)
+	c := loginTest(t, wsh, ts, "tom", "")
+	errorOf := func(reply _json.Reply) _json.Error {
+		if reply.ReplyType != REPLY_ERROR {
+			t.Fatalf("want an error reply but got %+v", reply)
+		}
+		var rs _json.Error
+		b, _ := json.Marshal(reply.ReplyValue)
+		json.Unmarshal(b, &rs)
+		return rs
+	}
+
+	for _, in := range []struct {
+		command int
+		body    string
+		code    int
+	}{
+		{FILE_UPLOAD_INIT, `not json`, ERR_BAD_REQUEST},
+		{FILE_UPLOAD_INIT, `{"size":0,"checksum":"x"}`, ERR_BAD_REQUEST},
+		{FILE_UPLOAD_CHUNK, `not json`, ERR_BAD_REQUEST},
+		{FILE_UPLOAD_CHUNK, `{"file_id":"none","seq":1,"data":"aGVsbA=="}`, ERR_NOT_FOUND},
+		{FILE_UPLOAD_INIT, `{"file_id":"f1","size":4,"chunk_size":4,"checksum":"00000000000000000000000000000000"}`, 0},
+		// 5 bytes over the size
+		{FILE_UPLOAD_CHUNK, `{"file_id":"f1","seq":1,"data":"aGVsbG8="}`, ERR_BAD_REQUEST},
+		// checksum mismatch
+		{FILE_UPLOAD_CHUNK, `{"file_id":"f1","seq":1,"data":"aGVsbA=="}`, ERR_BAD_REQUEST},
+		{FILE_DOWNLOAD, `not json`, ERR_BAD_REQUEST},
+		{FILE_DOWNLOAD, `{"file_id":"none"}`, ERR_NOT_FOUND},
+		{MESSAGE_ACK, `not json`, ERR_BAD_REQUEST},
+		{OFFLINE_ACK, `not json`, ERR_BAD_REQUEST},
+		{HISTORY, `not json`, ERR_BAD_REQUEST},
+		{HISTORY, `{"channel_type":9,"channel_id":"g1"}`, ERR_BAD_REQUEST},
+		{SUBSCRIBE, `not json`, ERR_BAD_REQUEST},
+	} {
+		c.Send(in.command, in.body)
+		if in.code == 0 {
+			c.Receive()
+			continue
+		}
+		if rs := errorOf(c.Reply()); rs.Code != in.code {
+			t.Fatalf("command '%d' %s: want code '%d' but got %+v", in.command, in.body, in.code, rs)
+		}
+	}
+
+	// bad compression flag and body on a compressing connection, the reply is small and not compressed
+	compressed := dialTest(t, wsh, ts, "?"+COMPRESS_QUERY+"=deflate")
+	for _, frame := range [][]byte{
+		append([]byte(wsh.genCommandHash(TEST_LOGIN)), 0xff, '{', '}'),
+		append([]byte(wsh.genCommandHash(TEST_LOGIN)), Deflate{}.Flag(), 'x', 'x'),
+	} {
+		compressed.SendFrame(frame)
+		buf := compressed.Receive()
+		var reply _json.Reply
+		wsh.Unmarshal(buf[33:], &reply)
+		if rs := errorOf(reply); rs.Code != ERR_BAD_REQUEST {
+			t.Fatalf("want code '%d' but got %+v", ERR_BAD_REQUEST, rs)
+		}
+	}
+
+	// both connections are still open
+	c.Send(TEST_LOGIN, `{"from":"tom"}`)
+	util.Assertf(c.Reply().ReplyType == REPLY_MESSAGE, t, "want the connection open")
+	compressed.SendFrame(append([]byte(wsh.genCommandHash(TEST_LOGIN)), append([]byte{FLAG_RAW}, `{"from":"bob"}`...)...))
+	util.Assertf(!compressed.Silent(5*time.Second), t, "want the compressing connection open")
+}
+
+// an error keeping the error it wraps in E without Unwrap, like errorx.Error
+type fieldWrapped struct {
+	E           error
+	StackTraces []string
+}
+
+func (e fieldWrapped) Error() string {
+	return e.E.Error()
+}
+
+func TestAsWrappedError(t *testing.T) {
+	notFound := NewError(ERR_NOT_FOUND, "no such user")
+	for _, e := range []error{
+		errorx.Wrap(notFound),
+		fmt.Errorf("kick: %w", notFound),
+		fieldWrapped{E: notFound},
+		&fieldWrapped{E: fmt.Errorf("kick: %w", errorx.Wrap(notFound))},
+	} {
+		typed, ok := asError(e)
+		util.Assertf(ok && typed == notFound, t, "want the *Error in '%v'", e)
+	}
+	_, ok := asError(fieldWrapped{E: errors.New("db down")})
+	util.Assertf(!ok, t, "want no *Error in an untyped error")
+}
@@ -0,0 +1,454 @@
+package wshelper
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"eyas/wshelper/model/json"
+	"fmt"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the default max size of a chunk
+const DEFAULT_CHUNK_SIZE = 64 * KB
+
+// the default max size of a file
+const DEFAULT_MAX_FILE_SIZE = 1 * GB
+
+// the default time an upload is kept since its last chunk
+const DEFAULT_UPLOAD_TTL = 24 * time.Hour
+
+var fileIdReg = regexp.MustCompile(`^[0-9a-zA-Z_\-]{1,64}$`)
+
+// storage backend of chunked file transfer
+type FileStorage interface {
+	// create a file with the given size, truncate it if exists
+	Create(fileId string, size int64) error
+	WriteAt(fileId string, p []byte, off int64) error
+	ReadAt(fileId string, p []byte, off int64) (int, error)
+	// size of a stored file, os.ErrNotExist as it is if not stored
+	Size(fileId string) (int64, error)
+	Remove(fileId string) error
+}
+
+// the default storage, each file is saved under Dir named by its file id
+type LocalFileStorage struct {
+	Dir string
+}
+
+func (l LocalFileStorage) path(fileId string) string {
+	return filepath.Join(l.Dir, fileId)
+}
+
+// create
+func (l LocalFileStorage) Create(fileId string, size int64) error {
+	if e := os.MkdirAll(l.Dir, 0755); e != nil {
+		return errorx.New(e)
+	}
+	f, e := os.OpenFile(l.path(fileId), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if e != nil {
+		return errorx.New(e)
+	}
+	defer f.Close()
+	if e = f.Truncate(size); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// write at
+func (l LocalFileStorage) WriteAt(fileId string, p []byte, off int64) error {
+	f, e := os.OpenFile(l.path(fileId), os.O_WRONLY, 0644)
+	if e != nil {
+		return errorx.New(e)
+	}
+	defer f.Close()
+	if _, e = f.WriteAt(p, off); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// read at
+func (l LocalFileStorage) ReadAt(fileId string, p []byte, off int64) (int, error) {
+	f, e := os.Open(l.path(fileId))
+	if e != nil {
+		return 0, errorx.New(e)
+	}
+	defer f.Close()
+	n, e := f.ReadAt(p, off)
+	if e != nil && e != io.EOF {
+		return n, errorx.New(e)
+	}
+	return n, e
+}
+
+// size
+func (l LocalFileStorage) Size(fileId string) (int64, error) {
+	info, e := os.Stat(l.path(fileId))
+	if os.IsNotExist(e) {
+		return 0, os.ErrNotExist
+	}
+	if e != nil {
+		return 0, errorx.New(e)
+	}
+	return info.Size(), nil
+}
+
+// remove
+func (l LocalFileStorage) Remove(fileId string) error {
+	if e := os.Remove(l.path(fileId)); e != nil && !os.IsNotExist(e) {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// state of an upload
+type upload struct {
+	init  _json.FileInit
+	acked int
+	done  bool
+	// when it's initiated or a chunk is written
+	active time.Time
+}
+
+// decide whether a connection may download a file, a non-nil error rejects it.
+// key is empty if the connection is not Online
+type DownloadAuthorizer func(key string, conn *websocket.Conn, fileId string) error
+
+// FileTransfer keeps the state of uploads, so that a client can resume an upload from the last acked chunk after reconnect.
+// protocol:
+// 1. client sends FILE_UPLOAD_INIT with size and md5 checksum, server replies FILE_ACK with a random file id, the chunk size and the last acked chunk.
+// 2. client sends FILE_UPLOAD_CHUNK numbered from FILE_ACK.Seq+1, server replies FILE_ACK per chunk.
+// 3. when the last chunk is written and the checksum matches, FILE_ACK.Done is true.
+// 4. after reconnect, client sends the FILE_UPLOAD_INIT again with the file id, and goes on from FILE_ACK.Seq+1.
+// a stored file is downloaded by FILE_DOWNLOAD, server replies FILE_DOWNLOAD frames carrying chunks from 'From' to the last.
+// uploads idle longer than UploadTTL are dropped with their files
+type FileTransfer struct {
+	Storage FileStorage
+	// max size of a chunk
+	ChunkSize int
+	// max size of a file, larger uploads are rejected
+	MaxSize int64
+	// an upload without chunks written in UploadTTL is dropped
+	UploadTTL time.Duration
+
+	m          *sync.RWMutex
+	uploads    map[string]*upload
+	authorizer DownloadAuthorizer
+}
+
+// new a file transfer, if chunkSize <=0, DEFAULT_CHUNK_SIZE will be used
+func NewFileTransfer(storage FileStorage, chunkSize int) *FileTransfer {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	return &FileTransfer{
+		Storage:   storage,
+		ChunkSize: chunkSize,
+		MaxSize:   DEFAULT_MAX_FILE_SIZE,
+		UploadTTL: DEFAULT_UPLOAD_TTL,
+		m:         &sync.RWMutex{},
+		uploads:   make(map[string]*upload),
+	}
+}
+
+// authorize downloads, all downloads are allowed if it's not set.
+// file ids are random, so only those told the id can download a file anyway
+func (ft *FileTransfer) AuthorizeDownload(f DownloadAuthorizer) {
+	ft.m.Lock()
+	defer ft.m.Unlock()
+	ft.authorizer = f
+}
+
+func (ft *FileTransfer) authorize(key string, conn *websocket.Conn, fileId string) error {
+	ft.m.RLock()
+	f := ft.authorizer
+	ft.m.RUnlock()
+	if f == nil {
+		return nil
+	}
+	if e := f(key, conn, fileId); e != nil {
+		if _, ok := e.(*Error); ok {
+			return e
+		}
+		return NewError(ERR_UNAUTHORIZED, e.Error())
+	}
+	return nil
+}
+
+// drop uploads idle longer than UploadTTL and their files, it's done on each Init
+func (ft *FileTransfer) Expire() {
+	ft.m.Lock()
+	defer ft.m.Unlock()
+	ft.expire(time.Now())
+}
+
+// must be called with ft.m locked
+func (ft *FileTransfer) expire(now time.Time) {
+	if ft.UploadTTL <= 0 {
+		return
+	}
+	for fileId, up := range ft.uploads {
+		if now.Sub(up.active) <= ft.UploadTTL {
+			continue
+		}
+		delete(ft.uploads, fileId)
+		if !up.done {
+			ft.Storage.Remove(fileId)
+		}
+	}
+}
+
+// initiate an upload, or get the last acked chunk of an existing one
+func (ft *FileTransfer) Init(in _json.FileInit) (_json.FileAck, error) {
+	if in.Size <= 0 {
+		return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "file size should be positive but got '%d'", in.Size)
+	}
+	if ft.MaxSize > 0 && in.Size > ft.MaxSize {
+		return _json.FileAck{}, Errorf(ERR_PAYLOAD_TOO_LARGE, "file size '%d' exceeds the max '%d'", in.Size, ft.MaxSize)
+	}
+	if in.Checksum == "" {
+		return _json.FileAck{}, NewError(ERR_BAD_REQUEST, "file checksum required")
+	}
+	if in.FileId == "" {
+		id, e := randomFileId()
+		if e != nil {
+			return _json.FileAck{}, errorx.Wrap(e)
+		}
+		in.FileId = id
+	}
+	if !fileIdReg.MatchString(in.FileId) {
+		return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "invalid file id '%s'", in.FileId)
+	}
+	if in.ChunkSize <= 0 || in.ChunkSize > ft.ChunkSize {
+		in.ChunkSize = ft.ChunkSize
+	}
+
+	ft.m.Lock()
+	defer ft.m.Unlock()
+	now := time.Now()
+	ft.expire(now)
+	if up, ok := ft.uploads[in.FileId]; ok {
+		if up.init.Size != in.Size || !strings.EqualFold(up.init.Checksum, in.Checksum) {
+			return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "file id '%s' is in use by another file", in.FileId)
+		}
+		up.active = now
+		return ft.ackOf(up), nil
+	}
+
+	if e := ft.Storage.Create(in.FileId, in.Size); e != nil {
+		return _json.FileAck{}, errorx.Wrap(e)
+	}
+	up := &upload{init: in, active: now}
+	ft.uploads[in.FileId] = up
+	return ft.ackOf(up), nil
+}
+
+// write a chunk.
+// a chunk already acked is ignored, and a chunk out of order is not written,
+// both reply the last acked chunk so the client knows where to go on
+func (ft *FileTransfer) Write(in _json.FileChunk) (_json.FileAck, error) {
+	ft.m.Lock()
+	defer ft.m.Unlock()
+	up, ok := ft.uploads[in.FileId]
+	if !ok {
+		return _json.FileAck{}, Errorf(ERR_NOT_FOUND, "upload '%s' not initiated", in.FileId)
+	}
+	if up.done || in.Seq != up.acked+1 {
+		return ft.ackOf(up), nil
+	}
+
+	off := int64(in.Seq-1) * int64(up.init.ChunkSize)
+	end := off + int64(len(in.Data))
+	if end > up.init.Size {
+		return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "chunk '%d' exceeds file size '%d'", in.Seq, up.init.Size)
+	}
+	if end < up.init.Size && len(in.Data) != up.init.ChunkSize {
+		return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "chunk '%d' should be '%d' bytes but got '%d'", in.Seq, up.init.ChunkSize, len(in.Data))
+	}
+	if e := ft.Storage.WriteAt(in.FileId, in.Data, off); e != nil {
+		return _json.FileAck{}, errorx.Wrap(e)
+	}
+	up.acked = in.Seq
+	up.active = time.Now()
+
+	if end == up.init.Size {
+		sum, e := ft.checksum(in.FileId, up.init.Size)
+		if e != nil {
+			return _json.FileAck{}, errorx.Wrap(e)
+		}
+		if !strings.EqualFold(sum, up.init.Checksum) {
+			delete(ft.uploads, in.FileId)
+			ft.Storage.Remove(in.FileId)
+			return _json.FileAck{}, Errorf(ERR_BAD_REQUEST, "checksum mismatch, want '%s' but got '%s'", up.init.Checksum, sum)
+		}
+		up.done = true
+	}
+	return ft.ackOf(up), nil
+}
+
+// read the chunk 'seq' of a stored file
+func (ft *FileTransfer) Read(fileId string, seq int) (_json.FileChunk, error) {
+	if !fileIdReg.MatchString(fileId) {
+		return _json.FileChunk{}, Errorf(ERR_BAD_REQUEST, "invalid file id '%s'", fileId)
+	}
+	if seq <= 0 {
+		seq = 1
+	}
+	ft.m.RLock()
+	up, ok := ft.uploads[fileId]
+	uploading := ok && !up.done
+	ft.m.RUnlock()
+	if uploading {
+		return _json.FileChunk{}, Errorf(ERR_BAD_REQUEST, "file '%s' is still uploading", fileId).Retry()
+	}
+
+	size, e := ft.Storage.Size(fileId)
+	if e == os.ErrNotExist {
+		return _json.FileChunk{}, Errorf(ERR_NOT_FOUND, "file '%s' not found", fileId)
+	}
+	if e != nil {
+		return _json.FileChunk{}, errorx.Wrap(e)
+	}
+	off := int64(seq-1) * int64(ft.ChunkSize)
+	if off >= size {
+		return _json.FileChunk{}, Errorf(ERR_BAD_REQUEST, "chunk '%d' out of file size '%d'", seq, size)
+	}
+	buf := make([]byte, ft.ChunkSize)
+	n, e := ft.Storage.ReadAt(fileId, buf, off)
+	if e != nil && e != io.EOF {
+		return _json.FileChunk{}, errorx.Wrap(e)
+	}
+	return _json.FileChunk{
+		FileId: fileId,
+		Seq:    seq,
+		Data:   buf[:n],
+		Last:   off+int64(n) >= size,
+	}, nil
+}
+
+// md5 of a stored file, in upper case as util.MD5
+func (ft *FileTransfer) checksum(fileId string, size int64) (string, error) {
+	h := md5.New()
+	buf := make([]byte, ft.ChunkSize)
+	for off := int64(0); off < size; {
+		n, e := ft.Storage.ReadAt(fileId, buf, off)
+		h.Write(buf[:n])
+		off += int64(n)
+		if e == io.EOF || n == 0 {
+			break
+		}
+		if e != nil {
+			return "", errorx.Wrap(e)
+		}
+	}
+	return strings.ToUpper(fmt.Sprintf("%x", h.Sum(nil))), nil
+}
+
+// a random file id of 32 hex characters
+func randomFileId() (string, error) {
+	b := make([]byte, 16)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (ft *FileTransfer) ackOf(up *upload) _json.FileAck {
+	return _json.FileAck{
+		FileId:    up.init.FileId,
+		Seq:       up.acked,
+		ChunkSize: up.init.ChunkSize,
+		Done:      up.done,
+	}
+}
+
+// enable chunked file transfer, handlers of FILE_UPLOAD_INIT, FILE_UPLOAD_CHUNK and FILE_DOWNLOAD will be registered.
+// if storage is nil, files will be saved to the local directory Options.FileStoragePath
+func (wsh *WebSocketHelper) EnableFileTransfer(storage FileStorage) *FileTransfer {
+	opts := wsh.Options()
+	if storage == nil {
+		dir := opts.FileStoragePath
+		if dir == "" {
+			dir = "files"
+		}
+		storage = LocalFileStorage{Dir: dir}
+	}
+	ft := NewFileTransfer(storage, opts.FileChunkSize)
+	ft.MaxSize = opts.MaxFileSize
+	ft.UploadTTL = opts.FileUploadTTL
+	wsh.M.Lock()
+	wsh.files = ft
+	wsh.M.Unlock()
+	wsh.HandleFunc(FILE_UPLOAD_INIT, wsh.handleFileUploadInit)
+	wsh.HandleFunc(FILE_UPLOAD_CHUNK, wsh.handleFileUploadChunk)
+	wsh.HandleFunc(FILE_DOWNLOAD, wsh.handleFileDownload)
+	return ft
+}
+
+func (wsh *WebSocketHelper) fileTransfer() *FileTransfer {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.files
+}
+
+func (wsh *WebSocketHelper) handleFileUploadInit(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.FileInit
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad file init: %s", e.Error())
+	}
+	ack, e := wsh.fileTransfer().Init(in)
+	if e != nil {
+		return wrapError(e)
+	}
+	return wsh.ReplyContext(ContextOf(cache), ConnOf(cache), FILE_ACK, ack)
+}
+
+func (wsh *WebSocketHelper) handleFileUploadChunk(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.FileChunk
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad file chunk: %s", e.Error())
+	}
+	ack, e := wsh.fileTransfer().Write(in)
+	if e != nil {
+		return wrapError(e)
+	}
+	return wsh.ReplyContext(ContextOf(cache), ConnOf(cache), FILE_ACK, ack)
+}
+
+func (wsh *WebSocketHelper) handleFileDownload(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.FileDownload
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad file download: %s", e.Error())
+	}
+	if in.From <= 0 {
+		in.From = 1
+	}
+	conn := ConnOf(cache)
+	ft := wsh.fileTransfer()
+	key, _ := pool.KeyOf(conn)
+	if e := ft.authorize(key, conn, in.FileId); e != nil {
+		return e
+	}
+	for seq := in.From; ; seq++ {
+		chunk, e := ft.Read(in.FileId, seq)
+		if e != nil {
+			return wrapError(e)
+		}
+		if e = wsh.ReplyContext(ContextOf(cache), conn, FILE_DOWNLOAD, chunk); e != nil {
+			return e
+		}
+		if chunk.Last {
+			return nil
+		}
+	}
+}
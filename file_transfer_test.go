@@ -0,0 +1,148 @@
+package wshelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileTransfer(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ft := NewFileTransfer(LocalFileStorage{Dir: dir}, 4)
+	content := []byte("hello wshelper")
+	in := _json.FileInit{Name: "hello.txt", SubType: FILE, Size: int64(len(content)), Checksum: util.MD5(string(content))}
+
+	ack, e := ft.Init(in)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	util.Assertf(ack.FileId != "" && ack.ChunkSize == 4 && ack.Seq == 0, t, "bad ack %+v", ack)
+
+	// chunk 1 and an out-of-order chunk 3
+	ack, _ = ft.Write(_json.FileChunk{FileId: ack.FileId, Seq: 1, Data: content[:4]})
+	util.Assertf(ack.Seq == 1, t, "want seq 1 but got %d", ack.Seq)
+	ack, _ = ft.Write(_json.FileChunk{FileId: ack.FileId, Seq: 3, Data: content[8:12]})
+	util.Assertf(ack.Seq == 1, t, "want seq 1 but got %d", ack.Seq)
+
+	// resume after reconnect by the assigned id
+	in.FileId = ack.FileId
+	ack, e = ft.Init(in)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	util.Assertf(ack.Seq == 1, t, "want resume from 1 but got %d", ack.Seq)
+	for seq := ack.Seq + 1; !ack.Done; seq++ {
+		end := seq * 4
+		if end > len(content) {
+			end = len(content)
+		}
+		ack, e = ft.Write(_json.FileChunk{FileId: ack.FileId, Seq: seq, Data: content[(seq-1)*4 : end]})
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+	}
+
+	var got []byte
+	for seq := 1; ; seq++ {
+		chunk, e := ft.Read(ack.FileId, seq)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		got = append(got, chunk.Data...)
+		if chunk.Last {
+			break
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("want '%s' but got '%s'", content, got)
+	}
+}
+
+func TestFileTransferLimits(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ft := NewFileTransfer(LocalFileStorage{Dir: dir}, 4)
+	ft.MaxSize = 8
+	_, e = ft.Init(_json.FileInit{Size: 9, Checksum: "X"})
+	var te *Error
+	util.Assertf(errors.As(e, &te) && te.Code == ERR_PAYLOAD_TOO_LARGE, t, "want ERR_PAYLOAD_TOO_LARGE but got %v", e)
+
+	// ids are random, not derived from the file
+	in := _json.FileInit{Size: 8, Checksum: util.MD5("12345678")}
+	ack1, e := ft.Init(in)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	ack2, e := ft.Init(in)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	util.Assertf(ack1.FileId != ack2.FileId, t, "want different ids but got '%s' twice", ack1.FileId)
+
+	// idle uploads are dropped with their files
+	ft.UploadTTL = 50 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	ft.Expire()
+	_, e = ft.Write(_json.FileChunk{FileId: ack1.FileId, Seq: 1, Data: []byte("1234")})
+	util.Assertf(errors.As(e, &te) && te.Code == ERR_NOT_FOUND, t, "want ERR_NOT_FOUND but got %v", e)
+	_, e = os.Stat(LocalFileStorage{Dir: dir}.path(ack2.FileId))
+	util.Assertf(os.IsNotExist(e), t, "want the file removed but got %v", e)
+}
+
+func TestFileDownloadAuthorized(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	wsh := NewWsHelper(nil)
+	ft := wsh.EnableFileTransfer(LocalFileStorage{Dir: dir})
+	ft.AuthorizeDownload(func(key string, conn *websocket.Conn, fileId string) error {
+		if key != "tom" {
+			return errors.New("only tom downloads")
+		}
+		return nil
+	})
+	handleTestLogin(wsh, nil)
+	ts := newTestServer(t, wsh)
+
+	content := "hello"
+	ack, e := ft.Init(_json.FileInit{Size: int64(len(content)), Checksum: util.MD5(content)})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if _, e = ft.Write(_json.FileChunk{FileId: ack.FileId, Seq: 1, Data: []byte(content)}); e != nil {
+		t.Fatal(e.Error())
+	}
+
+	bob := loginTest(t, wsh, ts, "bob", "")
+	bob.Send(FILE_DOWNLOAD, `{"file_id":"`+ack.FileId+`"}`)
+	reply := bob.Reply()
+	var rs _json.Error
+	b, _ := json.Marshal(reply.ReplyValue)
+	json.Unmarshal(b, &rs)
+	util.Assertf(reply.ReplyType == REPLY_ERROR && rs.Code == ERR_UNAUTHORIZED, t, "want ERR_UNAUTHORIZED but got %+v", reply)
+
+	tom := loginTest(t, wsh, ts, "tom", "")
+	tom.Send(FILE_DOWNLOAD, `{"file_id":"`+ack.FileId+`"}`)
+	var chunk _json.FileChunk
+	tom.ReceiveInto(&chunk)
+	util.Assertf(string(chunk.Data) == content && chunk.Last, t, "bad chunk %+v", chunk)
+}
@@ -0,0 +1,165 @@
+package wshelper
+
+import (
+	"encoding/binary"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+)
+
+// a stream is a header message of the command hash and an 8 byte big-endian body size,
+// followed by the body in any number of binary frames. bodies are not compressed
+const STREAM_HEADER_SIZE = 32 + 8
+
+// FrameReader reads the body of a stream, no more than its declared size.
+//
+//	json.NewDecoder(r).Decode(&dest)
+//	io.Copy(file, r)
+type FrameReader struct {
+	// command of the stream
+	Command int
+	// declared body size
+	Size int64
+
+	conn *websocket.Conn
+	body io.Reader
+}
+
+// read the body
+func (fr *FrameReader) Read(p []byte) (int, error) {
+	n, e := fr.body.Read(p)
+	if e != nil && e != io.EOF {
+		return n, errorx.New(e)
+	}
+	return n, e
+}
+
+// bytes of the body not read yet
+func (fr *FrameReader) Remaining() int64 {
+	return fr.body.(*io.LimitedReader).N
+}
+
+// discard the unread body, so that the next message can be read
+func (fr *FrameReader) Close() error {
+	if _, e := io.Copy(ioutil.Discard, fr.body); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// stream handlers get the body as a FrameReader rather than raw bytes
+type StreamHandler func(pool *ConnectionPool, r *FrameReader, cache map[string]interface{}) error
+
+// handle a command whose body is streamed, the declared size is limited to max bytes.
+// the rest of the body the handler does not read is discarded
+func (wsh *WebSocketHelper) HandleStream(command int, max int, f StreamHandler) {
+	wsh.M.Lock()
+	hash := wsh.genCommandHash(command)
+	if _, ok := wsh.commandHash[hash]; !ok {
+		wsh.Commands = append(wsh.Commands, command)
+		wsh.commandHash[hash] = command
+	}
+	wsh.streamHandlers[command] = f
+	wsh.M.Unlock()
+	wsh.SetPayloadLimit(command, max)
+}
+
+func (wsh *WebSocketHelper) streamHandlerOf(command int) (StreamHandler, bool) {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	f, ok := wsh.streamHandlers[command]
+	return f, ok
+}
+
+// get the reader of a stream from its header message
+func (wsh *WebSocketHelper) newFrameReader(conn *websocket.Conn, header []byte) (*FrameReader, error) {
+	if len(header) != STREAM_HEADER_SIZE {
+		return nil, Errorf(ERR_BAD_REQUEST, "required a stream header of length '%d' but got '%d'", STREAM_HEADER_SIZE, len(header)).Fatal()
+	}
+	command := wsh.GetCommand(string(header[:32]))
+	if command == 0 {
+		return nil, NewError(ERR_UNKNOWN_COMMAND, "unknown command of the stream").Fatal()
+	}
+	size := int64(binary.BigEndian.Uint64(header[32:]))
+	if size < 0 {
+		return nil, Errorf(ERR_BAD_REQUEST, "invalid stream size '%d'", size).Fatal()
+	}
+	return &FrameReader{
+		Command: command,
+		Size:    size,
+		conn:    conn,
+		body:    &io.LimitedReader{R: conn, N: size},
+	}, nil
+}
+
+// receive a stream, the header is read once and the body is left to the returned reader.
+// the reader should be read up or closed before receiving the next message.
+// websocket.ErrFrameTooLarge if the declared size is bigger than max, the body is not read then
+func (wsh *WebSocketHelper) ReceiveStream(conn *websocket.Conn, max int) (*FrameReader, error) {
+	header, e := wsh.pool.Read(conn)
+	if e != nil {
+		if e == io.EOF {
+			return nil, e
+		}
+		return nil, errorx.New(e)
+	}
+	fr, e := wsh.newFrameReader(conn, header)
+	if e != nil {
+		return nil, e
+	}
+	if fr.Size > int64(max) {
+		return nil, websocket.ErrFrameTooLarge
+	}
+	return fr, nil
+}
+
+// send size bytes read from r as a stream of command, in frames of DEFAULT_CHUNK_SIZE
+func (wsh *WebSocketHelper) SendStream(conn *websocket.Conn, command int, size int64, r io.Reader) error {
+	header := make([]byte, STREAM_HEADER_SIZE)
+	copy(header, wsh.genCommandHash(command))
+	binary.BigEndian.PutUint64(header[32:], uint64(size))
+	if e := wsh.pool.Write(conn, header); e != nil {
+		return errorx.Wrap(e)
+	}
+	// each Write is a frame, wrap conn to keep io.CopyBuffer writing by the buffer
+	n, e := io.CopyBuffer(struct{ io.Writer }{conn}, io.LimitReader(r, size), make([]byte, DEFAULT_CHUNK_SIZE))
+	if e != nil {
+		return errorx.New(e)
+	}
+	wsh.metricsOf().addBytesOut(n)
+	if n != size {
+		return errorx.NewFromStringf("stream declared size '%d' but only '%d' read", size, n)
+	}
+	return nil
+}
+
+// serve a stream whose header the dispatcher has read.
+// a stream larger than its limit closes the connection, since its body is on the way
+func (wsh *WebSocketHelper) serveStream(stream StreamHandler, conn *websocket.Conn, header []byte, cache map[string]interface{}) error {
+	fr, e := wsh.newFrameReader(conn, header)
+	if e != nil {
+		return e
+	}
+	if limit := wsh.PayloadLimitOf(fr.Command); fr.Size > int64(limit) {
+		return errPayloadTooLarge(fr.Command, fr.Size, limit).Fatal()
+	}
+	wsh.metricsOf().addBytesIn(fr.Size)
+	if e = stream(wsh.pool, fr, cache); e != nil {
+		// the rest of the body is not read, the connection can't go on
+		if typed, ok := e.(*Error); ok && fr.Remaining() > 0 {
+			return typed.Fatal()
+		}
+		return e
+	}
+	return fr.Close()
+}
+
+// discard the body of a stream whose header the dispatcher has read
+func (wsh *WebSocketHelper) discardStream(conn *websocket.Conn, header []byte) error {
+	fr, e := wsh.newFrameReader(conn, header)
+	if e != nil {
+		return e
+	}
+	return fr.Close()
+}
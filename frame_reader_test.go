@@ -0,0 +1,87 @@
+package wshelper
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"eyas/wshelper/model/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	const UPLOAD, PEEK, PING = 1000, 1001, 1002
+	wsh := NewWsHelper(nil)
+	wsh.SetMaxPayload(16)
+	wsh.HandleStream(UPLOAD, 1*MB, func(pool *ConnectionPool, r *FrameReader, cache map[string]interface{}) error {
+		h := md5.New()
+		if _, e := io.Copy(h, r); e != nil {
+			return e
+		}
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Tip: fmt.Sprintf("%x", h.Sum(nil))})
+	})
+	// reads a part, the rest is discarded
+	wsh.HandleStream(PEEK, 1*MB, func(pool *ConnectionPool, r *FrameReader, cache map[string]interface{}) error {
+		buf := make([]byte, 4)
+		if _, e := io.ReadFull(r, buf); e != nil {
+			return e
+		}
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Tip: string(buf)})
+	})
+	wsh.HandleFunc(PING, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Tip: "pong"})
+	})
+	ts := httptest.NewServer(websocket.Handler(wsh.Dispatcher(func(e error) { t.Error(e.Error()) })))
+	defer ts.Close()
+
+	conn, e := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn.Close()
+	receive := func() _json.Reply {
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if e := websocket.Message.Receive(conn, &buf); e != nil {
+			t.Fatal(e.Error())
+		}
+		var reply _json.Reply
+		if e := wsh.CoreOf(buf, &reply); e != nil {
+			t.Fatal(e.Error())
+		}
+		return reply
+	}
+
+	body := bytes.Repeat([]byte("0123456789"), 20000)
+	if e = wsh.SendStream(conn, UPLOAD, int64(len(body)), bytes.NewReader(body)); e != nil {
+		t.Fatal(e.Error())
+	}
+	if got, want := receive().Tip, fmt.Sprintf("%x", md5.Sum(body)); got != want {
+		t.Fatalf("want md5 '%s' but got '%s'", want, got)
+	}
+
+	if e = wsh.SendStream(conn, PEEK, int64(len(body)), bytes.NewReader(body)); e != nil {
+		t.Fatal(e.Error())
+	}
+	if got := receive().Tip; got != "0123" {
+		t.Fatalf("want '0123' but got '%s'", got)
+	}
+	websocket.Message.Send(conn, []byte(wsh.genCommandHash(PING)))
+	if got := receive().Tip; got != "pong" {
+		t.Fatalf("want 'pong' after streams but got '%s'", got)
+	}
+
+	// too large, replied before the connection is closed
+	header := make([]byte, STREAM_HEADER_SIZE)
+	copy(header, wsh.genCommandHash(UPLOAD))
+	binary.BigEndian.PutUint64(header[32:], 2*MB)
+	websocket.Message.Send(conn, header)
+	if reply := receive(); reply.ReplyType != REPLY_ERROR {
+		t.Fatalf("want reply type '%d' but got '%d'", REPLY_ERROR, reply.ReplyType)
+	}
+}
@@ -0,0 +1,16 @@
+package wshelper
+
+import (
+	"net"
+)
+
+// whether an error is a timeout, like a connection sending no heartbeat in Options.HeartbeatTimeout
+func isTimeout(e error) bool {
+	ne, ok := e.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// reply HEARTBEAT with no body, the dispatcher extends the read deadline on any message
+func (wsh *WebSocketHelper) handleHeartbeat(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	return pool.Write(ConnOf(cache), rawBytes[:32])
+}
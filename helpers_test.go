@@ -0,0 +1,108 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the command of the login handler set by handleTestLogin
+const TEST_LOGIN = 1000
+
+// serve wsh by its dispatcher, errors not handled by the error policy fail the test
+func newTestServer(t *testing.T, wsh *WebSocketHelper) *httptest.Server {
+	ts := httptest.NewServer(websocket.Handler(wsh.Dispatcher(func(e error) { t.Error(e.Error()) })))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// handle TEST_LOGIN with a SendOne, From goes online and a REPLY_MESSAGE is replied.
+// then is called before the reply if not nil
+func handleTestLogin(wsh *WebSocketHelper, then func(in _json.SendOne, cache map[string]interface{})) {
+	wsh.HandleFunc(TEST_LOGIN, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return NewError(ERR_BAD_REQUEST, "bad json")
+		}
+		wsh.Online(in.From, ConnOf(cache))
+		if then != nil {
+			then(in, cache)
+		}
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE})
+	})
+}
+
+// a client connection of a test server
+type testClient struct {
+	t    *testing.T
+	wsh  *WebSocketHelper
+	Conn *websocket.Conn
+}
+
+// dial a test server, query like "?compress=deflate" is appended to the url
+func dialTest(t *testing.T, wsh *WebSocketHelper, ts *httptest.Server, query string) *testClient {
+	conn, e := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+query, "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, wsh: wsh, Conn: conn}
+}
+
+// dial a test server and send TEST_LOGIN as user, the login reply is received
+func loginTest(t *testing.T, wsh *WebSocketHelper, ts *httptest.Server, user string, message string) *testClient {
+	c := dialTest(t, wsh, ts, "")
+	c.Send(TEST_LOGIN, `{"from":"`+user+`","message":"`+message+`"}`)
+	c.Receive()
+	return c
+}
+
+// send a frame of command with a json body
+func (c *testClient) Send(command int, body string) {
+	c.SendFrame(append([]byte(c.wsh.genCommandHash(command)), body...))
+}
+
+// send a frame as it is
+func (c *testClient) SendFrame(frame []byte) {
+	if e := websocket.Message.Send(c.Conn, frame); e != nil {
+		c.t.Fatal(e.Error())
+	}
+}
+
+// receive a frame in 5 seconds
+func (c *testClient) Receive() []byte {
+	var buf []byte
+	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if e := websocket.Message.Receive(c.Conn, &buf); e != nil {
+		c.t.Fatal(e.Error())
+	}
+	return buf
+}
+
+// receive a frame and unmarshal its body into dest, the command hash is returned
+func (c *testClient) ReceiveInto(dest interface{}) string {
+	buf := c.Receive()
+	if e := c.wsh.CoreOf(buf, dest); e != nil {
+		c.t.Fatal(e.Error())
+	}
+	return string(buf[:32])
+}
+
+// receive a REPLY
+func (c *testClient) Reply() _json.Reply {
+	var reply _json.Reply
+	if hash := c.ReceiveInto(&reply); hash != c.wsh.genCommandHash(REPLY) {
+		c.t.Fatalf("want a REPLY but got command '%d'", c.wsh.GetCommand(hash))
+	}
+	return reply
+}
+
+// whether nothing is received in d
+func (c *testClient) Silent(d time.Duration) bool {
+	var buf []byte
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	return websocket.Message.Receive(c.Conn, &buf) != nil
+}
@@ -0,0 +1,193 @@
+package wshelper
+
+import (
+	"errors"
+	"eyas/wshelper/dao"
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+)
+
+// enable history queries by HISTORY, messages are saved and read back through store.
+// if store is nil, a dao.MemoryStore will be used
+func (wsh *WebSocketHelper) EnableHistory(store dao.MessageStore) dao.MessageStore {
+	if store == nil {
+		store = dao.NewMemoryStore()
+	}
+	wsh.M.Lock()
+	wsh.messages = store
+	wsh.M.Unlock()
+	wsh.HandleFunc(HISTORY, wsh.handleHistory)
+	return store
+}
+
+// decide whether a user may query the history of a group or a room, a non-nil error rejects it as ERR_UNAUTHORIZED,
+// an *Error is replied as it is. wrap a failure of the store behind it by StoreFailure, it's replied as ERR_INTERNAL
+type HistoryAuthorizer func(key string, channelType int, channelId string) error
+
+// a failure of a store, like a database outage, rather than a rejection
+type storeFailure struct {
+	e error
+}
+
+func (f *storeFailure) Error() string {
+	return f.e.Error()
+}
+
+func (f *storeFailure) Unwrap() error {
+	return f.e
+}
+
+// mark an error of an authorizer as a failure of its store, so it's not replied as a permission denial
+func StoreFailure(e error) error {
+	if e == nil {
+		return nil
+	}
+	return &storeFailure{e: errorx.Wrap(e)}
+}
+
+// authorize HISTORY queries of groups and rooms, they're rejected until it's set.
+// one-to-one history needs no authorizer, it's always limited to the requester's own conversations:
+//
+//	wsh.AuthorizeHistory(wshelper.MembersOf(store))
+func (wsh *WebSocketHelper) AuthorizeHistory(f HistoryAuthorizer) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.historyAuth = f
+}
+
+// authorize group and room history by their members in store
+func MembersOf(store interface {
+	dao.GroupStore
+	dao.RoomStore
+}) HistoryAuthorizer {
+	return func(key string, channelType int, channelId string) error {
+		var members []string
+		var e error
+		switch channelType {
+		case dao.CHANNEL_GROUP:
+			members, e = store.GroupMembers(channelId)
+		case dao.CHANNEL_ROOM:
+			members, e = store.RoomMembers(channelId)
+		}
+		if e != nil {
+			return StoreFailure(e)
+		}
+		for _, member := range members {
+			if member == key {
+				return nil
+			}
+		}
+		return Errorf(ERR_UNAUTHORIZED, "'%s' is not a member of '%s'", key, channelId)
+	}
+}
+
+// check a history query of a group or a room by the authorizer
+func (wsh *WebSocketHelper) authorizeHistory(key string, channelType int, channelId string) error {
+	wsh.M.RLock()
+	f := wsh.historyAuth
+	wsh.M.RUnlock()
+	if f == nil {
+		return NewError(ERR_UNAUTHORIZED, "history of groups and rooms is not authorized, call AuthorizeHistory first")
+	}
+	if e := f(key, channelType, channelId); e != nil {
+		if typed, ok := asError(e); ok {
+			return typed
+		}
+		var failure *storeFailure
+		if errors.As(e, &failure) {
+			return wsh.historyUnavailable(failure.e)
+		}
+		return NewError(ERR_UNAUTHORIZED, e.Error())
+	}
+	return nil
+}
+
+// a store failure is logged and replied as a retryable ERR_INTERNAL, the cause is not shown to clients
+func (wsh *WebSocketHelper) historyUnavailable(e error) *Error {
+	wsh.Logger().Error("history store", "error", e)
+	return NewError(ERR_INTERNAL, "history not available").Retry()
+}
+
+func (wsh *WebSocketHelper) messageStore() (dao.MessageStore, error) {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	if wsh.messages == nil {
+		return nil, errorx.NewFromString("history not enabled, call EnableHistory first")
+	}
+	return wsh.messages, nil
+}
+
+// persist a message, the channel id of a one-to-one message is generated from From and To if not set
+func (wsh *WebSocketHelper) SaveMessage(msg *dao.Message) error {
+	store, e := wsh.messageStore()
+	if e != nil {
+		return e
+	}
+	if msg.ChannelType == dao.CHANNEL_ONE && msg.ChannelId == "" {
+		msg.ChannelId = dao.OneToOneChannel(msg.From, msg.To)
+	}
+	return store.SaveMessage(msg)
+}
+
+// get a page of history
+func (wsh *WebSocketHelper) History(q dao.HistoryQuery) ([]dao.Message, bool, error) {
+	store, e := wsh.messageStore()
+	if e != nil {
+		return nil, false, e
+	}
+	return store.History(q)
+}
+
+// one-to-one history is limited to the requester's own conversations, 'ChannelId' of the request is the peer key.
+// history of groups and rooms is checked by the authorizer of AuthorizeHistory
+func (wsh *WebSocketHelper) handleHistory(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.HistoryQuery
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad history query: %s", e.Error())
+	}
+	if in.ChannelType < dao.CHANNEL_ONE || in.ChannelType > dao.CHANNEL_ROOM {
+		return Errorf(ERR_BAD_REQUEST, "unknown channel type '%d'", in.ChannelType)
+	}
+	if in.ChannelId == "" {
+		return NewError(ERR_BAD_REQUEST, "channel id required")
+	}
+	key, ok := pool.KeyOf(ConnOf(cache))
+	if !ok {
+		return NewError(ERR_UNAUTHORIZED, "history query from a connection not online")
+	}
+	q := dao.HistoryQuery{
+		ChannelType: in.ChannelType,
+		ChannelId:   in.ChannelId,
+		Before:      in.Before,
+		After:       in.After,
+		Limit:       in.Limit,
+		SubTypes:    in.SubTypes,
+	}
+	if q.ChannelType == dao.CHANNEL_ONE {
+		q.ChannelId = dao.OneToOneChannel(key, in.ChannelId)
+	} else if e := wsh.authorizeHistory(key, q.ChannelType, q.ChannelId); e != nil {
+		return e
+	}
+
+	msgs, hasMore, e := wsh.History(q)
+	if e != nil {
+		return wsh.historyUnavailable(e)
+	}
+	page := _json.HistoryPage{
+		Messages: make([]_json.Message, 0, len(msgs)),
+		HasMore:  hasMore,
+	}
+	for _, msg := range msgs {
+		page.Messages = append(page.Messages, _json.Message{
+			Id:          msg.Id,
+			ChannelType: msg.ChannelType,
+			ChannelId:   msg.ChannelId,
+			From:        msg.From,
+			To:          msg.To,
+			SubType:     msg.SubType,
+			Body:        msg.Body,
+			SendAt:      msg.SendAt,
+		})
+	}
+	return wsh.ReplyContext(ContextOf(cache), ConnOf(cache), HISTORY, page)
+}
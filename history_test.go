@@ -0,0 +1,79 @@
+package wshelper
+
+import (
+	"encoding/json"
+	"errors"
+	"eyas/wshelper/dao"
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"github.com/fwhezfwhez/errorx"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	wsh.EnableHistory(nil)
+	ts := newTestServer(t, wsh)
+	tom := loginTest(t, wsh, ts, "tom", "")
+	bob := loginTest(t, wsh, ts, "bob", "")
+
+	wsh.SaveMessage(&dao.Message{ChannelType: dao.CHANNEL_ONE, From: "tom", To: "bob", Body: []byte("hi")})
+	wsh.SaveMessage(&dao.Message{ChannelType: dao.CHANNEL_GROUP, ChannelId: "g1", From: "tom", Body: []byte("hello")})
+	page := func(c *testClient, body string) (_json.HistoryPage, _json.Error) {
+		c.Send(HISTORY, body)
+		buf := c.Receive()
+		var page _json.HistoryPage
+		var rs _json.Error
+		if string(buf[:32]) == wsh.genCommandHash(HISTORY) {
+			wsh.CoreOf(buf, &page)
+			return page, rs
+		}
+		var reply _json.Reply
+		wsh.CoreOf(buf, &reply)
+		b, _ := json.Marshal(reply.ReplyValue)
+		json.Unmarshal(b, &rs)
+		return page, rs
+	}
+
+	p, _ := page(bob, `{"channel_type":1,"channel_id":"tom"}`)
+	util.Assertf(len(p.Messages) == 1 && string(p.Messages[0].Body) == "hi", t, "bad one-to-one history %+v", p)
+
+	// rejected without an authorizer
+	_, rs := page(tom, `{"channel_type":2,"channel_id":"g1"}`)
+	util.Assertf(rs.Code == ERR_UNAUTHORIZED, t, "want unauthorized but got %+v", rs)
+
+	store := dao.NewMemoryStore()
+	store.SaveGroup(dao.Group{Id: "g1", Owner: "tom"})
+	store.JoinGroup("g1", "tom")
+	wsh.AuthorizeHistory(MembersOf(store))
+	p, _ = page(tom, `{"channel_type":2,"channel_id":"g1"}`)
+	util.Assertf(len(p.Messages) == 1 && string(p.Messages[0].Body) == "hello", t, "bad group history %+v", p)
+	_, rs = page(bob, `{"channel_type":2,"channel_id":"g1"}`)
+	util.Assertf(rs.Code == ERR_UNAUTHORIZED, t, "bob is not a member, want unauthorized but got %+v", rs)
+}
+
+// a store failure of the authorizer is an internal error, not a permission denial
+func TestHistoryStoreFailure(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	wsh.EnableHistory(nil)
+	tom := loginTest(t, wsh, newTestServer(t, wsh), "tom", "")
+	for want, f := range map[int]HistoryAuthorizer{
+		ERR_INTERNAL: func(key string, channelType int, channelId string) error {
+			return StoreFailure(errors.New("db down"))
+		},
+		ERR_NOT_FOUND: func(key string, channelType int, channelId string) error {
+			return errorx.Wrap(NewError(ERR_NOT_FOUND, "no such group"))
+		},
+	} {
+		wsh.AuthorizeHistory(f)
+		tom.Send(HISTORY, `{"channel_type":2,"channel_id":"g1"}`)
+		reply := tom.Reply()
+		var rs _json.Error
+		b, _ := json.Marshal(reply.ReplyValue)
+		json.Unmarshal(b, &rs)
+		util.Assertf(reply.ReplyType == REPLY_ERROR && rs.Code == want, t, "want code '%d' but got %+v", want, rs)
+		util.Assertf(rs.Code != ERR_INTERNAL || rs.Retryable && rs.Message == "history not available", t, "bad internal error %+v", rs)
+	}
+}
@@ -0,0 +1,117 @@
+package wshelper
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// log levels
+const (
+	LEVEL_DEBUG = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+// a leveled and structured logger, kvs are key value pairs like:
+//
+//	logger.Error("recover from panic", "panic", e, "remote", addr)
+type Logger interface {
+	Debug(msg string, kvs ...interface{})
+	Info(msg string, kvs ...interface{})
+	Warn(msg string, kvs ...interface{})
+	Error(msg string, kvs ...interface{})
+}
+
+// a logger logging nothing, the default of WebSocketHelper
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, kvs ...interface{}) {}
+func (NopLogger) Info(msg string, kvs ...interface{})  {}
+func (NopLogger) Warn(msg string, kvs ...interface{})  {}
+func (NopLogger) Error(msg string, kvs ...interface{}) {}
+
+// a logger on the stdlib log, lines are like 'ERROR recover from panic panic="oops" remote=127.0.0.1'
+type StdLogger struct {
+	L *log.Logger
+	// logs below Level are dropped
+	Level int
+}
+
+// new a logger on the stdlib log, nil l means log.New(os.Stderr, "", log.LstdFlags)
+func NewStdLogger(l *log.Logger, level int) *StdLogger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &StdLogger{L: l, Level: level}
+}
+
+func (s *StdLogger) Debug(msg string, kvs ...interface{}) { s.log(LEVEL_DEBUG, "DEBUG", msg, kvs) }
+func (s *StdLogger) Info(msg string, kvs ...interface{})  { s.log(LEVEL_INFO, "INFO", msg, kvs) }
+func (s *StdLogger) Warn(msg string, kvs ...interface{})  { s.log(LEVEL_WARN, "WARN", msg, kvs) }
+func (s *StdLogger) Error(msg string, kvs ...interface{}) { s.log(LEVEL_ERROR, "ERROR", msg, kvs) }
+
+func (s *StdLogger) log(level int, name string, msg string, kvs []interface{}) {
+	if level < s.Level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(kvs); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(kvs) {
+			value = kvs[i+1]
+		}
+		if e, ok := value.(error); ok {
+			value = e.Error()
+		}
+		fmt.Fprintf(&b, " %v=%q", kvs[i], fmt.Sprint(value))
+	}
+	// report the file of the caller of the level method
+	s.L.Output(3, b.String())
+}
+
+// parse a level name like 'info', LEVEL_INFO if unknown
+func ParseLevel(name string) int {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LEVEL_DEBUG
+	case "warn", "warning":
+		return LEVEL_WARN
+	case "error":
+		return LEVEL_ERROR
+	}
+	return LEVEL_INFO
+}
+
+// set the logger, nil means NopLogger
+func (wsh *WebSocketHelper) SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.options.Logger = l
+	wsh.pool.SetLogger(l)
+	if wsh.rateLimiter != nil {
+		wsh.rateLimiter.SetLogger(l)
+	}
+}
+
+// get the logger
+func (wsh *WebSocketHelper) Logger() Logger {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.options.Logger
+}
+
+// a handleE logging errors by the logger:
+//
+//	http.Handle("/test-ws/", websocket.Handler(wsh.Dispatcher(wsh.LogError)))
+func (wsh *WebSocketHelper) LogError(e error) {
+	wsh.Logger().Error("handle message", "error", e)
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+
+package wshelper
+
+import (
+	"context"
+	"log/slog"
+)
+
+// a logger on log/slog
+type SlogLogger struct {
+	L *slog.Logger
+}
+
+// new a logger on log/slog, nil l means slog.Default()
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &SlogLogger{L: l}
+}
+
+func (s *SlogLogger) Debug(msg string, kvs ...interface{}) {
+	s.L.Log(context.Background(), slog.LevelDebug, msg, kvs...)
+}
+func (s *SlogLogger) Info(msg string, kvs ...interface{}) {
+	s.L.Log(context.Background(), slog.LevelInfo, msg, kvs...)
+}
+func (s *SlogLogger) Warn(msg string, kvs ...interface{}) {
+	s.L.Log(context.Background(), slog.LevelWarn, msg, kvs...)
+}
+func (s *SlogLogger) Error(msg string, kvs ...interface{}) {
+	s.L.Log(context.Background(), slog.LevelError, msg, kvs...)
+}
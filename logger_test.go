@@ -0,0 +1,42 @@
+package wshelper
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LEVEL_INFO)
+	l.Debug("dropped", "k", 1)
+	l.Info("user online", "key", "tom", "conns", 2)
+	l.Error("serve message", "error", errors.New("db down"), "odd")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		`INFO user online key="tom" conns="2"`,
+		`ERROR serve message error="db down" odd="!MISSING"`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("want %d lines but got %q", len(want), lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("want '%s' but got '%s'", want[i], lines[i])
+		}
+	}
+
+	wsh := NewWsHelper(nil)
+	if _, ok := wsh.Logger().(NopLogger); !ok {
+		t.Fatalf("want NopLogger by default but got %T", wsh.Logger())
+	}
+	wsh.SetLogger(l)
+	buf.Reset()
+	wsh.LogError(errors.New("oops"))
+	if got := strings.TrimSpace(buf.String()); got != `ERROR handle message error="oops"` {
+		t.Fatalf("unexpected log '%s'", got)
+	}
+}
@@ -0,0 +1,355 @@
+package wshelper
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds in seconds of the handler latency histogram
+var DEFAULT_LATENCY_BUCKETS = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// reasons a message is not sent
+const (
+	// the receiver is offline and no offline store is set
+	DROP_OFFLINE = "offline"
+	// writing to the connection failed
+	DROP_ERROR = "error"
+)
+
+type histogram struct {
+	// counts[i] counts observations <= buckets[i], the last one counts the rest
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics of a WebSocketHelper, served in the Prometheus text format by Handler.
+// all methods are no-ops on a nil *Metrics, which is the state before EnableMetrics
+type Metrics struct {
+	wsh     *WebSocketHelper
+	buckets []float64
+	// command hash -> command, of built-in commands which may have no handler
+	builtins map[string]int
+
+	connects    uint64
+	disconnects uint64
+	bytesIn     uint64
+	bytesOut    uint64
+
+	m                *sync.Mutex
+	framesIn         map[int]uint64
+	framesOut        map[int]uint64
+	latency          map[int]*histogram
+	drops            map[string]uint64
+	serializerErrors map[string]uint64
+	errors           map[int]uint64
+}
+
+// new metrics of wsh, buckets nil means DEFAULT_LATENCY_BUCKETS
+func NewMetrics(wsh *WebSocketHelper, buckets []float64) *Metrics {
+	if buckets == nil {
+		buckets = DEFAULT_LATENCY_BUCKETS
+	}
+	mt := &Metrics{
+		wsh:              wsh,
+		buckets:          buckets,
+		builtins:         make(map[string]int),
+		m:                &sync.Mutex{},
+		framesIn:         make(map[int]uint64),
+		framesOut:        make(map[int]uint64),
+		latency:          make(map[int]*histogram),
+		drops:            make(map[string]uint64),
+		serializerErrors: make(map[string]uint64),
+		errors:           make(map[int]uint64),
+	}
+	for command := SEND_ONE; command < builtinEnd; command++ {
+		mt.builtins[wsh.genCommandHash(command)] = command
+	}
+	return mt
+}
+
+// enable metrics, serve them by wsh.MetricsHandler()
+func (wsh *WebSocketHelper) EnableMetrics() *Metrics {
+	mt := NewMetrics(wsh, nil)
+	wsh.M.Lock()
+	wsh.metrics = mt
+	wsh.M.Unlock()
+	wsh.pool.metrics.Store(mt)
+	return mt
+}
+
+// the metrics handler, nil metrics are served empty before EnableMetrics:
+//
+//	http.Handle("/metrics", wsh.MetricsHandler())
+func (wsh *WebSocketHelper) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		wsh.metricsOf().WriteTo(w)
+	})
+}
+
+func (wsh *WebSocketHelper) metricsOf() *Metrics {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.metrics
+}
+
+func (cp *ConnectionPool) metricsOf() *Metrics {
+	mt, _ := cp.metrics.Load().(*Metrics)
+	return mt
+}
+
+func (mt *Metrics) commandOf(hash string) int {
+	if command := mt.wsh.GetCommand(hash); command != 0 {
+		return command
+	}
+	return mt.builtins[hash]
+}
+
+func (mt *Metrics) connect() {
+	if mt == nil {
+		return
+	}
+	atomic.AddUint64(&mt.connects, 1)
+}
+
+func (mt *Metrics) disconnect() {
+	if mt == nil {
+		return
+	}
+	atomic.AddUint64(&mt.disconnects, 1)
+}
+
+// a message of command with size bytes is read
+func (mt *Metrics) frameIn(command int, size int) {
+	if mt == nil {
+		return
+	}
+	atomic.AddUint64(&mt.bytesIn, uint64(size))
+	mt.m.Lock()
+	mt.framesIn[command]++
+	mt.m.Unlock()
+}
+
+// a message is written, data starts with the command hash
+func (mt *Metrics) frameOut(data []byte) {
+	if mt == nil || len(data) < 32 {
+		return
+	}
+	atomic.AddUint64(&mt.bytesOut, uint64(len(data)))
+	command := mt.commandOf(string(data[:32]))
+	mt.m.Lock()
+	mt.framesOut[command]++
+	mt.m.Unlock()
+}
+
+// bytes read without a header, like the body of a stream
+func (mt *Metrics) addBytesIn(n int64) {
+	if mt == nil {
+		return
+	}
+	atomic.AddUint64(&mt.bytesIn, uint64(n))
+}
+
+// bytes written without a header, like the body of a stream
+func (mt *Metrics) addBytesOut(n int64) {
+	if mt == nil {
+		return
+	}
+	atomic.AddUint64(&mt.bytesOut, uint64(n))
+}
+
+// a handler of command took d
+func (mt *Metrics) observe(command int, d time.Duration) {
+	if mt == nil {
+		return
+	}
+	mt.m.Lock()
+	defer mt.m.Unlock()
+	h, ok := mt.latency[command]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(mt.buckets)+1)}
+		mt.latency[command] = h
+	}
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(mt.buckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// a message is not sent for reason
+func (mt *Metrics) drop(reason string) {
+	if mt == nil {
+		return
+	}
+	mt.m.Lock()
+	mt.drops[reason]++
+	mt.m.Unlock()
+}
+
+// a serializer failed to marshal or unmarshal
+func (mt *Metrics) serializerError(m Marshaller) {
+	if mt == nil || m == nil {
+		return
+	}
+	mt.m.Lock()
+	mt.serializerErrors[m.TypeName()]++
+	mt.m.Unlock()
+}
+
+// an Error of code is replied
+func (mt *Metrics) replyError(code int) {
+	if mt == nil {
+		return
+	}
+	mt.m.Lock()
+	mt.errors[code]++
+	mt.m.Unlock()
+}
+
+func sortedInts(m map[int]uint64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedStrings(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// a copy of the counters in maps
+func (mt *Metrics) snapshot() *Metrics {
+	mt.m.Lock()
+	defer mt.m.Unlock()
+	snap := &Metrics{
+		framesIn:         copyInts(mt.framesIn),
+		framesOut:        copyInts(mt.framesOut),
+		latency:          make(map[int]*histogram, len(mt.latency)),
+		drops:            copyStrings(mt.drops),
+		serializerErrors: copyStrings(mt.serializerErrors),
+		errors:           copyInts(mt.errors),
+	}
+	for command, h := range mt.latency {
+		snap.latency[command] = &histogram{counts: append([]uint64(nil), h.counts...), sum: h.sum, count: h.count}
+	}
+	return snap
+}
+
+func copyInts(m map[int]uint64) map[int]uint64 {
+	rs := make(map[int]uint64, len(m))
+	for k, v := range m {
+		rs[k] = v
+	}
+	return rs
+}
+
+func copyStrings(m map[string]uint64) map[string]uint64 {
+	rs := make(map[string]uint64, len(m))
+	for k, v := range m {
+		rs[k] = v
+	}
+	return rs
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write metrics in the Prometheus text format
+func (mt *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if mt == nil {
+		return 0, nil
+	}
+	var n int64
+	var e error
+	printf := func(format string, args ...interface{}) {
+		if e != nil {
+			return
+		}
+		var written int
+		written, e = fmt.Fprintf(w, format, args...)
+		n += int64(written)
+	}
+	header := func(name string, typ string, help string) {
+		printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	connects, disconnects := atomic.LoadUint64(&mt.connects), atomic.LoadUint64(&mt.disconnects)
+	header("wshelper_connections_online", "gauge", "Connections online in the pool by user key.")
+	printf("wshelper_connections_online %d\n", mt.wsh.pool.Length())
+	header("wshelper_connections_open", "gauge", "Connections served by the dispatcher.")
+	printf("wshelper_connections_open %d\n", connects-disconnects)
+	header("wshelper_connects_total", "counter", "Connections accepted.")
+	printf("wshelper_connects_total %d\n", connects)
+	header("wshelper_disconnects_total", "counter", "Connections closed.")
+	printf("wshelper_disconnects_total %d\n", disconnects)
+	header("wshelper_bytes_in_total", "counter", "Bytes of messages read.")
+	printf("wshelper_bytes_in_total %d\n", atomic.LoadUint64(&mt.bytesIn))
+	header("wshelper_bytes_out_total", "counter", "Bytes of messages written.")
+	printf("wshelper_bytes_out_total %d\n", atomic.LoadUint64(&mt.bytesOut))
+
+	// written from a copy, so a slow scraper doesn't block counting frames
+	snap := mt.snapshot()
+	header("wshelper_frames_in_total", "counter", "Messages read by command.")
+	for _, command := range sortedInts(snap.framesIn) {
+		printf("wshelper_frames_in_total{command=\"%d\"} %d\n", command, snap.framesIn[command])
+	}
+	header("wshelper_frames_out_total", "counter", "Messages written by command, 0 for unknown.")
+	for _, command := range sortedInts(snap.framesOut) {
+		printf("wshelper_frames_out_total{command=\"%d\"} %d\n", command, snap.framesOut[command])
+	}
+
+	header("wshelper_handler_duration_seconds", "histogram", "Latency of command handlers.")
+	commands := make([]int, 0, len(snap.latency))
+	for command := range snap.latency {
+		commands = append(commands, command)
+	}
+	sort.Ints(commands)
+	for _, command := range commands {
+		h := snap.latency[command]
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(mt.buckets) {
+				le = mt.buckets[i]
+			}
+			printf("wshelper_handler_duration_seconds_bucket{command=\"%d\",le=\"%s\"} %d\n", command, formatFloat(le), cumulative)
+		}
+		printf("wshelper_handler_duration_seconds_sum{command=\"%d\"} %s\n", command, formatFloat(h.sum))
+		printf("wshelper_handler_duration_seconds_count{command=\"%d\"} %d\n", command, h.count)
+	}
+
+	header("wshelper_send_dropped_total", "counter", "Messages not sent by reason.")
+	for _, reason := range sortedStrings(snap.drops) {
+		printf("wshelper_send_dropped_total{reason=%q} %d\n", reason, snap.drops[reason])
+	}
+	header("wshelper_serializer_errors_total", "counter", "Marshal and unmarshal failures by serializer.")
+	for _, name := range sortedStrings(snap.serializerErrors) {
+		printf("wshelper_serializer_errors_total{serializer=%q} %d\n", name, snap.serializerErrors[name])
+	}
+	header("wshelper_errors_total", "counter", "Errors replied by code.")
+	for _, code := range sortedInts(snap.errors) {
+		printf("wshelper_errors_total{code=\"%d\"} %d\n", code, snap.errors[code])
+	}
+	return n, e
+}
@@ -0,0 +1,103 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	const ECHO = 1000
+	wsh := NewWsHelper(nil)
+	wsh.EnableMetrics()
+	wsh.EnablePubSub()
+	wsh.HandleFunc(ECHO, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return NewError(ERR_BAD_REQUEST, "bad json")
+		}
+		// tom is offline and there's no offline store
+		pool.SendOne(rawBytes, "tom")
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE})
+	})
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+
+	for _, body := range []string{`{"message":"hi"}`, `{"message":"hello"}`, `not json`} {
+		c.Send(ECHO, body)
+		c.Receive()
+	}
+	// PUBLISH is only sent by server, it has no handler
+	c.Send(SUBSCRIBE, `{"topic":"score"}`)
+	c.Reply()
+	wsh.Publish("score", _json.SendOne{Message: "1:0"})
+	c.Receive()
+	c.Conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	wsh.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, want := range []string{
+		"wshelper_connects_total 1\n",
+		"wshelper_disconnects_total 1\n",
+		"wshelper_connections_open 0\n",
+		`wshelper_frames_in_total{command="1000"} 3` + "\n",
+		`wshelper_frames_out_total{command="` + strconv.Itoa(REPLY) + `"} 4` + "\n",
+		`wshelper_frames_out_total{command="` + strconv.Itoa(PUBLISH) + `"} 1` + "\n",
+		`wshelper_frames_in_total{command="` + strconv.Itoa(SUBSCRIBE) + `"} 1` + "\n",
+		`wshelper_handler_duration_seconds_bucket{command="1000",le="+Inf"} 3` + "\n",
+		`wshelper_handler_duration_seconds_count{command="1000"} 3` + "\n",
+		`wshelper_send_dropped_total{reason="offline"} 2` + "\n",
+		`wshelper_serializer_errors_total{serializer="json"} 1` + "\n",
+		`wshelper_errors_total{code="` + strconv.Itoa(ERR_BAD_REQUEST) + `"} 1` + "\n",
+		"# TYPE wshelper_handler_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("want '%s' in metrics:\n%s", strings.TrimSpace(want), out)
+		}
+	}
+}
+
+// a writer blocking on the frames section until released
+type stalledWriter struct {
+	once    sync.Once
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "wshelper_frames_in_total") {
+		w.once.Do(func() {
+			close(w.blocked)
+			<-w.release
+		})
+	}
+	return len(p), nil
+}
+
+// a stalled scraper doesn't block counting frames
+func TestMetricsWriteToStalled(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	mt := wsh.EnableMetrics()
+	mt.frameIn(SEND_ONE, 10)
+	w := &stalledWriter{blocked: make(chan struct{}), release: make(chan struct{})}
+	defer close(w.release)
+	go mt.WriteTo(w)
+	<-w.blocked
+
+	counted := make(chan struct{})
+	go func() {
+		mt.frameIn(SEND_ONE, 10)
+		mt.observe(SEND_ONE, time.Millisecond)
+		close(counted)
+	}()
+	select {
+	case <-counted:
+	case <-time.After(time.Second):
+		t.Fatal("counting frames is blocked by a stalled scraper")
+	}
+}
@@ -19,4 +19,99 @@ type Reply struct {
 	ReplyValue interface{}
 }
 
+type FileInit struct {
+	FileId    string
+	Name      string
+	SubType   int
+	Size      int64
+	ChunkSize int
+	Checksum  string
+}
+
+type FileChunk struct {
+	FileId string
+	Seq    int
+	Data   []byte
+	Last   bool
+}
+
+type FileAck struct {
+	FileId    string
+	Seq       int
+	ChunkSize int
+	Done      bool
+}
+
+type FileDownload struct {
+	FileId string
+	From   int
+}
+
+type OfflineMessage struct {
+	Seq     int64
+	Data    []byte
+	SavedAt time.Time
+}
+
+type OfflineAck struct {
+	Seq int64
+}
+
+type Envelope struct {
+	MsgId  string
+	From   string
+	SendAt time.Time
+	Data   []byte
+}
+
+type MessageAck struct {
+	MsgId string
+	Read  bool
+}
+
+type Receipt struct {
+	MsgId string
+	To    string
+	State int
+	At    time.Time
+}
+
+type Message struct {
+	Id          int64
+	ChannelType int
+	ChannelId   string
+	From        string
+	To          string
+	SubType     int
+	Body        []byte
+	SendAt      time.Time
+}
+
+type HistoryQuery struct {
+	ChannelType int
+	ChannelId   string
+	Before      int64
+	After       int64
+	Limit       int
+	SubTypes    []int
+}
 
+type HistoryPage struct {
+	Messages []Message
+	HasMore  bool
+}
+
+type Error struct {
+	Code      int
+	Message   string
+	Retryable bool
+}
+
+type Subscription struct {
+	Topic string
+}
+
+type Publication struct {
+	Topic string
+	Data  []byte
+}
@@ -11,10 +11,107 @@ type SendOne struct {
 }
 
 type Reply struct {
-	ReplyType  int         `json:"reply_type"` // reply_type range in config/const/const.go
+	ReplyType  int         `json:"reply_type"` // reply_type range in reply_types.go
 	Desc       string      `json:"desc"`       // describe what this type of reply used to do
 	Tip        string      `json:"tip"`        // for REPLY_TIPS 正常提示
 	Debug      string      `json:"debug"`      // for REPLY_DEBUG 调试信息
-	Notice     string      `json:"notice"`     // for REPLY_NOTICE 系统公告
+	Notice     string      `json:"notice"`     // for REPLY_NOTIFY 系统公告
 	ReplyValue interface{} `json:"reply_value"`
 }
+
+type FileInit struct {
+	FileId    string `json:"file_id"` // a random id is assigned by server if empty, send it again to resume
+	Name      string `json:"name"`
+	SubType   int    `json:"sub_type"` // FILE, IMAGE, VIDEO ...
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"` // proposed by client, capped by server
+	Checksum  string `json:"checksum"`   // md5 of the whole file
+}
+
+type FileChunk struct {
+	FileId string `json:"file_id"`
+	Seq    int    `json:"seq"` // starts from 1
+	Data   []byte `json:"data"`
+	Last   bool   `json:"last"`
+}
+
+type FileAck struct {
+	FileId    string `json:"file_id"`
+	Seq       int    `json:"seq"` // the last acked chunk, resume from Seq+1
+	ChunkSize int    `json:"chunk_size"`
+	Done      bool   `json:"done"`
+}
+
+type FileDownload struct {
+	FileId string `json:"file_id"`
+	From   int    `json:"from"` // the first chunk wanted
+}
+
+type OfflineMessage struct {
+	Seq     int64     `json:"seq"`
+	Data    []byte    `json:"data"` // the raw message, command hash + body
+	SavedAt time.Time `json:"saved_at"`
+}
+
+type OfflineAck struct {
+	Seq int64 `json:"seq"` // messages whose seq <= Seq are acked
+}
+
+type Envelope struct {
+	MsgId  string    `json:"msg_id"` // assigned by server, drop duplicates by it
+	From   string    `json:"from"`
+	SendAt time.Time `json:"send_at"`
+	Data   []byte    `json:"data"` // the raw message, command hash + body
+}
+
+type MessageAck struct {
+	MsgId string `json:"msg_id"`
+	Read  bool   `json:"read"` // false for delivered
+}
+
+type Receipt struct {
+	MsgId string    `json:"msg_id"`
+	To    string    `json:"to"`
+	State int       `json:"state"` // RECEIPT_DELIVERED or RECEIPT_READ
+	At    time.Time `json:"at"`
+}
+
+type Message struct {
+	Id          int64     `json:"id"`
+	ChannelType int       `json:"channel_type"`
+	ChannelId   string    `json:"channel_id"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	SubType     int       `json:"sub_type"`
+	Body        []byte    `json:"body"`
+	SendAt      time.Time `json:"send_at"`
+}
+
+type HistoryQuery struct {
+	ChannelType int    `json:"channel_type"` // CHANNEL_ONE, CHANNEL_GROUP, CHANNEL_ROOM
+	ChannelId   string `json:"channel_id"`   // the peer key for CHANNEL_ONE
+	Before      int64  `json:"before"`       // message id
+	After       int64  `json:"after"`        // message id
+	Limit       int    `json:"limit"`
+	SubTypes    []int  `json:"sub_types"`
+}
+
+type HistoryPage struct {
+	Messages []Message `json:"messages"` // ascending by id
+	HasMore  bool      `json:"has_more"`
+}
+
+type Error struct {
+	Code      int    `json:"code"`      // ERR_* in errors.go
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"` // whether the same request may succeed later
+}
+
+type Subscription struct {
+	Topic string `json:"topic"` // a topic or a pattern of '*' and '#', like "score.*" or "score.#"
+}
+
+type Publication struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"` // the published object marshalled by the serializer of the connection
+}
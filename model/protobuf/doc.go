@@ -0,0 +1,5 @@
+// protocol messages of model.proto, generated by protoc-gen-go.
+// regenerate them after model.proto is changed, keep fields the same as model/json.
+package _protobuf
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative model.proto
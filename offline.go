@@ -0,0 +1,414 @@
+package wshelper
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"eyas/wshelper/dao"
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"github.com/fwhezfwhez/errorx"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// a message saved for an offline user
+type OfflineMessage struct {
+	// increasing per key, starts from 1
+	Seq int64
+	// the raw message sent by ConnectionPool.SendOne/SendMany
+	Data    []byte
+	SavedAt time.Time
+}
+
+// offline inbox, messages are listed in the order they are pushed.
+// messages older than the ttl of a store are regarded expired, they will not be listed and will be removed lazily
+type OfflineStore interface {
+	// save a message to a key's inbox
+	Push(key string, data []byte) error
+	// list unexpired messages of a key in order
+	List(key string) ([]OfflineMessage, error)
+	// remove messages whose seq <= 'seq'
+	Ack(key string, seq int64) error
+}
+
+// an in-memory realization of OfflineStore, messages are lost when the process exits
+type MemoryOfflineStore struct {
+	TTL time.Duration
+
+	m     *sync.Mutex
+	boxes map[string][]OfflineMessage
+	seqs  map[string]int64
+}
+
+// new a memory offline store, ttl<=0 means never expire
+func NewMemoryOfflineStore(ttl time.Duration) *MemoryOfflineStore {
+	return &MemoryOfflineStore{
+		TTL:   ttl,
+		m:     &sync.Mutex{},
+		boxes: make(map[string][]OfflineMessage),
+		seqs:  make(map[string]int64),
+	}
+}
+
+// push
+func (s *MemoryOfflineStore) Push(key string, data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seqs[key]++
+	s.boxes[key] = append(unexpired(s.boxes[key], s.TTL), OfflineMessage{
+		Seq:     s.seqs[key],
+		Data:    data,
+		SavedAt: time.Now(),
+	})
+	return nil
+}
+
+// list
+func (s *MemoryOfflineStore) List(key string) ([]OfflineMessage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	box := unexpired(s.boxes[key], s.TTL)
+	s.boxes[key] = box
+	rs := make([]OfflineMessage, len(box))
+	copy(rs, box)
+	return rs, nil
+}
+
+// ack
+func (s *MemoryOfflineStore) Ack(key string, seq int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	box := acked(s.boxes[key], seq)
+	if len(box) == 0 {
+		delete(s.boxes, key)
+		return nil
+	}
+	s.boxes[key] = box
+	return nil
+}
+
+// a file-backed realization of OfflineStore, each key's inbox is a file of json lines under Dir.
+// a push appends a line, expired and acked lines are dropped when the inbox is rewritten by Ack,
+// or by a push finding its oldest message expired for 2 TTLs.
+// seq of a key restarts from 1 when the process restarts with its inbox empty
+type FileOfflineStore struct {
+	Dir string
+	TTL time.Duration
+	// a message larger than it is rejected, it bounds the line buffer reading an inbox.
+	// EnableOffline sets it to Options.MaxPayloadBytes
+	MaxMessageBytes int
+
+	m    *sync.Mutex
+	seqs map[string]int64
+	// SavedAt of the first message in each inbox file, zero if empty
+	heads map[string]time.Time
+}
+
+// new a file offline store, ttl<=0 means never expire. MaxMessageBytes is DEFAULT_MAX_PAYLOAD
+func NewFileOfflineStore(dir string, ttl time.Duration) (*FileOfflineStore, error) {
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return nil, errorx.New(e)
+	}
+	return &FileOfflineStore{
+		Dir:             dir,
+		TTL:             ttl,
+		MaxMessageBytes: DEFAULT_MAX_PAYLOAD,
+		m:               &sync.Mutex{},
+		seqs:            make(map[string]int64),
+		heads:           make(map[string]time.Time),
+	}, nil
+}
+
+// keys are hashed so that any key is a safe file name
+func (s *FileOfflineStore) path(key string) string {
+	return filepath.Join(s.Dir, util.MD5(key)+".inbox")
+}
+
+// max bytes of a line, a message is base64 encoded in it
+func (s *FileOfflineStore) maxLine() int {
+	return base64.StdEncoding.EncodedLen(s.MaxMessageBytes) + 1*KB
+}
+
+func (s *FileOfflineStore) read(key string) ([]OfflineMessage, error) {
+	f, e := os.Open(s.path(key))
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, nil
+		}
+		return nil, errorx.New(e)
+	}
+	defer f.Close()
+
+	var box []OfflineMessage
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*KB), s.maxLine())
+	for scanner.Scan() {
+		var msg OfflineMessage
+		if e = json.Unmarshal(scanner.Bytes(), &msg); e != nil {
+			return nil, errorx.New(e)
+		}
+		box = append(box, msg)
+	}
+	if e = scanner.Err(); e != nil {
+		return nil, errorx.New(e)
+	}
+	s.remember(key, box)
+	return box, nil
+}
+
+// keep the last seq and the head of an inbox read or written
+func (s *FileOfflineStore) remember(key string, box []OfflineMessage) {
+	if len(box) == 0 {
+		delete(s.heads, key)
+		return
+	}
+	if last := box[len(box)-1].Seq; last > s.seqs[key] {
+		s.seqs[key] = last
+	}
+	s.heads[key] = box[0].SavedAt
+}
+
+func (s *FileOfflineStore) write(key string, box []OfflineMessage) error {
+	s.remember(key, box)
+	if len(box) == 0 {
+		if e := os.Remove(s.path(key)); e != nil && !os.IsNotExist(e) {
+			return errorx.New(e)
+		}
+		return nil
+	}
+	tmp := s.path(key) + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if e != nil {
+		return errorx.New(e)
+	}
+	w := bufio.NewWriter(f)
+	for _, msg := range box {
+		b, e := json.Marshal(msg)
+		if e != nil {
+			f.Close()
+			return errorx.New(e)
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if e = w.Flush(); e != nil {
+		f.Close()
+		return errorx.New(e)
+	}
+	if e = f.Close(); e != nil {
+		return errorx.New(e)
+	}
+	if e = os.Rename(tmp, s.path(key)); e != nil {
+		return errorx.New(e)
+	}
+	return nil
+}
+
+// push, the message is appended to the inbox file
+func (s *FileOfflineStore) Push(key string, data []byte) error {
+	if len(data) > s.MaxMessageBytes {
+		return errorx.NewFromStringf("offline message of %d bytes exceeds the max %d", len(data), s.MaxMessageBytes)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	// the inbox is read once after the process starts, to go on with its seq
+	if _, ok := s.seqs[key]; !ok {
+		if _, e := s.read(key); e != nil {
+			return errorx.Wrap(e)
+		}
+	}
+	if head, ok := s.heads[key]; ok && s.TTL > 0 && time.Since(head) > 2*s.TTL {
+		box, e := s.read(key)
+		if e != nil {
+			return errorx.Wrap(e)
+		}
+		if e = s.write(key, unexpired(box, s.TTL)); e != nil {
+			return errorx.Wrap(e)
+		}
+	}
+
+	msg := OfflineMessage{Seq: s.seqs[key] + 1, Data: data, SavedAt: time.Now()}
+	b, e := json.Marshal(msg)
+	if e != nil {
+		return errorx.New(e)
+	}
+	f, e := os.OpenFile(s.path(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return errorx.New(e)
+	}
+	if _, e = f.Write(append(b, '\n')); e != nil {
+		f.Close()
+		return errorx.New(e)
+	}
+	if e = f.Close(); e != nil {
+		return errorx.New(e)
+	}
+	s.seqs[key] = msg.Seq
+	if _, ok := s.heads[key]; !ok {
+		s.heads[key] = msg.SavedAt
+	}
+	return nil
+}
+
+// list
+func (s *FileOfflineStore) List(key string) ([]OfflineMessage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	box, e := s.read(key)
+	if e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	return unexpired(box, s.TTL), nil
+}
+
+// ack
+func (s *FileOfflineStore) Ack(key string, seq int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	box, e := s.read(key)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	return s.write(key, unexpired(acked(box, seq), s.TTL))
+}
+
+// a realization of OfflineStore on the inbox of a dao.Store
+type DaoOfflineStore struct {
+	Store dao.InboxStore
+	TTL   time.Duration
+}
+
+// push
+func (s DaoOfflineStore) Push(key string, data []byte) error {
+	return s.Store.PushInbox(key, data)
+}
+
+// list, expired messages are removed
+func (s DaoOfflineStore) List(key string) ([]OfflineMessage, error) {
+	var since time.Time
+	if s.TTL > 0 {
+		since = time.Now().Add(-s.TTL)
+		if e := s.Store.ExpireInbox(key, since); e != nil {
+			return nil, errorx.Wrap(e)
+		}
+	}
+	box, e := s.Store.ListInbox(key, since)
+	if e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	var rs = make([]OfflineMessage, 0, len(box))
+	for _, msg := range box {
+		rs = append(rs, OfflineMessage{Seq: msg.Seq, Data: msg.Data, SavedAt: msg.SavedAt})
+	}
+	return rs, nil
+}
+
+// ack
+func (s DaoOfflineStore) Ack(key string, seq int64) error {
+	return s.Store.AckInbox(key, seq)
+}
+
+// drop expired messages, box is in the order of SavedAt
+func unexpired(box []OfflineMessage, ttl time.Duration) []OfflineMessage {
+	if ttl <= 0 {
+		return box
+	}
+	deadline := time.Now().Add(-ttl)
+	for i, msg := range box {
+		if msg.SavedAt.After(deadline) {
+			return box[i:]
+		}
+	}
+	return nil
+}
+
+// drop messages whose seq <= 'seq'
+func acked(box []OfflineMessage, seq int64) []OfflineMessage {
+	for i, msg := range box {
+		if msg.Seq > seq {
+			return box[i:]
+		}
+	}
+	return nil
+}
+
+// enable the offline inbox. messages to offline users will be saved to store,
+// delivered as OFFLINE_MESSAGE when the user is Online, and removed when the client replies OFFLINE_ACK.
+// if store is nil, a memory store expiring in Options.OfflineTTL will be used
+func (wsh *WebSocketHelper) EnableOffline(store OfflineStore) OfflineStore {
+	if store == nil {
+		store = NewMemoryOfflineStore(wsh.Options().OfflineTTL)
+	}
+	if fs, ok := store.(*FileOfflineStore); ok {
+		fs.MaxMessageBytes = wsh.Options().MaxPayloadBytes
+	}
+	wsh.pool.SetOfflineStore(store)
+	wsh.HandleFunc(OFFLINE_ACK, wsh.handleOfflineAck)
+	return store
+}
+
+// deliver the offline messages of a key in order, they are kept until acked.
+// messages are saved as packed by wsh.Serializer, and re-encoded for the serializer of the connection.
+// a message failing to re-encode is logged and skipped, an ack of a later message removes it.
+// delivery stops at the first failed write, the rest are delivered on the next Online
+func (wsh *WebSocketHelper) DeliverOffline(key string) error {
+	wsh.pool.M.RLock()
+	store := wsh.pool.offline
+	wsh.pool.M.RUnlock()
+	if store == nil {
+		return nil
+	}
+	conn, ok := wsh.pool.Get(key)
+	if !ok {
+		return nil
+	}
+
+	box, e := store.List(key)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	wsh.M.RLock()
+	from := wsh.Serializer
+	wsh.M.RUnlock()
+	to := wsh.SerializerOf(conn)
+	for _, msg := range box {
+		data, e := wsh.Transcode(msg.Data, from, to)
+		var buf []byte
+		if e == nil {
+			buf, e = wsh.PackFor(conn, OFFLINE_MESSAGE, _json.OfflineMessage{
+				Seq:     msg.Seq,
+				Data:    data,
+				SavedAt: msg.SavedAt,
+			})
+		}
+		if e != nil {
+			wsh.Logger().Warn("skip offline message", "key", key, "seq", msg.Seq, "error", e)
+			continue
+		}
+		if e = wsh.pool.Write(conn, buf); e != nil {
+			return errorx.Wrap(e)
+		}
+	}
+	return nil
+}
+
+func (wsh *WebSocketHelper) handleOfflineAck(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.OfflineAck
+	if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad offline ack: %s", e.Error())
+	}
+	key, ok := pool.KeyOf(ConnOf(cache))
+	if !ok {
+		return NewError(ERR_UNAUTHORIZED, "offline ack from a connection not online")
+	}
+	pool.M.RLock()
+	store := pool.offline
+	pool.M.RUnlock()
+	if store == nil {
+		return nil
+	}
+	return store.Ack(key, in.Seq)
+}
@@ -0,0 +1,133 @@
+package wshelper
+
+import (
+	"eyas/wshelper/dao"
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOfflineStore(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+	fileStore, e := NewFileOfflineStore(dir, time.Hour)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	for _, store := range []OfflineStore{NewMemoryOfflineStore(time.Hour), fileStore, DaoOfflineStore{Store: dao.NewMemoryStore(), TTL: time.Hour}} {
+		pool := NewConnectionPool()
+		pool.SetOfflineStore(store)
+		for _, msg := range []string{"a", "b", "c"} {
+			if e := pool.SendOne([]byte(msg), "tom"); e != nil {
+				t.Fatal(e.Error())
+			}
+		}
+
+		box, e := store.List("tom")
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		util.Assertf(len(box) == 3 && string(box[0].Data) == "a" && box[2].Seq == 3, t, "bad inbox %+v", box)
+
+		if e = store.Ack("tom", 2); e != nil {
+			t.Fatal(e.Error())
+		}
+		box, _ = store.List("tom")
+		util.Assertf(len(box) == 1 && string(box[0].Data) == "c", t, "bad inbox after ack %+v", box)
+
+		store.Push("tom", []byte("d"))
+		box, _ = store.List("tom")
+		util.Assertf(len(box) == 2 && box[1].Seq == 4, t, "bad seq after ack %+v", box)
+	}
+}
+
+func TestOfflineStoreTTL(t *testing.T) {
+	store := NewMemoryOfflineStore(time.Millisecond)
+	store.Push("tom", []byte("a"))
+	time.Sleep(5 * time.Millisecond)
+	box, _ := store.List("tom")
+	util.Assertf(len(box) == 0, t, "want expired but got %+v", box)
+}
+
+func TestDeliverOffline(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	var m Msgpacker
+	wsh.RegisterMarshaller(m)
+	store := wsh.EnableOffline(NewMemoryOfflineStore(time.Hour))
+	handleTestLogin(wsh, nil)
+	ts := newTestServer(t, wsh)
+
+	// saved as packed by json, the second can not be re-encoded for msgpack
+	for _, msg := range []string{"a", "", "c"} {
+		frame, _ := wsh.Pack(SEND_ONE, _json.SendOne{From: "bob", Message: msg})
+		if msg == "" {
+			frame = append([]byte(wsh.genCommandHash(SEND_ONE)), "not json"...)
+		}
+		store.Push("tom", frame)
+	}
+
+	send := func(c *testClient, command int, obj interface{}) {
+		body, _ := m.Marshal(obj)
+		c.SendFrame(append([]byte(wsh.genCommandHash(command)), body...))
+	}
+	receive := func(c *testClient, dest interface{}) string {
+		buf := c.Receive()
+		if e := m.Unmarshal(buf[32:], dest); e != nil {
+			t.Fatal(e.Error())
+		}
+		return string(buf[:32])
+	}
+	c := dialTest(t, wsh, ts, "?"+SERIALIZER_QUERY+"=msgpack")
+	send(c, TEST_LOGIN, _json.SendOne{From: "tom"})
+	var got []string
+	var seqs []int64
+	for i := 0; i < 2; i++ {
+		var offline _json.OfflineMessage
+		util.Assertf(receive(c, &offline) == wsh.genCommandHash(OFFLINE_MESSAGE), t, "want an OFFLINE_MESSAGE")
+		var in _json.SendOne
+		if e := m.Unmarshal(offline.Data[32:], &in); e != nil {
+			t.Fatal(e.Error())
+		}
+		got = append(got, in.Message)
+		seqs = append(seqs, offline.Seq)
+	}
+	util.Assertf(strings.Join(got, ",") == "a,c" && seqs[0] == 1 && seqs[1] == 3, t, "want a and c in order but got %v %v", got, seqs)
+	var reply _json.Reply
+	util.Assertf(receive(c, &reply) == wsh.genCommandHash(REPLY), t, "want the login reply")
+
+	// acking the last removes the skipped one too
+	send(c, OFFLINE_ACK, _json.OfflineAck{Seq: 3})
+	time.Sleep(50 * time.Millisecond)
+	box, _ := store.List("tom")
+	util.Assertf(len(box) == 0, t, "want the inbox acked but got %d", len(box))
+}
+
+func TestFileOfflineStore_Append(t *testing.T) {
+	store, e := NewFileOfflineStore(t.TempDir(), time.Hour)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	store.MaxMessageBytes = 8
+	util.Assertf(store.Push("tom", []byte("123456789")) != nil, t, "want a message over MaxMessageBytes rejected")
+	for _, msg := range []string{"a", "b"} {
+		if e = store.Push("tom", []byte(msg)); e != nil {
+			t.Fatal(e.Error())
+		}
+	}
+	b, _ := ioutil.ReadFile(store.path("tom"))
+	util.Assertf(strings.Count(string(b), "\n") == 2, t, "want 2 lines appended but got:\n%s", b)
+
+	// a new store goes on with the seq of the file
+	again, _ := NewFileOfflineStore(store.Dir, time.Hour)
+	again.Push("tom", []byte("c"))
+	box, _ := again.List("tom")
+	util.Assertf(len(box) == 3 && box[2].Seq == 3 && string(box[2].Data) == "c", t, "bad inbox %+v", box)
+}
@@ -0,0 +1,253 @@
+package wshelper
+
+import (
+	"github.com/fwhezfwhez/errorx"
+	"github.com/spf13/viper"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// the prefix of environment variables overriding config keys, like WSHELPER_MAXPAYLOADBYTES
+const ENV_PREFIX = "WSHELPER"
+
+// Options of a WebSocketHelper, start from DefaultOptions():
+//
+//	opts := wshelper.DefaultOptions()
+//	opts.HeartbeatTimeout = time.Minute
+//	wsh := wshelper.NewWsHelper(nil, wshelper.WithOptions(opts))
+type Options struct {
+	// the default serializer of connections, used when NewWsHelper(nil)
+	Serializer Marshaller
+	// logs nothing by default
+	Logger Logger
+	// traces nothing by default
+	Tracer Tracer
+
+	// the pool is set full when connections online exceed it
+	MaxOnlineConn int
+	// shards of the connection pool, more shards mean less contention between users
+	PoolShards int
+	// the max body size of a message, commands can override it by HandleFuncLimit
+	MaxPayloadBytes int
+	// the min body size to compress on connections negotiating '?compress='
+	CompressThreshold int
+
+	// a connection is closed when it lives longer than Deadline
+	Deadline time.Duration
+	// a connection sending nothing, not even a HEARTBEAT, in HeartbeatTimeout is closed, 0 means never
+	HeartbeatTimeout time.Duration
+	// frames of a connection handled at the same time, commands marked by SetOrdered keep their order.
+	// the reader waits when it's reached. 0 or 1 means one by one.
+	// handlers get a copy of the connection cache if it's more than 1, values set in it are not seen by other frames,
+	// share values by SharedOf(cache) instead
+	Concurrency int
+
+	// where EnableFileTransfer(nil) saves files, and the chunk size
+	FileStoragePath string
+	FileChunkSize   int
+	// uploads larger than MaxFileSize are rejected, uploads idle longer than FileUploadTTL are dropped
+	MaxFileSize   int64
+	FileUploadTTL time.Duration
+	// how long EnableOffline(nil) keeps messages, 0 means forever
+	OfflineTTL time.Duration
+	// EnableDelivery resends a message not acked in RetransmitInterval, for MaxRetransmit times
+	RetransmitInterval time.Duration
+	MaxRetransmit      int
+	// limits of EnableRateLimit, messages per second of a user and connections per second of an ip, 0 means no limit
+	UserRate  float64
+	UserBurst int
+	IPRate    float64
+	IPBurst   int
+	// the dao.Store of OpenStore, tables are created if DaoMigrate
+	DaoDriver  string
+	DaoDSN     string
+	DaoMigrate bool
+}
+
+// the default options
+func DefaultOptions() Options {
+	return Options{
+		Logger:             NopLogger{},
+		Tracer:             NopTracer{},
+		MaxOnlineConn:      50000,
+		PoolShards:         DEFAULT_POOL_SHARDS,
+		MaxPayloadBytes:    DEFAULT_MAX_PAYLOAD,
+		CompressThreshold:  1 * KB,
+		Deadline:           10 * time.Hour,
+		FileStoragePath:    "files",
+		FileChunkSize:      DEFAULT_CHUNK_SIZE,
+		MaxFileSize:        DEFAULT_MAX_FILE_SIZE,
+		FileUploadTTL:      DEFAULT_UPLOAD_TTL,
+		OfflineTTL:         7 * 24 * time.Hour,
+		RetransmitInterval: 10 * time.Second,
+		MaxRetransmit:      5,
+		DaoDriver:          "memory",
+	}
+}
+
+// modify options of NewWsHelper
+type Option func(o *Options)
+
+// replace all options
+func WithOptions(opts Options) Option {
+	return func(o *Options) {
+		*o = opts
+	}
+}
+
+// set the logger
+func WithLogger(l Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// set the tracer
+func WithTracer(t Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// set the max online connections
+func WithMaxOnlineConn(max int) Option {
+	return func(o *Options) {
+		o.MaxOnlineConn = max
+	}
+}
+
+// set the max body size of a message
+func WithMaxPayload(max int) Option {
+	return func(o *Options) {
+		o.MaxPayloadBytes = max
+	}
+}
+
+// set the max lifetime of a connection
+func WithDeadline(deadline time.Duration) Option {
+	return func(o *Options) {
+		o.Deadline = deadline
+	}
+}
+
+// handle frames of a connection concurrently
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+// close connections sending nothing in timeout
+func WithHeartbeat(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.HeartbeatTimeout = timeout
+	}
+}
+
+// load options from a yaml file like config.yaml, on the defaults. empty path loads nothing from files.
+// environment variables of ENV_PREFIX override the file, like WSHELPER_MAXPAYLOADBYTES=1048576.
+// durations are in seconds. if 'logFileEnabled', logs go to 'logFilePath' at 'logLevel'
+func LoadOptions(path string) (Options, error) {
+	v := viper.New()
+	v.SetEnvPrefix(ENV_PREFIX)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if path != "" {
+		v.SetConfigFile(path)
+		if e := v.ReadInConfig(); e != nil {
+			return Options{}, errorx.NewFromStringf("read config '%s': %s", path, e.Error())
+		}
+	}
+	o, e := optionsFrom(v, DefaultOptions())
+	if e != nil {
+		return o, e
+	}
+	l, e := loggerFrom(v)
+	if e != nil {
+		return o, e
+	}
+	if l != nil {
+		o.Logger = l
+	}
+	return o, nil
+}
+
+// read options set in v on o
+func optionsFrom(v *viper.Viper, o Options) (Options, error) {
+	ints := map[string]*int{
+		"maxOnlineConnPerPool": &o.MaxOnlineConn,
+		"poolShards":           &o.PoolShards,
+		"maxPayloadBytes":      &o.MaxPayloadBytes,
+		"compressThreshold":    &o.CompressThreshold,
+		"fileChunkSize":        &o.FileChunkSize,
+		"maxRetransmit":        &o.MaxRetransmit,
+		"userBurst":            &o.UserBurst,
+		"ipBurst":              &o.IPBurst,
+		"concurrency":          &o.Concurrency,
+	}
+	for key, p := range ints {
+		if v.IsSet(key) {
+			*p = v.GetInt(key)
+		}
+	}
+	seconds := map[string]*time.Duration{
+		"deadline":           &o.Deadline,
+		"heartbeatTimeout":   &o.HeartbeatTimeout,
+		"offlineTTL":         &o.OfflineTTL,
+		"retransmitInterval": &o.RetransmitInterval,
+		"fileUploadTTL":      &o.FileUploadTTL,
+	}
+	for key, p := range seconds {
+		if v.IsSet(key) {
+			*p = time.Duration(v.GetFloat64(key) * float64(time.Second))
+		}
+	}
+	floats := map[string]*float64{
+		"userRate": &o.UserRate,
+		"ipRate":   &o.IPRate,
+	}
+	for key, p := range floats {
+		if v.IsSet(key) {
+			*p = v.GetFloat64(key)
+		}
+	}
+	strs := map[string]*string{
+		"fileStoragePath": &o.FileStoragePath,
+		"daoDriver":       &o.DaoDriver,
+		"daoDSN":          &o.DaoDSN,
+	}
+	for key, p := range strs {
+		if v.IsSet(key) {
+			*p = v.GetString(key)
+		}
+	}
+	if v.IsSet("maxFileSize") {
+		o.MaxFileSize = v.GetInt64("maxFileSize")
+	}
+	if v.IsSet("daoMigrate") {
+		o.DaoMigrate = v.GetBool("daoMigrate")
+	}
+	return o, nil
+}
+
+// the logger of 'logFilePath' at 'logLevel' if 'logFileEnabled', or nil
+func loggerFrom(v *viper.Viper) (Logger, error) {
+	if !v.GetBool("logFileEnabled") || v.GetString("logFilePath") == "" {
+		return nil, nil
+	}
+	file, e := os.OpenFile(v.GetString("logFilePath"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return nil, errorx.NewFromStringf("open log file '%s': %s", v.GetString("logFilePath"), e.Error())
+	}
+	// kept open as long as the process
+	return NewStdLogger(log.New(file, "", log.LstdFlags|log.Llongfile), ParseLevel(v.GetString("logLevel"))), nil
+}
+
+// get the options
+func (wsh *WebSocketHelper) Options() Options {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.options
+}
@@ -0,0 +1,71 @@
+package wshelper
+
+import (
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOptions(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte("maxPayloadBytes: 1024\nofflineTTL: 60\nuserRate: 2.5\ndaoDriver: mysql\n"), 0644)
+	os.Setenv("WSHELPER_MAXPAYLOADBYTES", "2048")
+	defer os.Unsetenv("WSHELPER_MAXPAYLOADBYTES")
+
+	opts, e := LoadOptions(path)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if opts.MaxPayloadBytes != 2048 || opts.OfflineTTL != time.Minute || opts.UserRate != 2.5 || opts.DaoDriver != "mysql" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	// not set keys keep the defaults
+	if opts.MaxOnlineConn != DefaultOptions().MaxOnlineConn || opts.Deadline != DefaultOptions().Deadline {
+		t.Fatalf("want defaults kept but got %+v", opts)
+	}
+
+	wsh := NewWsHelper(nil, WithOptions(opts), WithMaxPayload(4096))
+	if wsh.PayloadLimitOf(SEND_ONE) != 4096 {
+		t.Fatalf("want max payload 4096 but got %d", wsh.PayloadLimitOf(SEND_ONE))
+	}
+	if wsh.Serializer.TypeName() != "json" {
+		t.Fatalf("want the json serializer but got %s", wsh.Serializer.TypeName())
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	wsh := NewWsHelper(nil, WithHeartbeat(200*time.Millisecond))
+	ts := httptest.NewServer(websocket.Handler(wsh.Dispatcher(func(e error) { t.Error(e.Error()) })))
+	defer ts.Close()
+	conn, e := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		websocket.Message.Send(conn, []byte(wsh.genCommandHash(HEARTBEAT)))
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if e = websocket.Message.Receive(conn, &buf); e != nil {
+			t.Fatalf("heartbeat %d: %s", i, e.Error())
+		}
+	}
+	// silent too long
+	var buf []byte
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if e = websocket.Message.Receive(conn, &buf); e == nil || isTimeout(e) {
+		t.Fatalf("want the connection closed by the server but got %v", e)
+	}
+}
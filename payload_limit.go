@@ -0,0 +1,64 @@
+package wshelper
+
+// the default max body size of a message, when 'maxPayloadBytes' is not set in config
+const DEFAULT_MAX_PAYLOAD = 4 * MB
+
+// set the max body size of messages whose command has no limit of its own
+func (wsh *WebSocketHelper) SetMaxPayload(max int) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.options.MaxPayloadBytes = max
+}
+
+// set the max body size of a command, overriding the global one, max<=0 removes the override
+func (wsh *WebSocketHelper) SetPayloadLimit(command int, max int) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	if max <= 0 {
+		delete(wsh.payloadLimits, command)
+		return
+	}
+	wsh.payloadLimits[command] = max
+}
+
+// handle a command whose message body is limited to max bytes, like a file chunk larger than the global limit
+func (wsh *WebSocketHelper) HandleFuncLimit(command int, max int, f func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error) {
+	wsh.HandleFunc(command, f)
+	wsh.SetPayloadLimit(command, max)
+}
+
+// get the max body size of a command
+func (wsh *WebSocketHelper) PayloadLimitOf(command int) int {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	if max, ok := wsh.payloadLimits[command]; ok {
+		return max
+	}
+	return wsh.options.MaxPayloadBytes
+}
+
+// the max size of a frame the connection reads, the largest limit of all commands plus the header
+func (wsh *WebSocketHelper) framePayloadLimit() int {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	max := wsh.options.MaxPayloadBytes
+	for command, limit := range wsh.payloadLimits {
+		// streams are read by their declared size
+		if _, ok := wsh.streamHandlers[command]; ok {
+			continue
+		}
+		if limit > max {
+			max = limit
+		}
+	}
+	// command hash, compression flag and trace header
+	return max + 33 + TRACE_HEADER_SIZE
+}
+
+// the error of a message too large, command is 0 when the frame is dropped before its header is read
+func errPayloadTooLarge(command int, size int64, limit int) *Error {
+	if command == 0 {
+		return Errorf(ERR_PAYLOAD_TOO_LARGE, "message bigger than the max '%d'", limit)
+	}
+	return Errorf(ERR_PAYLOAD_TOO_LARGE, "message of command '%d' size '%d' bigger than the max '%d'", command, size, limit)
+}
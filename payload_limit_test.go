@@ -0,0 +1,61 @@
+package wshelper
+
+import (
+	"bytes"
+	"eyas/wshelper/model/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadLimit(t *testing.T) {
+	const SMALL, LARGE = 1000, 1001
+	wsh := NewWsHelper(nil)
+	wsh.SetMaxPayload(16)
+	echo := func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		return wsh.Reply(ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE, Tip: "ok"})
+	}
+	wsh.HandleFunc(SMALL, echo)
+	wsh.HandleFuncLimit(LARGE, 64, echo)
+	ts := httptest.NewServer(websocket.Handler(wsh.Dispatcher(func(e error) { t.Error(e.Error()) })))
+	defer ts.Close()
+
+	conn, e := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn.Close()
+
+	for _, c := range []struct {
+		command int
+		size    int
+		want    int
+	}{
+		{SMALL, 8, REPLY_MESSAGE},
+		{SMALL, 32, REPLY_ERROR},
+		{LARGE, 32, REPLY_MESSAGE},
+		{LARGE, 65, REPLY_ERROR},
+		// dropped by the codec before the header is read
+		{LARGE, 200, REPLY_ERROR},
+		{LARGE, 64, REPLY_MESSAGE},
+	} {
+		data := append([]byte(wsh.genCommandHash(c.command)), bytes.Repeat([]byte("a"), c.size)...)
+		if e = websocket.Message.Send(conn, data); e != nil {
+			t.Fatal(e.Error())
+		}
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if e = websocket.Message.Receive(conn, &buf); e != nil {
+			t.Fatal(e.Error())
+		}
+		var reply _json.Reply
+		if e = wsh.CoreOf(buf, &reply); e != nil {
+			t.Fatal(e.Error())
+		}
+		if reply.ReplyType != c.want {
+			t.Fatalf("command '%d' size '%d': want reply type '%d' but got '%d' %s", c.command, c.size, c.want, reply.ReplyType, reply.Tip)
+		}
+	}
+}
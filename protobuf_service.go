@@ -1 +1,199 @@
 package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/model/protobuf"
+	"github.com/fwhezfwhez/errorx"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// an realization of Marshaller by protobuf.
+// proto.Message values are marshalled directly, other values are converted to their registered proto messages,
+// so handlers can work on model/json structs whatever the serializer is.
+// the model/json structs are registered to model/protobuf by default
+type Protobufer struct {
+	m *sync.RWMutex
+	// plain type -> proto message type
+	types map[reflect.Type]reflect.Type
+}
+
+// new a protobufer with model/json registered
+func NewProtobufer() *Protobufer {
+	p := &Protobufer{
+		m:     &sync.RWMutex{},
+		types: make(map[reflect.Type]reflect.Type),
+	}
+	p.Register(_json.SendOne{}, &_protobuf.SendOne{})
+	p.Register(_json.Reply{}, &_protobuf.Reply{})
+	p.Register(_json.FileInit{}, &_protobuf.FileInit{})
+	p.Register(_json.FileChunk{}, &_protobuf.FileChunk{})
+	p.Register(_json.FileAck{}, &_protobuf.FileAck{})
+	p.Register(_json.FileDownload{}, &_protobuf.FileDownload{})
+	p.Register(_json.OfflineMessage{}, &_protobuf.OfflineMessage{})
+	p.Register(_json.OfflineAck{}, &_protobuf.OfflineAck{})
+	p.Register(_json.Envelope{}, &_protobuf.Envelope{})
+	p.Register(_json.MessageAck{}, &_protobuf.MessageAck{})
+	p.Register(_json.Receipt{}, &_protobuf.Receipt{})
+	p.Register(_json.Message{}, &_protobuf.Message{})
+	p.Register(_json.HistoryQuery{}, &_protobuf.HistoryQuery{})
+	p.Register(_json.HistoryPage{}, &_protobuf.HistoryPage{})
+	p.Register(_json.Error{}, &_protobuf.Error{})
+	p.Register(_json.Subscription{}, &_protobuf.Subscription{})
+	p.Register(_json.Publication{}, &_protobuf.Publication{})
+	return p
+}
+
+// register the proto message of a plain struct, fields are matched by name.
+// ints are converted to the proto int types, time.Time to unix nano int64, interface{} to bytes marshalled by the protobufer.
+// the concrete type of an interface{} is not on the wire, it's unmarshalled as the bytes, like Reply.ReplyValue,
+// which is unmarshalled again into the payload of its reply type by the receiver
+func (p *Protobufer) Register(plain interface{}, pb proto.Message) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.types[indirectType(reflect.TypeOf(plain))] = indirectType(reflect.TypeOf(pb))
+}
+
+func (p *Protobufer) protoTypeOf(t reflect.Type) (reflect.Type, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	pt, ok := p.types[indirectType(t)]
+	return pt, ok
+}
+
+// marshal
+func (p *Protobufer) Marshal(obj interface{}) ([]byte, error) {
+	if msg, ok := obj.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+	pt, ok := p.protoTypeOf(reflect.TypeOf(obj))
+	if !ok {
+		return nil, errorx.NewFromStringf("'%T' is neither a proto.Message nor registered", obj)
+	}
+	pb := reflect.New(pt)
+	if e := p.convert(pb.Elem(), reflect.Indirect(reflect.ValueOf(obj))); e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	return proto.Marshal(pb.Interface().(proto.Message))
+}
+
+// unmarshal, dest should be a pointer
+func (p *Protobufer) Unmarshal(src []byte, dest interface{}) error {
+	if msg, ok := dest.(proto.Message); ok {
+		return proto.Unmarshal(src, msg)
+	}
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errorx.NewFromStringf("dest should be a non-nil pointer but got '%T'", dest)
+	}
+	pt, ok := p.protoTypeOf(rv.Type())
+	if !ok {
+		return errorx.NewFromStringf("'%T' is neither a proto.Message nor registered", dest)
+	}
+	pb := reflect.New(pt)
+	if e := proto.Unmarshal(src, pb.Interface().(proto.Message)); e != nil {
+		return errorx.New(e)
+	}
+	return p.convert(rv.Elem(), pb.Elem())
+}
+
+// type name
+func (p *Protobufer) TypeName() string {
+	return "protobuf"
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// copy src into dst between a plain struct and a proto message, in both directions
+func (p *Protobufer) convert(dst reflect.Value, src reflect.Value) error {
+	if src.Kind() == reflect.Ptr {
+		if src.IsNil() {
+			return nil
+		}
+		src = src.Elem()
+	}
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		dst = dst.Elem()
+	}
+
+	switch {
+	case src.Type() == timeType && dst.Kind() == reflect.Int64:
+		if t := src.Interface().(time.Time); !t.IsZero() {
+			dst.SetInt(t.UnixNano())
+		}
+		return nil
+	case dst.Type() == timeType && src.Kind() == reflect.Int64:
+		if src.Int() != 0 {
+			dst.Set(reflect.ValueOf(time.Unix(0, src.Int()).UTC()))
+		}
+		return nil
+	case src.Kind() == reflect.Interface:
+		// interface{} -> bytes
+		if src.IsNil() {
+			return nil
+		}
+		if b, ok := src.Interface().([]byte); ok {
+			dst.SetBytes(b)
+			return nil
+		}
+		b, e := p.Marshal(src.Interface())
+		if e != nil {
+			return errorx.Wrap(e)
+		}
+		dst.SetBytes(b)
+		return nil
+	case dst.Kind() == reflect.Interface:
+		// bytes -> interface{}, the concrete type is unknown, the bytes are kept for the receiver to unmarshal
+		if src.Len() > 0 {
+			dst.Set(src)
+		}
+		return nil
+	case src.Kind() == reflect.Struct && dst.Kind() == reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			field := dst.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			sf := src.FieldByName(field.Name)
+			if !sf.IsValid() {
+				continue
+			}
+			if e := p.convert(dst.Field(i), sf); e != nil {
+				return errorx.Wrap(e)
+			}
+		}
+		return nil
+	case src.Kind() == reflect.Slice && dst.Kind() == reflect.Slice:
+		if src.IsNil() {
+			return nil
+		}
+		if src.Type() == dst.Type() {
+			dst.Set(src)
+			return nil
+		}
+		rs := reflect.MakeSlice(dst.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			if e := p.convert(rs.Index(i), src.Index(i)); e != nil {
+				return errorx.Wrap(e)
+			}
+		}
+		dst.Set(rs)
+		return nil
+	case src.Type().ConvertibleTo(dst.Type()):
+		dst.Set(src.Convert(dst.Type()))
+		return nil
+	}
+	return errorx.NewFromStringf("can not convert '%s' to '%s'", src.Type(), dst.Type())
+}
@@ -0,0 +1,106 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/model/protobuf"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// every field of a json model has its counterpart in the protobuf model, and values survive a round trip
+func TestProtobufer_RoundTrip(t *testing.T) {
+	p := NewProtobufer()
+	for _, sample := range jsonSamples() {
+		pt, ok := p.protoTypeOf(reflect.TypeOf(sample))
+		if !ok {
+			t.Fatalf("'%T' not registered", sample)
+		}
+		jt := reflect.TypeOf(sample).Elem()
+		for i := 0; i < jt.NumField(); i++ {
+			if _, ok := pt.FieldByName(jt.Field(i).Name); !ok {
+				t.Fatalf("'%s.%s' missing in protobuf model", jt.Name(), jt.Field(i).Name)
+			}
+		}
+		for i := 0; i < pt.NumField(); i++ {
+			if pt.Field(i).PkgPath != "" {
+				continue
+			}
+			if _, ok := jt.FieldByName(pt.Field(i).Name); !ok {
+				t.Fatalf("'%s.%s' missing in json model", pt.Name(), pt.Field(i).Name)
+			}
+		}
+
+		b, e := p.Marshal(sample)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		got := reflect.New(jt).Interface()
+		if e = p.Unmarshal(b, got); e != nil {
+			t.Fatal(e.Error())
+		}
+		if !reflect.DeepEqual(sample, got) {
+			t.Fatalf("want %+v but got %+v", sample, got)
+		}
+	}
+}
+
+func TestProtobufer_InterfaceField(t *testing.T) {
+	p := NewProtobufer()
+	b, e := p.Marshal(_json.Reply{ReplyType: REPLY_ERROR, ReplyValue: _json.Error{Code: ERR_NOT_FOUND, Message: "no such user"}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var reply _json.Reply
+	if e = p.Unmarshal(b, &reply); e != nil {
+		t.Fatal(e.Error())
+	}
+	// decoded as the bytes marshalled, not the value
+	raw, ok := reply.ReplyValue.([]byte)
+	if !ok {
+		t.Fatalf("want bytes but got '%T'", reply.ReplyValue)
+	}
+	var rs _json.Error
+	if e = p.Unmarshal(raw, &rs); e != nil || rs.Code != ERR_NOT_FOUND || rs.Message != "no such user" {
+		t.Fatalf("bad reply value %+v %v", rs, e)
+	}
+}
+
+func TestProtobufer_ProtoMessage(t *testing.T) {
+	wsh := NewWsHelper(NewProtobufer())
+	buf, e := wsh.Pack(SEND_ONE, &_protobuf.SendOne{From: "tom", To: "bob", Message: "hi"})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var in _json.SendOne
+	if e = wsh.CoreOf(buf, &in); e != nil {
+		t.Fatal(e.Error())
+	}
+	if in.From != "tom" || in.To != "bob" || in.Message != "hi" {
+		t.Fatalf("bad message %+v", in)
+	}
+}
+
+// one of each model/json struct, all fields set
+func jsonSamples() []interface{} {
+	now := time.Date(2019, 1, 4, 12, 0, 0, 123, time.UTC)
+	return []interface{}{
+		&_json.SendOne{From: "tom", To: "bob", SendAt: now, Message: "hi", Extra: []byte("extra")},
+		&_json.Reply{ReplyType: REPLY_TIPS, Desc: "tips", Tip: "bob is offline", Debug: "debug", Notice: "notice", ReplyValue: []byte("value")},
+		&_json.FileInit{FileId: "f1", Name: "a.png", SubType: IMAGE, Size: 1 << 40, ChunkSize: 64 * KB, Checksum: "C4CA4238A0B923820DCC509A6F75849B"},
+		&_json.FileChunk{FileId: "f1", Seq: 2, Data: []byte("chunk"), Last: true},
+		&_json.FileAck{FileId: "f1", Seq: 2, ChunkSize: 64 * KB, Done: true},
+		&_json.FileDownload{FileId: "f1", From: 3},
+		&_json.OfflineMessage{Seq: 1, Data: []byte("data"), SavedAt: now},
+		&_json.OfflineAck{Seq: 1},
+		&_json.Envelope{MsgId: "m1", From: "tom", SendAt: now, Data: []byte("data")},
+		&_json.MessageAck{MsgId: "m1", Read: true},
+		&_json.Receipt{MsgId: "m1", To: "bob", State: RECEIPT_READ, At: now},
+		&_json.Message{Id: 1, ChannelType: 2, ChannelId: "g1", From: "tom", To: "bob", SubType: TEXT, Body: []byte("hi"), SendAt: now},
+		&_json.HistoryQuery{ChannelType: 1, ChannelId: "bob", Before: 10, After: 1, Limit: 20, SubTypes: []int{TEXT, IMAGE}},
+		&_json.HistoryPage{Messages: []_json.Message{{Id: 1, ChannelId: "g1", SendAt: now}, {Id: 2, Body: []byte("hi")}}, HasMore: true},
+		&_json.Error{Code: ERR_RATE_LIMITED, Message: "slow down", Retryable: true},
+		&_json.Subscription{Topic: "score.*"},
+		&_json.Publication{Topic: "score.football", Data: []byte("data")},
+	}
+}
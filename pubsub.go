@@ -0,0 +1,340 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"strings"
+	"sync"
+)
+
+// the default max patterns a connection subscribes
+const DEFAULT_MAX_SUBSCRIPTIONS = 100
+
+// topics are words separated by '.', like "score.football.1001".
+// a pattern subscribed may use '*' for exactly one word and '#' as the last word for zero or more words,
+// like "score.*.1001" or "score.#"
+const (
+	TOPIC_SEPARATOR = "."
+	TOPIC_WORD      = "*"
+	TOPIC_REST      = "#"
+)
+
+// decide whether a connection may subscribe a pattern, a non-nil error rejects it.
+// key is empty if the connection is not Online
+type AuthorizeFunc func(key string, conn *websocket.Conn, pattern string) error
+
+type authorizer struct {
+	pattern string
+	f       AuthorizeFunc
+}
+
+// topic-based publish/subscribe over connections, get it by EnablePubSub.
+// clients subscribe by SUBSCRIBE and UNSUBSCRIBE with a Subscription, and receive PUBLISH with a Publication.
+// subscriptions of a connection are dropped when it's closed
+type PubSub struct {
+	wsh *WebSocketHelper
+	m   *sync.RWMutex
+	// pattern -> connections subscribed
+	subs map[string]map[*websocket.Conn]struct{}
+	// patterns with wildcards, matched one by one on Publish
+	wildcards map[string]struct{}
+	// connection -> patterns subscribed
+	conns       map[*websocket.Conn]map[string]struct{}
+	authorizers []authorizer
+	max         int
+}
+
+// enable publish/subscribe, SUBSCRIBE and UNSUBSCRIBE are handled
+func (wsh *WebSocketHelper) EnablePubSub() *PubSub {
+	ps := &PubSub{
+		wsh:       wsh,
+		m:         &sync.RWMutex{},
+		subs:      make(map[string]map[*websocket.Conn]struct{}),
+		wildcards: make(map[string]struct{}),
+		conns:     make(map[*websocket.Conn]map[string]struct{}),
+		max:       DEFAULT_MAX_SUBSCRIPTIONS,
+	}
+	wsh.M.Lock()
+	wsh.pubsub = ps
+	wsh.M.Unlock()
+	wsh.HandleFunc(SUBSCRIBE, ps.handleSubscribe)
+	wsh.HandleFunc(UNSUBSCRIBE, ps.handleUnsubscribe)
+	return ps
+}
+
+func (wsh *WebSocketHelper) pubSub() (*PubSub, error) {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	if wsh.pubsub == nil {
+		return nil, errorx.NewFromString("pubsub not enabled, call EnablePubSub first")
+	}
+	return wsh.pubsub, nil
+}
+
+// publish an object to connections subscribing the topic, the number of connections sent is returned
+func (wsh *WebSocketHelper) Publish(topic string, obj interface{}) (int, error) {
+	ps, e := wsh.pubSub()
+	if e != nil {
+		return 0, e
+	}
+	return ps.Publish(topic, obj)
+}
+
+// set the max patterns a connection subscribes
+func (ps *PubSub) SetMaxSubscriptions(max int) {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	ps.max = max
+}
+
+// authorize subscriptions whose patterns overlap pattern, that's, may receive a topic matching pattern.
+// all authorizers overlapping a subscription should pass:
+//
+//	ps.Authorize("private.#", func(key string, conn *websocket.Conn, pattern string) error {
+//		if key == "" {
+//			return wshelper.NewError(wshelper.ERR_UNAUTHORIZED, "login first")
+//		}
+//		return nil
+//	})
+func (ps *PubSub) Authorize(pattern string, f AuthorizeFunc) error {
+	if e := validateTopic(pattern, true); e != nil {
+		return e
+	}
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	ps.authorizers = append(ps.authorizers, authorizer{pattern: pattern, f: f})
+	return nil
+}
+
+// subscribe a topic or a pattern for a connection
+func (ps *PubSub) Subscribe(conn *websocket.Conn, pattern string) error {
+	if e := validateTopic(pattern, true); e != nil {
+		return e
+	}
+	ps.m.RLock()
+	authorizers := ps.authorizers
+	ps.m.RUnlock()
+	key, _ := ps.wsh.pool.KeyOf(conn)
+	for _, a := range authorizers {
+		if !overlapTopics(a.pattern, pattern) {
+			continue
+		}
+		if e := a.f(key, conn, pattern); e != nil {
+			if _, ok := e.(*Error); ok {
+				return e
+			}
+			return NewError(ERR_UNAUTHORIZED, e.Error())
+		}
+	}
+
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	patterns, ok := ps.conns[conn]
+	if !ok {
+		patterns = make(map[string]struct{})
+		ps.conns[conn] = patterns
+	}
+	if _, ok := patterns[pattern]; ok {
+		return nil
+	}
+	if len(patterns) >= ps.max {
+		return Errorf(ERR_BAD_REQUEST, "subscriptions more than the max '%d'", ps.max)
+	}
+	patterns[pattern] = struct{}{}
+	subscribers, ok := ps.subs[pattern]
+	if !ok {
+		subscribers = make(map[*websocket.Conn]struct{})
+		ps.subs[pattern] = subscribers
+		if hasWildcard(pattern) {
+			ps.wildcards[pattern] = struct{}{}
+		}
+	}
+	subscribers[conn] = struct{}{}
+	return nil
+}
+
+// unsubscribe a pattern subscribed by a connection
+func (ps *PubSub) Unsubscribe(conn *websocket.Conn, pattern string) {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	ps.unsubscribe(conn, pattern)
+}
+
+// drop all subscriptions of a connection
+func (ps *PubSub) UnsubscribeAll(conn *websocket.Conn) {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	for pattern := range ps.conns[conn] {
+		ps.unsubscribe(conn, pattern)
+	}
+}
+
+// must be called with ps.m locked
+func (ps *PubSub) unsubscribe(conn *websocket.Conn, pattern string) {
+	if patterns, ok := ps.conns[conn]; ok {
+		delete(patterns, pattern)
+		if len(patterns) == 0 {
+			delete(ps.conns, conn)
+		}
+	}
+	if subscribers, ok := ps.subs[pattern]; ok {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(ps.subs, pattern)
+			delete(ps.wildcards, pattern)
+		}
+	}
+}
+
+// patterns subscribed by a connection
+func (ps *PubSub) Subscriptions(conn *websocket.Conn) []string {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	rs := make([]string, 0, len(ps.conns[conn]))
+	for pattern := range ps.conns[conn] {
+		rs = append(rs, pattern)
+	}
+	return rs
+}
+
+// connections subscribing a topic, each once even if it subscribes more than one matching pattern
+func (ps *PubSub) subscribersOf(topic string) []*websocket.Conn {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	set := make(map[*websocket.Conn]struct{}, len(ps.subs[topic]))
+	for conn := range ps.subs[topic] {
+		set[conn] = struct{}{}
+	}
+	for pattern := range ps.wildcards {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		for conn := range ps.subs[pattern] {
+			set[conn] = struct{}{}
+		}
+	}
+	rs := make([]*websocket.Conn, 0, len(set))
+	for conn := range set {
+		rs = append(rs, conn)
+	}
+	return rs
+}
+
+// publish an object to connections subscribing the topic, as a PUBLISH with the object marshalled by the serializer
+// of each connection. the number of connections sent is returned
+func (ps *PubSub) Publish(topic string, obj interface{}) (int, error) {
+	if e := validateTopic(topic, false); e != nil {
+		return 0, e
+	}
+	conns := ps.subscribersOf(topic)
+	if len(conns) == 0 {
+		return 0, nil
+	}
+	return ps.wsh.pool.sendConns(conns, ps.wsh.packerFor(PUBLISH, func(m Marshaller) (interface{}, error) {
+		data, e := m.Marshal(obj)
+		if e != nil {
+			return nil, e
+		}
+		return _json.Publication{Topic: topic, Data: data}, nil
+	}))
+}
+
+func (ps *PubSub) handleSubscribe(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.Subscription
+	if e := ps.wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad subscription: %s", e.Error())
+	}
+	if e := ps.Subscribe(ConnOf(cache), in.Topic); e != nil {
+		return e
+	}
+	return ps.wsh.ReplyContext(ContextOf(cache), ConnOf(cache), REPLY, _json.Reply{
+		ReplyType: REPLY_NOTIFY,
+		Desc:      "subscribed",
+		Tip:       in.Topic,
+	})
+}
+
+func (ps *PubSub) handleUnsubscribe(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+	var in _json.Subscription
+	if e := ps.wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+		return Errorf(ERR_BAD_REQUEST, "bad subscription: %s", e.Error())
+	}
+	ps.Unsubscribe(ConnOf(cache), in.Topic)
+	return ps.wsh.ReplyContext(ContextOf(cache), ConnOf(cache), REPLY, _json.Reply{
+		ReplyType: REPLY_NOTIFY,
+		Desc:      "unsubscribed",
+		Tip:       in.Topic,
+	})
+}
+
+// drop subscriptions of a closed connection, if pubsub is enabled
+func (wsh *WebSocketHelper) unsubscribeAll(conn *websocket.Conn) {
+	wsh.M.RLock()
+	ps := wsh.pubsub
+	wsh.M.RUnlock()
+	if ps != nil {
+		ps.UnsubscribeAll(conn)
+	}
+}
+
+// a topic has no empty words, a pattern may have wildcards with '#' only as the last word
+func validateTopic(topic string, pattern bool) error {
+	if topic == "" {
+		return NewError(ERR_BAD_REQUEST, "empty topic")
+	}
+	words := strings.Split(topic, TOPIC_SEPARATOR)
+	for i, word := range words {
+		switch {
+		case word == "":
+			return Errorf(ERR_BAD_REQUEST, "topic '%s' has an empty word", topic)
+		case (word == TOPIC_WORD || word == TOPIC_REST) && !pattern:
+			return Errorf(ERR_BAD_REQUEST, "topic '%s' to publish should not have wildcards", topic)
+		case word == TOPIC_REST && i != len(words)-1:
+			return Errorf(ERR_BAD_REQUEST, "'%s' should be the last word of '%s'", TOPIC_REST, topic)
+		case word != TOPIC_WORD && word != TOPIC_REST && strings.ContainsAny(word, TOPIC_WORD+TOPIC_REST):
+			return Errorf(ERR_BAD_REQUEST, "wildcards should be whole words in '%s'", topic)
+		}
+	}
+	return nil
+}
+
+func hasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, TOPIC_WORD+TOPIC_REST)
+}
+
+// whether a topic matches a pattern
+func matchTopic(pattern string, topic string) bool {
+	ps, ts := strings.Split(pattern, TOPIC_SEPARATOR), strings.Split(topic, TOPIC_SEPARATOR)
+	for i, p := range ps {
+		if p == TOPIC_REST {
+			return true
+		}
+		if i >= len(ts) || p != TOPIC_WORD && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// whether a topic may match both patterns
+func overlapTopics(a string, b string) bool {
+	as, bs := strings.Split(a, TOPIC_SEPARATOR), strings.Split(b, TOPIC_SEPARATOR)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == TOPIC_REST || bs[i] == TOPIC_REST {
+			return true
+		}
+		if as[i] != TOPIC_WORD && bs[i] != TOPIC_WORD && as[i] != bs[i] {
+			return false
+		}
+	}
+	if len(as) == len(bs) {
+		return true
+	}
+	// the longer one may end with '#' matching no more words
+	longer, n := as, len(bs)
+	if len(bs) > len(as) {
+		longer, n = bs, len(as)
+	}
+	return len(longer) == n+1 && longer[n] == TOPIC_REST
+}
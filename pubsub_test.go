@@ -0,0 +1,91 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"golang.org/x/net/websocket"
+	"testing"
+	"time"
+)
+
+func TestTopics(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"score.football", "score.football", true},
+		{"score.*", "score.football", true},
+		{"score.*", "score.football.1001", false},
+		{"score.*.1001", "score.football.1001", true},
+		{"score.#", "score", true},
+		{"score.#", "score.football.1001", true},
+		{"#", "score.football", true},
+		{"score.#", "news.football", false},
+	} {
+		util.Assertf(matchTopic(c.pattern, c.topic) == c.match, t, "match '%s' '%s' want %v", c.pattern, c.topic, c.match)
+	}
+	for _, c := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"private.#", "#", true},
+		{"private.#", "private.*", true},
+		{"private.#", "private", true},
+		{"private.*", "*.chat", true},
+		{"private.*", "public.*", false},
+		{"private.*", "private", false},
+	} {
+		util.Assertf(overlapTopics(c.a, c.b) == c.overlap, t, "overlap '%s' '%s' want %v", c.a, c.b, c.overlap)
+	}
+	for _, bad := range []string{"", "score..1", "score.#.1", "score.foo*"} {
+		util.Assertf(validateTopic(bad, true) != nil, t, "'%s' should be invalid", bad)
+	}
+	util.Assertf(validateTopic("score.*", false) != nil, t, "topics to publish should not have wildcards")
+}
+
+func TestPubSub(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	ps := wsh.EnablePubSub()
+	ps.Authorize("private.#", func(key string, conn *websocket.Conn, pattern string) error {
+		return NewError(ERR_UNAUTHORIZED, "no private topics")
+	})
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+	subscribe := func(command int, topic string) _json.Reply {
+		c.Send(command, `{"topic":"`+topic+`"}`)
+		return c.Reply()
+	}
+
+	reply := subscribe(SUBSCRIBE, "score.*")
+	util.Assertf(reply.Desc == "subscribed" && reply.Tip == "score.*", t, "bad reply %+v", reply)
+	subscribe(SUBSCRIBE, "score.#")
+	reply = subscribe(SUBSCRIBE, "#")
+	util.Assertf(reply.ReplyType == REPLY_ERROR, t, "'#' overlaps private topics, want an error but got %+v", reply)
+
+	// subscribed twice by patterns, sent once
+	n, e := wsh.Publish("score.football", _json.SendOne{Message: "1:0"})
+	util.Assertf(e == nil && n == 1, t, "want published to 1 but got %d %v", n, e)
+	var pub _json.Publication
+	util.Assertf(c.ReceiveInto(&pub) == wsh.genCommandHash(PUBLISH), t, "want a PUBLISH")
+	var score _json.SendOne
+	wsh.Unmarshal(pub.Data, &score)
+	util.Assertf(pub.Topic == "score.football" && score.Message == "1:0", t, "bad publication %+v %+v", pub, score)
+
+	n, _ = wsh.Publish("news.football", _json.SendOne{})
+	util.Assertf(n == 0, t, "want published to none but got %d", n)
+	_, e = wsh.Publish("score.*", _json.SendOne{})
+	util.Assertf(e != nil, t, "want an error publishing a pattern")
+
+	subscribe(UNSUBSCRIBE, "score.*")
+	subscribe(UNSUBSCRIBE, "score.#")
+	n, _ = wsh.Publish("score.football", _json.SendOne{})
+	util.Assertf(n == 0, t, "want published to none after unsubscribed but got %d", n)
+
+	// cleaned up on disconnect
+	subscribe(SUBSCRIBE, "score.*")
+	c.Conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	ps.m.RLock()
+	util.Assertf(len(ps.subs) == 0 && len(ps.conns) == 0 && len(ps.wildcards) == 0, t, "subscriptions should be dropped")
+	ps.m.RUnlock()
+}
@@ -0,0 +1,166 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"golang.org/x/net/websocket"
+	"io"
+	"sync"
+)
+
+// states of a push
+const (
+	// sent to the connection of the user
+	PUSH_SENT = 1 + iota
+	// the user is offline, saved to the offline store
+	PUSH_SAVED
+	// the user is offline and there's no offline store
+	PUSH_DROPPED
+	// failed, see PushResult.Err
+	PUSH_FAILED
+	// a debug-only reply to a user not in debug mode or offline
+	PUSH_SKIPPED
+)
+
+// the result of pushing to a user
+type PushResult struct {
+	To    string
+	State int
+	Err   error
+}
+
+// build the Reply of a push, replyType should be registered. a Reply is sent as it is with the reply type set,
+// a string is the text of its type, Tip, Debug or Notice, other objects are the ReplyValue
+func (wsh *WebSocketHelper) replyOf(replyType int, obj interface{}) (_json.Reply, ReplyKind, error) {
+	var reply _json.Reply
+	switch v := obj.(type) {
+	case _json.Reply:
+		reply = v
+	case *_json.Reply:
+		reply = *v
+	case string:
+		switch replyType {
+		case REPLY_TIPS:
+			reply.Tip = v
+		case REPLY_DEBUG:
+			reply.Debug = v
+		case REPLY_NOTIFY:
+			reply.Notice = v
+		default:
+			reply.ReplyValue = v
+		}
+	default:
+		reply.ReplyValue = obj
+	}
+	reply.ReplyType = replyType
+	kind, e := wsh.replies.check(reply)
+	return reply, kind, e
+}
+
+// push a REPLY of replyType to a user, with the serializer of the user's connection.
+// if the user is offline, it's saved to the offline store. it fails instead if some serializer can not carry the offline copy,
+// like a ReplyValue of a type without a registered Payload when protobuf is registered
+func (wsh *WebSocketHelper) Push(to string, replyType int, obj interface{}) PushResult {
+	return wsh.PushMany(replyType, obj, to)[0]
+}
+
+// push a REPLY of replyType to users at the same time, results are in the order of tos
+func (wsh *WebSocketHelper) PushMany(replyType int, obj interface{}, tos ...string) []PushResult {
+	rs := make([]PushResult, len(tos))
+	reply, kind, e := wsh.replyOf(replyType, obj)
+	if e != nil {
+		for i, to := range tos {
+			rs[i] = PushResult{To: to, State: PUSH_FAILED, Err: e}
+		}
+		return rs
+	}
+	pack := wsh.packerFor(REPLY, func(m Marshaller) (interface{}, error) {
+		return reply, nil
+	})
+	// offline messages are packed by wsh.Serializer, and re-encoded for the serializer of the user when delivered
+	var once sync.Once
+	var offline []byte
+	var offlineE error
+	packOffline := func() ([]byte, error) {
+		once.Do(func() {
+			if offline, offlineE = wsh.Pack(REPLY, reply); offlineE == nil {
+				offlineE = wsh.checkTranscode(offline)
+			}
+		})
+		return offline, offlineE
+	}
+
+	var wg = sync.WaitGroup{}
+	wg.Add(len(tos))
+	for i, to := range tos {
+		go func(i int, to string) {
+			defer wg.Done()
+			rs[i] = wsh.pushTo(to, kind.DebugOnly, pack, packOffline)
+		}(i, to)
+	}
+	wg.Wait()
+	return rs
+}
+
+// push a REPLY of replyType to all users online
+func (wsh *WebSocketHelper) PushAll(replyType int, obj interface{}) []PushResult {
+	var tos []string
+	wsh.pool.Range(func(key string, conn *websocket.Conn) bool {
+		tos = append(tos, key)
+		return true
+	})
+	return wsh.PushMany(replyType, obj, tos...)
+}
+
+func (wsh *WebSocketHelper) pushTo(to string, debugOnly bool, pack func(conn *websocket.Conn) ([]byte, error), packOffline func() ([]byte, error)) PushResult {
+	conn, online := wsh.pool.Get(to)
+	// debug-only replies are not saved for offline users
+	if debugOnly && (!online || !wsh.pool.IsDebug(conn)) {
+		return PushResult{To: to, State: PUSH_SKIPPED}
+	}
+	if online {
+		buf, e := pack(conn)
+		if e != nil {
+			return PushResult{To: to, State: PUSH_FAILED, Err: e}
+		}
+		e = wsh.pool.Write(conn, buf)
+		if e == nil {
+			return PushResult{To: to, State: PUSH_SENT}
+		}
+		if e != io.EOF {
+			return PushResult{To: to, State: PUSH_FAILED, Err: e}
+		}
+		// the connection is closing, the user is regarded as offline
+	}
+	buf, e := packOffline()
+	if e != nil {
+		return PushResult{To: to, State: PUSH_FAILED, Err: e}
+	}
+	wsh.pool.M.RLock()
+	store := wsh.pool.offline
+	wsh.pool.M.RUnlock()
+	if e = wsh.pool.saveOffline(buf, to); e != nil {
+		return PushResult{To: to, State: PUSH_FAILED, Err: e}
+	}
+	if store == nil {
+		return PushResult{To: to, State: PUSH_DROPPED}
+	}
+	return PushResult{To: to, State: PUSH_SAVED}
+}
+
+// check a message packed by wsh.Serializer can be re-encoded for every serializer connections can negotiate,
+// so that it's not saved offline for users who can never get it, like an untyped ReplyValue for protobuf
+func (wsh *WebSocketHelper) checkTranscode(buf []byte) error {
+	wsh.M.RLock()
+	from := wsh.Serializer
+	ms := make([]Marshaller, 0, len(wsh.marshallers))
+	for _, m := range wsh.marshallers {
+		ms = append(ms, m)
+	}
+	wsh.M.RUnlock()
+	for _, m := range ms {
+		if _, e := wsh.Transcode(buf, from, m); e != nil {
+			return Errorf(ERR_BAD_REQUEST, "can not be re-encoded for '%s' connections: %s", m.TypeName(), e.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, nil)
+	ts := newTestServer(t, wsh)
+	clients := make(map[string]*testClient)
+	for _, user := range []string{"tom", "bob"} {
+		clients[user] = loginTest(t, wsh, ts, user, "")
+	}
+
+	r := wsh.Push("tom", REPLY_TIPS, "bob is typing")
+	util.Assertf(r.State == PUSH_SENT && r.Err == nil, t, "bad result %+v", r)
+	reply := clients["tom"].Reply()
+	util.Assertf(reply.ReplyType == REPLY_TIPS && reply.Tip == "bob is typing", t, "bad tips %+v", reply)
+
+	r = wsh.Push("tom", 100, "?")
+	util.Assertf(r.State == PUSH_FAILED && r.Err != nil, t, "want an unknown reply type failed but got %+v", r)
+
+	// jack is offline, dropped without an offline store and saved with it
+	rs := wsh.PushMany(REPLY_MESSAGE, _json.SendOne{From: "system", Message: "hi"}, "bob", "jack")
+	util.Assertf(rs[0].To == "bob" && rs[0].State == PUSH_SENT, t, "bad result %+v", rs[0])
+	util.Assertf(rs[1].To == "jack" && rs[1].State == PUSH_DROPPED, t, "bad result %+v", rs[1])
+	reply = clients["bob"].Reply()
+	util.Assertf(reply.ReplyType == REPLY_MESSAGE && reply.ReplyValue != nil, t, "bad message %+v", reply)
+	store := wsh.EnableOffline(NewMemoryOfflineStore(time.Hour))
+	r = wsh.Push("jack", REPLY_NOTIFY, "maintenance at 2am")
+	util.Assertf(r.State == PUSH_SAVED, t, "want saved but got %+v", r)
+	box, _ := store.List("jack")
+	util.Assertf(len(box) == 1, t, "want 1 saved but got %d", len(box))
+
+	rs = wsh.PushAll(REPLY_NOTIFY, _json.Reply{Desc: "notice", Notice: "maintenance at 2am"})
+	util.Assertf(len(rs) == 2, t, "want pushed to 2 but got %d", len(rs))
+	for _, user := range []string{"tom", "bob"} {
+		reply = clients[user].Reply()
+		util.Assertf(reply.ReplyType == REPLY_NOTIFY && reply.Desc == "notice" && reply.Notice == "maintenance at 2am", t, "bad notice %+v", reply)
+	}
+}
+
+// offline copies are saved only if they can be re-encoded for every serializer
+func TestPushOfflineProtobuf(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	pb := NewProtobufer()
+	wsh.RegisterMarshaller(pb)
+	store := wsh.EnableOffline(NewMemoryOfflineStore(time.Hour))
+	handleTestLogin(wsh, nil)
+
+	r := wsh.Push("tom", REPLY_ERROR, _json.Error{Code: ERR_NOT_FOUND, Message: "no such group"})
+	util.Assertf(r.State == PUSH_SAVED, t, "want saved but got %+v", r)
+	// an untyped ReplyValue decoded by json is a map, which protobuf can not carry
+	r = wsh.Push("tom", REPLY_MESSAGE, _json.SendOne{From: "system", Message: "hi"})
+	util.Assertf(r.State == PUSH_FAILED && r.Err != nil, t, "want failed but got %+v", r)
+	box, _ := store.List("tom")
+	util.Assertf(len(box) == 1, t, "want 1 saved but got %d", len(box))
+
+	c := dialTest(t, wsh, newTestServer(t, wsh), "?"+SERIALIZER_QUERY+"=protobuf")
+	body, _ := pb.Marshal(_json.SendOne{From: "tom"})
+	c.SendFrame(append([]byte(wsh.genCommandHash(TEST_LOGIN)), body...))
+	buf := c.Receive()
+	var offline _json.OfflineMessage
+	if e := pb.Unmarshal(buf[32:], &offline); e != nil {
+		t.Fatal(e.Error())
+	}
+	reply, payload, e := wsh.Replies().Decode(pb, offline.Data[32:])
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	v, ok := payload.(_json.Error)
+	util.Assertf(reply.ReplyType == REPLY_ERROR && ok && v.Code == ERR_NOT_FOUND, t, "bad offline reply %+v %#v", reply, payload)
+}
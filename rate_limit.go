@@ -0,0 +1,421 @@
+package wshelper
+
+import (
+	"context"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// actions on a message over its rate limit
+const (
+	// drop the message and reply REPLY_ERROR
+	RATE_REJECT = 1 + iota
+	// hold the connection until a token is available
+	RATE_DELAY
+	// close the connection
+	RATE_DISCONNECT
+)
+
+// the max time a message waits for a token under RATE_DELAY if RateLimit.MaxDelay is 0, it holds the reader of the connection
+const DEFAULT_MAX_RATE_DELAY = 5 * time.Second
+
+// a token bucket limit, Rate tokens are added per second up to Burst, each message takes one
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	// RATE_REJECT, RATE_DELAY or RATE_DISCONNECT, 0 means RATE_REJECT
+	Action int
+	// for RATE_DELAY, a message waiting longer is rejected, 0 means DEFAULT_MAX_RATE_DELAY
+	MaxDelay time.Duration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// add the tokens since the last time
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.last = now
+}
+
+// whether a token can be taken without taking it. when there's none, one can be reserved if reserve is set,
+// and the time to wait for it is returned
+func (b *tokenBucket) check(limit RateLimit, reserve bool) (time.Duration, bool) {
+	if b.tokens >= 1 {
+		return 0, true
+	}
+	if !reserve || limit.Rate <= 0 {
+		return 0, false
+	}
+	maxDelay := limit.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DEFAULT_MAX_RATE_DELAY
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	if wait > maxDelay {
+		return 0, false
+	}
+	return wait, true
+}
+
+// take a token. when there's none, reserve one if reserve is set and return the time to wait for it
+func (b *tokenBucket) take(limit RateLimit, now time.Time, reserve bool) (time.Duration, bool) {
+	b.refill(limit, now)
+	wait, ok := b.check(limit, reserve)
+	if ok {
+		// a reserved token makes it negative
+		b.tokens--
+	}
+	return wait, ok
+}
+
+// counters of rate limited messages
+type RateCounters struct {
+	Allowed      uint64
+	Rejected     uint64
+	Delayed      uint64
+	Disconnected uint64
+}
+
+func (c *RateCounters) count(action int) {
+	switch action {
+	case 0:
+		atomic.AddUint64(&c.Allowed, 1)
+	case RATE_DELAY:
+		atomic.AddUint64(&c.Delayed, 1)
+	case RATE_DISCONNECT:
+		atomic.AddUint64(&c.Disconnected, 1)
+	default:
+		atomic.AddUint64(&c.Rejected, 1)
+	}
+}
+
+func (c *RateCounters) load() RateCounters {
+	return RateCounters{
+		Allowed:      atomic.LoadUint64(&c.Allowed),
+		Rejected:     atomic.LoadUint64(&c.Rejected),
+		Delayed:      atomic.LoadUint64(&c.Delayed),
+		Disconnected: atomic.LoadUint64(&c.Disconnected),
+	}
+}
+
+// RateLimiter limits messages per user key, per command of a user key, and connections per ip at handshake.
+// a connection not online is limited by its ip as the user key
+type RateLimiter struct {
+	m *sync.Mutex
+	// limit of each user over all commands, nil means no limit
+	user *RateLimit
+	// limits of specific users, overriding user
+	users map[string]RateLimit
+	// limits of each user on a command
+	commands map[int]RateLimit
+	// limit of connections per ip, nil means no limit
+	ip *RateLimit
+
+	buckets map[string]*tokenBucket
+
+	counters        RateCounters
+	ipCounters      RateCounters
+	commandCounters map[int]*RateCounters
+
+	logger Logger
+}
+
+// new a rate limiter without limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		m:               &sync.Mutex{},
+		users:           make(map[string]RateLimit),
+		commands:        make(map[int]RateLimit),
+		buckets:         make(map[string]*tokenBucket),
+		commandCounters: make(map[int]*RateCounters),
+		logger:          NopLogger{},
+	}
+}
+
+// set the logger, nil means NopLogger. EnableRateLimit sets the logger of wsh
+func (rl *RateLimiter) SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	rl.logger = l
+}
+
+func (rl *RateLimiter) loggerOf() Logger {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	return rl.logger
+}
+
+// limit each user over all commands, Rate<=0 removes the limit
+func (rl *RateLimiter) SetUserLimit(limit RateLimit) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if limit.Rate <= 0 {
+		rl.user = nil
+		return
+	}
+	rl.user = &limit
+}
+
+// limit a specific user, overriding SetUserLimit
+func (rl *RateLimiter) SetUserLimitOf(key string, limit RateLimit) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	rl.users[key] = limit
+}
+
+// limit each user on a command, like SEND_MANY
+func (rl *RateLimiter) SetCommandLimit(command int, limit RateLimit) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	rl.commands[command] = limit
+	if _, ok := rl.commandCounters[command]; !ok {
+		rl.commandCounters[command] = &RateCounters{}
+	}
+}
+
+// limit new connections per ip, checked at handshake, Rate<=0 removes the limit
+func (rl *RateLimiter) SetIPLimit(limit RateLimit) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if limit.Rate <= 0 {
+		rl.ip = nil
+		return
+	}
+	rl.ip = &limit
+}
+
+// the bucket refilled to now
+func (rl *RateLimiter) bucketOf(bucket string, limit RateLimit, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[bucket]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		rl.buckets[bucket] = b
+	}
+	b.refill(limit, now)
+	return b
+}
+
+func (rl *RateLimiter) take(bucket string, limit RateLimit, now time.Time) (time.Duration, bool) {
+	return rl.bucketOf(bucket, limit, now).take(limit, now, limit.Action == RATE_DELAY)
+}
+
+// check a message of a command from a user key, every bucket is checked before a token is taken from any,
+// so a message rejected by one limit costs nothing of the others.
+// it returns the time to wait before handling the message, and the action if it's over the limit, 0 for none
+func (rl *RateLimiter) Allow(key string, command int) (time.Duration, int) {
+	now := time.Now()
+	rl.m.Lock()
+	var wait time.Duration
+	action := 0
+	var limits []RateLimit
+	var buckets []string
+	if limit, ok := rl.users[key]; ok {
+		limits, buckets = append(limits, limit), append(buckets, "user:"+key)
+	} else if rl.user != nil {
+		limits, buckets = append(limits, *rl.user), append(buckets, "user:"+key)
+	}
+	limit, limited := rl.commands[command]
+	if limited {
+		limits, buckets = append(limits, limit), append(buckets, "command:"+strconv.Itoa(command)+":"+key)
+	}
+	bs := make([]*tokenBucket, len(limits))
+	for i := range limits {
+		bs[i] = rl.bucketOf(buckets[i], limits[i], now)
+		w, ok := bs[i].check(limits[i], limits[i].Action == RATE_DELAY)
+		if !ok {
+			action = limits[i].Action
+			if action == 0 || action == RATE_DELAY {
+				action = RATE_REJECT
+			}
+			break
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	if action == 0 {
+		for _, b := range bs {
+			b.tokens--
+		}
+	}
+	counters := rl.commandCounters[command]
+	rl.m.Unlock()
+
+	if action == 0 && wait > 0 {
+		rl.counters.count(RATE_DELAY)
+		if counters != nil {
+			counters.count(RATE_DELAY)
+		}
+		return wait, 0
+	}
+	rl.counters.count(action)
+	if counters != nil {
+		counters.count(action)
+	}
+	return 0, action
+}
+
+// check a new connection from an ip, like Allow
+func (rl *RateLimiter) AllowIP(ip string) (time.Duration, int) {
+	rl.m.Lock()
+	if rl.ip == nil {
+		rl.m.Unlock()
+		return 0, 0
+	}
+	limit := *rl.ip
+	wait, ok := rl.take("ip:"+ip, limit, time.Now())
+	rl.m.Unlock()
+
+	switch {
+	case !ok:
+		rl.ipCounters.count(RATE_REJECT)
+		return 0, RATE_REJECT
+	case wait > 0:
+		rl.ipCounters.count(RATE_DELAY)
+	default:
+		rl.ipCounters.count(0)
+	}
+	return wait, 0
+}
+
+// counters of all messages checked
+func (rl *RateLimiter) Counters() RateCounters {
+	return rl.counters.load()
+}
+
+// counters of connections checked at handshake
+func (rl *RateLimiter) IPCounters() RateCounters {
+	return rl.ipCounters.load()
+}
+
+// counters of messages of each command having a limit
+func (rl *RateLimiter) CommandCounters() map[int]RateCounters {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	var rs = make(map[int]RateCounters, len(rl.commandCounters))
+	for command, c := range rl.commandCounters {
+		rs[command] = c.load()
+	}
+	return rs
+}
+
+// forget buckets idle long enough to be full again
+func (rl *RateLimiter) prune(now time.Time) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > time.Minute && b.tokens >= 0 {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// a supervisor to forget idle buckets on a timer
+func (rl *RateLimiter) Supervisor() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func(ctx context.Context) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				rl.loggerOf().Debug("rate limiter supervisor canceled")
+				return
+			case now := <-ticker.C:
+				rl.prune(now)
+			}
+		}
+	}(ctx)
+	return cancel
+}
+
+// enable rate limits, set limits on the returned RateLimiter.
+// the user limit is Options.UserRate per second with burst Options.UserBurst, and the ip limit is Options.IPRate with Options.IPBurst, 0 means no limit.
+// the ip limit takes effect on wsh.Server. the supervisor forgetting idle buckets can be stopped by the returned cancel func
+func (wsh *WebSocketHelper) EnableRateLimit() (*RateLimiter, context.CancelFunc) {
+	rl := NewRateLimiter()
+	rl.SetLogger(wsh.Logger())
+	opts := wsh.Options()
+	if opts.UserRate > 0 {
+		rl.SetUserLimit(RateLimit{Rate: opts.UserRate, Burst: opts.UserBurst})
+	}
+	if opts.IPRate > 0 {
+		rl.SetIPLimit(RateLimit{Rate: opts.IPRate, Burst: opts.IPBurst})
+	}
+	wsh.M.Lock()
+	wsh.rateLimiter = rl
+	wsh.M.Unlock()
+	return rl, rl.Supervisor()
+}
+
+// the ip of a connection or a request
+func remoteIP(req *http.Request) string {
+	host, _, e := net.SplitHostPort(req.RemoteAddr)
+	if e != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// the key a connection is limited by, its user key when online, or else its ip
+func (wsh *WebSocketHelper) rateKeyOf(conn *websocket.Conn) string {
+	if key, ok := wsh.pool.KeyOf(conn); ok {
+		return key
+	}
+	if req := conn.Request(); req != nil {
+		return remoteIP(req)
+	}
+	return ""
+}
+
+// check the rate limit of a message, an ERR_RATE_LIMITED Error if it's over the limit
+func (wsh *WebSocketHelper) limitRate(conn *websocket.Conn, command int) error {
+	wsh.M.RLock()
+	rl := wsh.rateLimiter
+	wsh.M.RUnlock()
+	if rl == nil {
+		return nil
+	}
+	wait, action := rl.Allow(wsh.rateKeyOf(conn), command)
+	switch action {
+	case 0:
+		time.Sleep(wait)
+		return nil
+	case RATE_DISCONNECT:
+		return Errorf(ERR_RATE_LIMITED, "too many messages of command '%d'", command).Fatal()
+	}
+	return Errorf(ERR_RATE_LIMITED, "too many messages of command '%d', retry later", command).Retry()
+}
+
+// check the ip limit of a new connection
+func (wsh *WebSocketHelper) limitIP(req *http.Request) error {
+	wsh.M.RLock()
+	rl := wsh.rateLimiter
+	wsh.M.RUnlock()
+	if rl == nil {
+		return nil
+	}
+	ip := remoteIP(req)
+	wait, action := rl.AllowIP(ip)
+	if action != 0 {
+		return errorx.NewFromStringf("too many connections from '%s'", ip)
+	}
+	time.Sleep(wait)
+	return nil
+}
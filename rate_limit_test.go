@@ -0,0 +1,75 @@
+package wshelper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.SetCommandLimit(SEND_MANY, RateLimit{Rate: 0.001, Burst: 2})
+	rl.SetCommandLimit(SEND_ONE, RateLimit{Rate: 10, Burst: 1, Action: RATE_DELAY, MaxDelay: time.Second})
+	rl.SetUserLimitOf("spammer", RateLimit{Rate: 0.001, Burst: 1, Action: RATE_DISCONNECT})
+
+	for i, want := range []int{0, 0, RATE_REJECT} {
+		if _, action := rl.Allow("tom", SEND_MANY); action != want {
+			t.Fatalf("message %d: want action '%d' but got '%d'", i, want, action)
+		}
+	}
+	// buckets are per user
+	if _, action := rl.Allow("jack", SEND_MANY); action != 0 {
+		t.Fatalf("want jack allowed but got action '%d'", action)
+	}
+
+	if wait, action := rl.Allow("tom", SEND_ONE); wait != 0 || action != 0 {
+		t.Fatalf("want the first message passed but got wait '%v' action '%d'", wait, action)
+	}
+	if wait, action := rl.Allow("tom", SEND_ONE); action != 0 || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("want the second message delayed ~100ms but got wait '%v' action '%d'", wait, action)
+	}
+
+	rl.Allow("spammer", SEND_ONE)
+	if _, action := rl.Allow("spammer", SEND_ONE); action != RATE_DISCONNECT {
+		t.Fatalf("want action '%d' but got '%d'", RATE_DISCONNECT, action)
+	}
+
+	if c := rl.Counters(); c.Allowed != 5 || c.Rejected != 1 || c.Delayed != 1 || c.Disconnected != 1 {
+		t.Fatalf("unexpected counters %+v", c)
+	}
+	if c := rl.CommandCounters()[SEND_MANY]; c.Allowed != 3 || c.Rejected != 1 {
+		t.Fatalf("unexpected SEND_MANY counters %+v", c)
+	}
+
+	rl.SetIPLimit(RateLimit{Rate: 0.001, Burst: 1})
+	if _, action := rl.AllowIP("10.0.0.1"); action != 0 {
+		t.Fatalf("want the first connection allowed but got action '%d'", action)
+	}
+	if _, action := rl.AllowIP("10.0.0.1"); action != RATE_REJECT {
+		t.Fatalf("want action '%d' but got '%d'", RATE_REJECT, action)
+	}
+}
+
+func TestRateLimiterAllOrNothing(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.SetUserLimit(RateLimit{Rate: 0.001, Burst: 2})
+	rl.SetCommandLimit(SEND_MANY, RateLimit{Rate: 0.001, Burst: 1})
+	// the second SEND_MANY is rejected by the command limit, it costs no token of the user limit
+	for i, want := range []int{0, RATE_REJECT} {
+		if _, action := rl.Allow("tom", SEND_MANY); action != want {
+			t.Fatalf("message %d: want action '%d' but got '%d'", i, want, action)
+		}
+	}
+	if _, action := rl.Allow("tom", SEND_ONE); action != 0 {
+		t.Fatalf("want a token of the user left but got action '%d'", action)
+	}
+	if _, action := rl.Allow("tom", SEND_ONE); action != RATE_REJECT {
+		t.Fatalf("want the user limit reached but got action '%d'", action)
+	}
+
+	// a delay without MaxDelay is capped by DEFAULT_MAX_RATE_DELAY
+	rl.SetCommandLimit(SEND_ONE, RateLimit{Rate: 0.001, Burst: 1, Action: RATE_DELAY})
+	rl.Allow("jack", SEND_ONE)
+	if wait, action := rl.Allow("jack", SEND_ONE); action != RATE_REJECT {
+		t.Fatalf("want a wait over the default max rejected but got wait '%v' action '%d'", wait, action)
+	}
+}
@@ -1,12 +1,293 @@
 package wshelper
 
+import (
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"reflect"
+	"sort"
+	"sync"
+)
+
 const (
 	// chat message
 	REPLY_MESSAGE = 1 + iota
-	// notifications
+	// notifications, the text is Reply.Notice
 	REPLY_NOTIFY
 	// tips after send some message like 'Tom is offline. message will be received after he/she 's online'
 	REPLY_TIPS
-	// debug message showed in a specific message box
+	// debug message showed in a specific message box, sent only to connections in debug mode
 	REPLY_DEBUG
+	// the request failed, like a message too large
+	REPLY_ERROR
 )
+
+// reply types of applications start from it
+const REPLY_CUSTOM = 100
+
+// a kind of reply in the ReplyRegistry
+type ReplyKind struct {
+	Type int
+	Name string
+	// the struct carried in Reply.ReplyValue, like _json.Error{}, nil means untyped.
+	// for protobuf, register it to the Protobufer too
+	Payload interface{}
+	// structs by Reply.Desc, for a type carrying different ones, like the receipts of REPLY_NOTIFY. Payload is for other descs
+	Payloads map[string]interface{}
+	// sent only to connections in debug mode, like REPLY_DEBUG
+	DebugOnly bool
+}
+
+// handle a reply on the client side, payload is of the registered Payload type, or ReplyValue as it is if untyped
+type ReplyHandler func(reply _json.Reply, payload interface{}) error
+
+// reply types known by both sides. servers check replies sent by it, clients decode and dispatch replies by it
+type ReplyRegistry struct {
+	m        *sync.RWMutex
+	kinds    map[int]ReplyKind
+	handlers map[int]ReplyHandler
+}
+
+// new a registry with REPLY_MESSAGE, REPLY_NOTIFY, REPLY_TIPS, REPLY_DEBUG and REPLY_ERROR
+func NewReplyRegistry() *ReplyRegistry {
+	r := &ReplyRegistry{
+		m:        &sync.RWMutex{},
+		kinds:    make(map[int]ReplyKind),
+		handlers: make(map[int]ReplyHandler),
+	}
+	r.Register(ReplyKind{Type: REPLY_MESSAGE, Name: "message"})
+	r.Register(ReplyKind{Type: REPLY_NOTIFY, Name: "notify", Payloads: map[string]interface{}{
+		"delivered": _json.Receipt{},
+		"read":      _json.Receipt{},
+	}})
+	r.Register(ReplyKind{Type: REPLY_TIPS, Name: "tips"})
+	r.Register(ReplyKind{Type: REPLY_DEBUG, Name: "debug", DebugOnly: true})
+	r.Register(ReplyKind{Type: REPLY_ERROR, Name: "error", Payload: _json.Error{}})
+	return r
+}
+
+// the registered struct of a reply, nil means untyped
+func (kind ReplyKind) payloadOf(reply _json.Reply) interface{} {
+	if p, ok := kind.Payloads[reply.Desc]; ok {
+		return p
+	}
+	return kind.Payload
+}
+
+// register a reply type, applications use types from REPLY_CUSTOM on
+func (r *ReplyRegistry) Register(kind ReplyKind) error {
+	if kind.Type <= 0 {
+		return errorx.NewFromStringf("reply type should be positive but got '%d'", kind.Type)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if old, ok := r.kinds[kind.Type]; ok {
+		return errorx.NewFromStringf("reply type '%d' registered as '%s'", kind.Type, old.Name)
+	}
+	r.kinds[kind.Type] = kind
+	return nil
+}
+
+// get a reply type
+func (r *ReplyRegistry) Kind(replyType int) (ReplyKind, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	kind, ok := r.kinds[replyType]
+	return kind, ok
+}
+
+// all reply types in order
+func (r *ReplyRegistry) Kinds() []ReplyKind {
+	r.m.RLock()
+	rs := make([]ReplyKind, 0, len(r.kinds))
+	for _, kind := range r.kinds {
+		rs = append(rs, kind)
+	}
+	r.m.RUnlock()
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Type < rs[j].Type
+	})
+	return rs
+}
+
+// handle replies of a type on the client side
+func (r *ReplyRegistry) Handle(replyType int, f ReplyHandler) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.handlers[replyType] = f
+}
+
+// check a reply to send, its type should be registered and its ReplyValue of the registered Payload
+func (r *ReplyRegistry) check(reply _json.Reply) (ReplyKind, error) {
+	kind, ok := r.Kind(reply.ReplyType)
+	if !ok {
+		return kind, Errorf(ERR_BAD_REQUEST, "unknown reply type '%d'", reply.ReplyType)
+	}
+	payload := kind.payloadOf(reply)
+	if payload == nil || reply.ReplyValue == nil {
+		return kind, nil
+	}
+	if want, got := indirectType(reflect.TypeOf(payload)), indirectType(reflect.TypeOf(reply.ReplyValue)); want != got {
+		return kind, Errorf(ERR_BAD_REQUEST, "reply type '%s' wants a '%s' but got '%s'", kind.Name, want, got)
+	}
+	return kind, nil
+}
+
+// decode the body of a REPLY by m, the payload is decoded into the registered Payload type
+func (r *ReplyRegistry) Decode(m Marshaller, body []byte) (_json.Reply, interface{}, error) {
+	var reply _json.Reply
+	if e := m.Unmarshal(body, &reply); e != nil {
+		return reply, nil, errorx.Wrap(e)
+	}
+	if _, ok := r.Kind(reply.ReplyType); !ok {
+		return reply, nil, errorx.NewFromStringf("unknown reply type '%d'", reply.ReplyType)
+	}
+	payload, e := r.payload(m, reply)
+	return reply, payload, e
+}
+
+// the ReplyValue of a reply decoded by m into its registered struct, or as it is if untyped
+func (r *ReplyRegistry) payload(m Marshaller, reply _json.Reply) (interface{}, error) {
+	kind, _ := r.Kind(reply.ReplyType)
+	typ := kind.payloadOf(reply)
+	if typ == nil || reply.ReplyValue == nil {
+		return reply.ReplyValue, nil
+	}
+	// serializers decode interface{} as bytes or maps, which are decoded again into the payload
+	raw, ok := reply.ReplyValue.([]byte)
+	if !ok {
+		var e error
+		if raw, e = m.Marshal(reply.ReplyValue); e != nil {
+			return nil, errorx.Wrap(e)
+		}
+	}
+	payload := reflect.New(indirectType(reflect.TypeOf(typ)))
+	if e := m.Unmarshal(raw, payload.Interface()); e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	return payload.Elem().Interface(), nil
+}
+
+// decode the body of a REPLY and call the handler of its type, replies without handlers are ignored
+func (r *ReplyRegistry) Dispatch(m Marshaller, body []byte) error {
+	reply, payload, e := r.Decode(m, body)
+	if e != nil {
+		return e
+	}
+	r.m.RLock()
+	f, ok := r.handlers[reply.ReplyType]
+	r.m.RUnlock()
+	if !ok {
+		return nil
+	}
+	return f(reply, payload)
+}
+
+// the Reply in obj, if it's one
+func replyOf(obj interface{}) (_json.Reply, bool) {
+	switch v := obj.(type) {
+	case _json.Reply:
+		return v, true
+	case *_json.Reply:
+		if v != nil {
+			return *v, true
+		}
+	}
+	return _json.Reply{}, false
+}
+
+// whether obj is a Reply of a debug-only type
+func (r *ReplyRegistry) debugOnly(obj interface{}) bool {
+	reply, ok := replyOf(obj)
+	if !ok {
+		return false
+	}
+	kind, ok := r.Kind(reply.ReplyType)
+	return ok && kind.DebugOnly
+}
+
+// set a connection in debug mode or not, only connections in debug mode receive debug-only replies like REPLY_DEBUG
+func (cp *ConnectionPool) SetDebug(conn *websocket.Conn, on bool) {
+	if on {
+		cp.debug.Store(conn, struct{}{})
+		return
+	}
+	cp.debug.Delete(conn)
+}
+
+// whether a connection is in debug mode
+func (cp *ConnectionPool) IsDebug(conn *websocket.Conn) bool {
+	_, ok := cp.debug.Load(conn)
+	return ok
+}
+
+// whether obj is a Reply of a debug-only type
+func (wsh *WebSocketHelper) debugOnly(obj interface{}) bool {
+	return wsh.replies.debugOnly(obj)
+}
+
+// a frame packed from a debug-only reply starts with it, so writes know debug-only frames without decoding them.
+// the pool strips it on write, and skips the frame for connections not in debug mode and for offline users
+const DEBUG_FRAME_FLAG = '!'
+
+// strip off the debug flag of a frame if any
+func splitDebugFlag(data []byte) ([]byte, bool) {
+	if len(data) > 0 && data[0] == DEBUG_FRAME_FLAG {
+		return data[1:], true
+	}
+	return data, false
+}
+
+// whether the frame of obj is debug-only. a RELIABLE_MESSAGE carrying a debug-only frame is debug-only,
+// the flag moves from the frame inside to the envelope
+func (wsh *WebSocketHelper) packDebug(command int, obj interface{}) (interface{}, bool) {
+	switch command {
+	case REPLY:
+		return obj, wsh.debugOnly(obj)
+	case RELIABLE_MESSAGE:
+		var debug bool
+		switch v := obj.(type) {
+		case _json.Envelope:
+			v.Data, debug = splitDebugFlag(v.Data)
+			return v, debug
+		case *_json.Envelope:
+			if v != nil {
+				env := *v
+				env.Data, debug = splitDebugFlag(env.Data)
+				return &env, debug
+			}
+		}
+	}
+	return obj, false
+}
+
+// get the reply registry
+func (wsh *WebSocketHelper) Replies() *ReplyRegistry {
+	return wsh.replies
+}
+
+// register a reply type of the application:
+//
+//	const REPLY_SCORE = wshelper.REPLY_CUSTOM + 1
+//	wsh.RegisterReply(wshelper.ReplyKind{Type: REPLY_SCORE, Name: "score", Payload: Score{}})
+//	wsh.Push("tom", REPLY_SCORE, Score{Home: 1})
+func (wsh *WebSocketHelper) RegisterReply(kind ReplyKind) error {
+	return wsh.replies.Register(kind)
+}
+
+// dispatch a REPLY frame received by a client, decoded by wsh.Serializer:
+//
+//	wsh.Replies().Handle(REPLY_SCORE, func(reply _json.Reply, payload interface{}) error {
+//		score := payload.(Score)
+//		...
+//	})
+//	wsh.DispatchReply(frame)
+func (wsh *WebSocketHelper) DispatchReply(frame []byte) error {
+	if len(frame) < 32 || string(frame[:32]) != wsh.genCommandHash(REPLY) {
+		return errorx.NewFromString("not a REPLY frame")
+	}
+	wsh.M.RLock()
+	m := wsh.Serializer
+	wsh.M.RUnlock()
+	return wsh.replies.Dispatch(m, frame[32:])
+}
@@ -0,0 +1,108 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"testing"
+	"time"
+)
+
+type score struct {
+	Home int `json:"home"`
+	Away int `json:"away"`
+}
+
+func TestReplyRegistry(t *testing.T) {
+	const REPLY_SCORE = REPLY_CUSTOM + 1
+	wsh := NewWsHelper(nil)
+	e := wsh.RegisterReply(ReplyKind{Type: REPLY_SCORE, Name: "score", Payload: score{}})
+	util.Assertf(e == nil, t, "register: %v", e)
+	e = wsh.RegisterReply(ReplyKind{Type: REPLY_DEBUG, Name: "debug"})
+	util.Assertf(e != nil, t, "want a duplicated reply type rejected")
+
+	handleTestLogin(wsh, nil)
+	c := loginTest(t, wsh, newTestServer(t, wsh), "tom", "")
+
+	// the client dispatches replies by type with typed payloads
+	var got []interface{}
+	wsh.Replies().Handle(REPLY_SCORE, func(reply _json.Reply, payload interface{}) error {
+		got = append(got, payload)
+		return nil
+	})
+	wsh.Replies().Handle(REPLY_DEBUG, func(reply _json.Reply, payload interface{}) error {
+		got = append(got, reply.Debug)
+		return nil
+	})
+	r := wsh.Push("tom", REPLY_SCORE, score{Home: 2, Away: 1})
+	util.Assertf(r.State == PUSH_SENT, t, "bad result %+v", r)
+	e = wsh.DispatchReply(c.Receive())
+	util.Assertf(e == nil && len(got) == 1 && got[0] == score{Home: 2, Away: 1}, t, "bad dispatch %v %+v", e, got)
+	r = wsh.Push("tom", REPLY_SCORE, _json.Error{Message: "?"})
+	util.Assertf(r.State == PUSH_FAILED && r.Err != nil, t, "want a bad payload failed but got %+v", r)
+
+	// debug replies are skipped until the connection is in debug mode
+	r = wsh.Push("tom", REPLY_DEBUG, "cost 3ms")
+	util.Assertf(r.State == PUSH_SKIPPED, t, "want skipped but got %+v", r)
+	server, _ := wsh.pool.Get("tom")
+	e = wsh.Reply(server, REPLY, _json.Reply{ReplyType: REPLY_DEBUG, Debug: "cost 3ms"})
+	util.Assertf(e == nil, t, "reply: %v", e)
+	wsh.pool.SetDebug(server, true)
+	r = wsh.Push("tom", REPLY_DEBUG, "cost 4ms")
+	util.Assertf(r.State == PUSH_SENT, t, "want sent but got %+v", r)
+	e = wsh.DispatchReply(c.Receive())
+	util.Assertf(e == nil && len(got) == 2 && got[1] == "cost 4ms", t, "bad dispatch %v %+v", e, got)
+	n, _ := wsh.SendWhere(HasTag("none"), REPLY, _json.Reply{ReplyType: REPLY_DEBUG})
+	util.Assertf(n == 0, t, "want sent to none but got %d", n)
+}
+
+func TestDebugRepliesOnWritePath(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	store := NewMemoryOfflineStore(time.Hour)
+	wsh.EnableOffline(store)
+	d, cancel := wsh.EnableDelivery()
+	defer cancel()
+	handleTestLogin(wsh, nil)
+	c := loginTest(t, wsh, newTestServer(t, wsh), "tom", "")
+	server, _ := wsh.pool.Get("tom")
+
+	e := wsh.Reply(server, REPLY, _json.Reply{ReplyType: REPLY_CUSTOM + 99})
+	util.Assertf(e != nil, t, "want an unregistered reply type rejected")
+
+	debug := _json.Reply{ReplyType: REPLY_DEBUG, Debug: "cost 3ms"}
+	frame, _ := wsh.Pack(REPLY, debug)
+	envelope, _ := wsh.Pack(RELIABLE_MESSAGE, _json.Envelope{MsgId: "1", Data: frame})
+	// decided when packed, the flag moves from the frame to its envelope
+	var in _json.Envelope
+	util.Assertf(frame[0] == DEBUG_FRAME_FLAG && envelope[0] == DEBUG_FRAME_FLAG, t, "want debug-only frames flagged")
+	util.Assertf(wsh.CoreOf(envelope, &in) == nil && in.Data[0] != DEBUG_FRAME_FLAG, t, "want the flag off the frame inside")
+	send := func() {
+		util.Assertf(wsh.Send("tom", REPLY, debug) == nil, t, "send")
+		util.Assertf(wsh.SendFrame("tom", frame) == nil, t, "send frame")
+		util.Assertf(wsh.pool.SendOne(frame, "tom") == nil, t, "send one")
+		util.Assertf(wsh.pool.SendMany(frame, "tom") == nil, t, "send many")
+		util.Assertf(wsh.pool.SendOne(envelope, "tom") == nil, t, "send an envelope")
+		_, e := d.Send("", "tom", REPLY, debug)
+		util.Assertf(e == nil, t, "deliver: %v", e)
+		wsh.Send("tom", REPLY, _json.Reply{ReplyType: REPLY_NOTIFY, Notice: "end"})
+	}
+
+	// skipped on every path if tom is not in debug mode
+	send()
+	reply := c.Reply()
+	util.Assertf(reply.Notice == "end", t, "want debug replies skipped but got %+v", reply)
+	util.Assertf(wsh.Send("jack", REPLY, debug) == nil, t, "send to offline")
+	msgs, _ := store.List("jack")
+	util.Assertf(len(msgs) == 0, t, "want debug replies not saved offline but got %d", len(msgs))
+
+	wsh.pool.SetDebug(server, true)
+	send()
+	for i := 0; i < 4; i++ {
+		reply = c.Reply()
+		util.Assertf(reply.Debug == "cost 3ms", t, "want a debug reply but got %+v", reply)
+	}
+	util.Assertf(c.ReceiveInto(&in) == wsh.genCommandHash(RELIABLE_MESSAGE), t, "want the envelope")
+	reply = c.Reply()
+	util.Assertf(reply.Debug == "cost 3ms", t, "want a delivered debug reply but got %+v", reply)
+	reply = c.Reply()
+	util.Assertf(reply.Notice == "end", t, "want the end but got %+v", reply)
+}
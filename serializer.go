@@ -0,0 +1,249 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+// the query parameter to negotiate a serializer when Sec-WebSocket-Protocol is not usable, like ws://host/ws?serializer=protobuf
+const SERIALIZER_QUERY = "serializer"
+
+// register a marshaller which connections can negotiate by its TypeName(),
+// wsh.Serializer and Jsoner are registered on NewWsHelper
+func (wsh *WebSocketHelper) RegisterMarshaller(m Marshaller) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.marshallers[m.TypeName()] = m
+}
+
+// get a registered marshaller by type name
+func (wsh *WebSocketHelper) MarshallerByName(typeName string) (Marshaller, bool) {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	m, ok := wsh.marshallers[typeName]
+	return m, ok
+}
+
+// a websocket.Server handshake choosing the first registered serializer the client offers in Sec-WebSocket-Protocol.
+// offers not registered are ignored, if none is registered, no subprotocol is replied and the query parameter or wsh.Serializer takes effect.
+// a '?compress=' not registered is refused, so are ips over the rate limit
+func (wsh *WebSocketHelper) Handshake(config *websocket.Config, req *http.Request) error {
+	if e := wsh.limitIP(req); e != nil {
+		return e
+	}
+	if name := req.URL.Query().Get(COMPRESS_QUERY); name != "" {
+		wsh.M.RLock()
+		_, ok := wsh.compressors[name]
+		wsh.M.RUnlock()
+		if !ok {
+			return errorx.NewFromStringf("unsupported compressor '%s'", name)
+		}
+	}
+	for _, protocol := range config.Protocol {
+		if _, ok := wsh.MarshallerByName(protocol); ok {
+			config.Protocol = []string{protocol}
+			return nil
+		}
+	}
+	config.Protocol = nil
+	return nil
+}
+
+// a websocket.Server serving the dispatcher with serializer negotiation:
+//     http.Handle("/test-ws/", wsh.Server(f))
+func (wsh *WebSocketHelper) Server(handleE func(error)) websocket.Server {
+	return websocket.Server{
+		Handshake: wsh.Handshake,
+		Handler:   wsh.Dispatcher(handleE),
+	}
+}
+
+// decide the serializer of a new connection, by the subprotocol chosen in Handshake, then the query parameter, then wsh.Serializer
+func (wsh *WebSocketHelper) negotiate(conn *websocket.Conn) Marshaller {
+	if config := conn.Config(); config != nil && len(config.Protocol) == 1 {
+		if m, ok := wsh.MarshallerByName(config.Protocol[0]); ok {
+			return m
+		}
+	}
+	if req := conn.Request(); req != nil {
+		if m, ok := wsh.MarshallerByName(req.URL.Query().Get(SERIALIZER_QUERY)); ok {
+			return m
+		}
+	}
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.Serializer
+}
+
+// get the serializer of a connection, wsh.Serializer if it's not served by the dispatcher
+func (wsh *WebSocketHelper) SerializerOf(conn *websocket.Conn) Marshaller {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	if m, ok := wsh.connSerializers[conn]; ok {
+		return m
+	}
+	return wsh.Serializer
+}
+
+func (wsh *WebSocketHelper) setSerializer(conn *websocket.Conn, m Marshaller) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	if m == nil {
+		delete(wsh.connSerializers, conn)
+		return
+	}
+	wsh.connSerializers[conn] = m
+}
+
+// pack an object for a connection with its serializer
+func (wsh *WebSocketHelper) PackFor(conn *websocket.Conn, command int, obj interface{}) ([]byte, error) {
+	m := wsh.SerializerOf(conn)
+	obj, debug := wsh.packDebug(command, obj)
+	body, e := m.Marshal(obj)
+	if e != nil {
+		wsh.metricsOf().serializerError(m)
+		return nil, errorx.New(e)
+	}
+	return packFrame(wsh.genCommandHash(command), body, debug), nil
+}
+
+// the command hash and the body, with the debug flag first if debug-only
+func packFrame(hash string, body []byte, debug bool) []byte {
+	buf := make([]byte, 0, 1+len(hash)+len(body))
+	if debug {
+		buf = append(buf, DEBUG_FRAME_FLAG)
+	}
+	return append(append(buf, hash...), body...)
+}
+
+// get the core struct from the raw bytes of a handler, decoded by the serializer of the connection
+func (wsh *WebSocketHelper) CoreFrom(cache map[string]interface{}, buf []byte, dest interface{}) error {
+	// decoded before the handler, like by the order key of SEND_ONE
+	if core, ok := cache[cacheCore].(decodedCore); ok && core.of(buf) && reflect.TypeOf(core.v) == reflect.TypeOf(dest) {
+		reflect.ValueOf(dest).Elem().Set(reflect.ValueOf(core.v).Elem())
+		return nil
+	}
+	m := wsh.SerializerOf(ConnOf(cache))
+	_, span := StartSpan(ContextOf(cache), SPAN_UNMARSHAL)
+	defer span.End()
+	span.SetAttributes("serializer", m.TypeName(), "bytes", len(buf)-32)
+	if e := m.Unmarshal(buf[32:], dest); e != nil {
+		span.RecordError(e)
+		wsh.metricsOf().serializerError(m)
+		return e
+	}
+	return nil
+}
+
+// set the model struct of a command, so that its messages can be re-encoded between serializers.
+// SEND_ONE, REPLY, RELIABLE_MESSAGE and OFFLINE_MESSAGE are set on NewWsHelper
+func (wsh *WebSocketHelper) SetCommandModel(command int, model interface{}) {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.commandModels[wsh.genCommandHash(command)] = t
+}
+
+// re-encode a packed message from a serializer to another.
+// messages of commands without a model are returned as they are. RELIABLE_MESSAGE and OFFLINE_MESSAGE carry a message inside,
+// which is re-encoded too. the ReplyValue of a REPLY is decoded into the payload registered for its reply type first,
+// untyped ReplyValues and other interface{} fields may not survive between serializers, like a map to protobuf
+func (wsh *WebSocketHelper) Transcode(buf []byte, from Marshaller, to Marshaller) ([]byte, error) {
+	frame, debug := splitDebugFlag(buf)
+	if len(frame) < 32 || from.TypeName() == to.TypeName() {
+		return buf, nil
+	}
+	buf = frame
+	wsh.M.RLock()
+	t, ok := wsh.commandModels[string(buf[:32])]
+	wsh.M.RUnlock()
+	if !ok {
+		return buf, nil
+	}
+
+	dest := reflect.New(t).Interface()
+	if e := from.Unmarshal(buf[32:], dest); e != nil {
+		wsh.metricsOf().serializerError(from)
+		return nil, errorx.Wrap(e)
+	}
+	var e error
+	switch inner := dest.(type) {
+	case *_json.Envelope:
+		inner.Data, e = wsh.Transcode(inner.Data, from, to)
+	case *_json.OfflineMessage:
+		inner.Data, e = wsh.Transcode(inner.Data, from, to)
+	case *_json.Reply:
+		inner.ReplyValue, e = wsh.replies.payload(from, *inner)
+	}
+	if e != nil {
+		return nil, errorx.Wrap(e)
+	}
+	body, e := to.Marshal(dest)
+	if e != nil {
+		wsh.metricsOf().serializerError(to)
+		return nil, errorx.Wrap(e)
+	}
+	return packFrame(string(buf[:32]), body, debug), nil
+}
+
+// send a message packed by wsh.Serializer to a user, it's re-encoded for the serializer of the user's connection.
+// if the user is offline, it's saved as it is
+func (wsh *WebSocketHelper) SendFrame(to string, buf []byte) error {
+	conn, ok := wsh.pool.Get(to)
+	if !ok {
+		return wsh.pool.SendOne(buf, to)
+	}
+	wsh.M.RLock()
+	from := wsh.Serializer
+	wsh.M.RUnlock()
+	buf, e := wsh.Transcode(buf, from, wsh.SerializerOf(conn))
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	return wsh.pool.SendOne(buf, to)
+}
+
+// pack an object and send it to a user with the serializer of the user's connection,
+// so it's not re-encoded. if the user is offline, it's saved as packed by wsh.Serializer
+func (wsh *WebSocketHelper) Send(to string, command int, obj interface{}) error {
+	if conn, ok := wsh.pool.Get(to); ok {
+		buf, e := wsh.PackFor(conn, command, obj)
+		if e != nil {
+			return errorx.Wrap(e)
+		}
+		// the connection is closing, the user is regarded as offline
+		if e = wsh.pool.Write(conn, buf); e != io.EOF {
+			return e
+		}
+	}
+	buf, e := wsh.Pack(command, obj)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	return wsh.pool.saveOffline(buf, to)
+}
+
+// forward the raw bytes a handler received to users, re-encoded from the sender's serializer for each of them
+func (wsh *WebSocketHelper) Forward(cache map[string]interface{}, rawBytes []byte, tos ...string) error {
+	wsh.M.RLock()
+	canonical := wsh.Serializer
+	wsh.M.RUnlock()
+	buf, e := wsh.Transcode(rawBytes, wsh.SerializerOf(ConnOf(cache)), canonical)
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	var errors = make([]error, 0, len(tos))
+	for _, to := range tos {
+		if e = wsh.SendFrame(to, buf); e != nil {
+			errors = append(errors, e)
+		}
+	}
+	return errorx.GroupErrors(errors...)
+}
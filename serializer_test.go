@@ -0,0 +1,121 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/model/protobuf"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a json client and a protobuf client share the same server
+func TestSerializerNegotiation(t *testing.T) {
+	const LOGIN = 1000
+	wsh := NewWsHelper(nil)
+	wsh.RegisterMarshaller(NewProtobufer())
+	wsh.HandleFunc(LOGIN, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return e
+		}
+		wsh.Online(in.From, ConnOf(cache))
+		return wsh.Reply(ConnOf(cache), LOGIN, in)
+	})
+	wsh.HandleFunc(SEND_ONE, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return e
+		}
+		return wsh.Forward(cache, rawBytes, in.To)
+	})
+	server := wsh.Server(func(e error) { t.Error(e.Error()) })
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	dial := func(url string, protocol string, m Marshaller, key string) *websocket.Conn {
+		config, e := websocket.NewConfig(url, ts.URL)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		if protocol != "" {
+			config.Protocol = []string{"xml", protocol}
+		}
+		conn, e := websocket.DialConfig(config)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		body, _ := m.Marshal(&_json.SendOne{From: key})
+		websocket.Message.Send(conn, append([]byte(wsh.genCommandHash(LOGIN)), body...))
+		var buf []byte
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if e = websocket.Message.Receive(conn, &buf); e != nil {
+			t.Fatal(e.Error())
+		}
+		return conn
+	}
+	pb := NewProtobufer()
+	jsonConn := dial(url+"?serializer=json", "", Jsoner{}, "web")
+	defer jsonConn.Close()
+	pbConn := dial(url, "protobuf", pb, "native")
+	defer pbConn.Close()
+	if pbConn.Config().Protocol[0] != "protobuf" {
+		t.Fatalf("want subprotocol protobuf but got %v", pbConn.Config().Protocol)
+	}
+
+	body, _ := Jsoner{}.Marshal(_json.SendOne{From: "web", To: "native", Message: "hi"})
+	websocket.Message.Send(jsonConn, append([]byte(wsh.genCommandHash(SEND_ONE)), body...))
+
+	var buf []byte
+	pbConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if e := websocket.Message.Receive(pbConn, &buf); e != nil {
+		t.Fatal(e.Error())
+	}
+	var got _protobuf.SendOne
+	if e := pb.Unmarshal(buf[32:], &got); e != nil {
+		t.Fatal(e.Error())
+	}
+	if got.From != "web" || got.Message != "hi" {
+		t.Fatalf("bad message %+v", &got)
+	}
+}
+
+// typed ReplyValues packed by json are decoded into their payloads before re-encoded for protobuf
+func TestTranscodeReplyValue(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	pb := NewProtobufer()
+	at := time.Now().UTC()
+	for _, reply := range []_json.Reply{
+		{ReplyType: REPLY_ERROR, ReplyValue: _json.Error{Code: ERR_NOT_FOUND, Message: "no such user"}},
+		{ReplyType: REPLY_NOTIFY, Desc: "read", ReplyValue: _json.Receipt{MsgId: "m1", To: "bob", State: RECEIPT_READ, At: at}},
+		{ReplyType: REPLY_NOTIFY, Notice: "untyped without a value"},
+	} {
+		buf, e := wsh.Pack(REPLY, reply)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		buf, e = wsh.Transcode(buf, Jsoner{}, pb)
+		if e != nil {
+			t.Fatalf("transcode %+v: %s", reply, e.Error())
+		}
+		got, payload, e := wsh.Replies().Decode(pb, buf[32:])
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		if got.ReplyType != reply.ReplyType || got.Desc != reply.Desc || got.Notice != reply.Notice {
+			t.Fatalf("want %+v but got %+v", reply, got)
+		}
+		switch want := reply.ReplyValue.(type) {
+		case _json.Error:
+			if v, ok := payload.(_json.Error); !ok || v.Code != want.Code || v.Message != want.Message {
+				t.Fatalf("want %+v but got %#v", want, payload)
+			}
+		case _json.Receipt:
+			if v, ok := payload.(_json.Receipt); !ok || v.MsgId != want.MsgId || v.State != want.State || !v.At.Equal(want.At) {
+				t.Fatalf("want %+v but got %#v", want, payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package wshelper
+
+import (
+	"context"
+	"github.com/fwhezfwhez/errorx"
+	"github.com/spf13/viper"
+	"os"
+	"time"
+)
+
+// Settings are the options changeable while the server is running, by UpdateSettings, ReloadSettings or WatchSettings
+type Settings struct {
+	MaxOnlineConn     int           `json:"max_online_conn"`
+	MaxPayloadBytes   int           `json:"max_payload_bytes"`
+	CompressThreshold int           `json:"compress_threshold"`
+	HeartbeatTimeout  time.Duration `json:"heartbeat_timeout"` // nanoseconds
+	UserRate          float64       `json:"user_rate"`
+	UserBurst         int           `json:"user_burst"`
+	IPRate            float64       `json:"ip_rate"`
+	IPBurst           int           `json:"ip_burst"`
+}
+
+func settingsOf(o Options) Settings {
+	return Settings{
+		MaxOnlineConn:     o.MaxOnlineConn,
+		MaxPayloadBytes:   o.MaxPayloadBytes,
+		CompressThreshold: o.CompressThreshold,
+		HeartbeatTimeout:  o.HeartbeatTimeout,
+		UserRate:          o.UserRate,
+		UserBurst:         o.UserBurst,
+		IPRate:            o.IPRate,
+		IPBurst:           o.IPBurst,
+	}
+}
+
+func (s Settings) applyTo(o *Options) {
+	o.MaxOnlineConn = s.MaxOnlineConn
+	o.MaxPayloadBytes = s.MaxPayloadBytes
+	o.CompressThreshold = s.CompressThreshold
+	o.HeartbeatTimeout = s.HeartbeatTimeout
+	o.UserRate = s.UserRate
+	o.UserBurst = s.UserBurst
+	o.IPRate = s.IPRate
+	o.IPBurst = s.IPBurst
+}
+
+// check the settings are usable
+func (s Settings) Validate() error {
+	var errors []error
+	if s.MaxOnlineConn <= 0 {
+		errors = append(errors, errorx.NewFromStringf("max online conn should be positive but got '%d'", s.MaxOnlineConn))
+	}
+	if s.MaxPayloadBytes <= 0 {
+		errors = append(errors, errorx.NewFromStringf("max payload bytes should be positive but got '%d'", s.MaxPayloadBytes))
+	}
+	if s.CompressThreshold < 0 {
+		errors = append(errors, errorx.NewFromStringf("compress threshold should not be negative but got '%d'", s.CompressThreshold))
+	}
+	if s.HeartbeatTimeout != 0 && s.HeartbeatTimeout < 100*time.Millisecond {
+		errors = append(errors, errorx.NewFromStringf("heartbeat timeout should be 0 or at least 100ms but got '%v'", s.HeartbeatTimeout))
+	}
+	if s.UserRate < 0 || s.IPRate < 0 {
+		errors = append(errors, errorx.NewFromStringf("rates should not be negative but got '%v' and '%v'", s.UserRate, s.IPRate))
+	}
+	if s.UserRate > 0 && s.UserBurst < 1 {
+		errors = append(errors, errorx.NewFromStringf("user burst should be at least 1 but got '%d'", s.UserBurst))
+	}
+	if s.IPRate > 0 && s.IPBurst < 1 {
+		errors = append(errors, errorx.NewFromStringf("ip burst should be at least 1 but got '%d'", s.IPBurst))
+	}
+	if len(errors) == 0 {
+		return nil
+	}
+	return errorx.GroupErrors(errors...)
+}
+
+// get the current settings
+func (wsh *WebSocketHelper) Settings() Settings {
+	return settingsOf(wsh.Options())
+}
+
+// add a validator rejecting settings the application can't run with, in addition to Settings.Validate
+func (wsh *WebSocketHelper) AddSettingsValidator(f func(s Settings) error) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.settingsValidators = append(wsh.settingsValidators, f)
+}
+
+// call f after settings are changed
+func (wsh *WebSocketHelper) OnSettingsChange(f func(old Settings, new Settings)) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.settingsCallbacks = append(wsh.settingsCallbacks, f)
+}
+
+// validate and apply settings to the running server, bad settings are rejected and nothing is changed.
+// connections online take the new payload limit and heartbeat timeout from their next message
+func (wsh *WebSocketHelper) UpdateSettings(s Settings) error {
+	if e := s.Validate(); e != nil {
+		return errorx.Wrap(e)
+	}
+	wsh.M.RLock()
+	validators := wsh.settingsValidators
+	wsh.M.RUnlock()
+	for _, validate := range validators {
+		if e := validate(s); e != nil {
+			return errorx.Wrap(e)
+		}
+	}
+
+	wsh.settingsM.Lock()
+	defer wsh.settingsM.Unlock()
+	wsh.M.Lock()
+	old := settingsOf(wsh.options)
+	if old == s {
+		wsh.M.Unlock()
+		return nil
+	}
+	s.applyTo(&wsh.options)
+	rl := wsh.rateLimiter
+	callbacks := wsh.settingsCallbacks
+	wsh.M.Unlock()
+
+	wsh.pool.SetMaxOnline(s.MaxOnlineConn)
+	wsh.pool.SetCompressThreshold(s.CompressThreshold)
+	if s.HeartbeatTimeout > 0 {
+		wsh.HandleFunc(HEARTBEAT, wsh.handleHeartbeat)
+	}
+	if rl != nil {
+		rl.SetUserLimit(RateLimit{Rate: s.UserRate, Burst: s.UserBurst})
+		rl.SetIPLimit(RateLimit{Rate: s.IPRate, Burst: s.IPBurst})
+	}
+	wsh.Logger().Info("settings changed", "old", old, "new", s)
+	for _, f := range callbacks {
+		f(old, s)
+	}
+	return nil
+}
+
+// update settings from a yaml file like config.yaml and the environment, keys not set keep their current values
+func (wsh *WebSocketHelper) ReloadSettings(path string) error {
+	v := viper.New()
+	v.SetEnvPrefix(ENV_PREFIX)
+	v.AutomaticEnv()
+	v.SetConfigFile(path)
+	if e := v.ReadInConfig(); e != nil {
+		return errorx.NewFromStringf("read config '%s': %s", path, e.Error())
+	}
+	o, e := optionsFrom(v, wsh.Options())
+	if e != nil {
+		return errorx.Wrap(e)
+	}
+	return wsh.UpdateSettings(settingsOf(o))
+}
+
+// reload settings when the file is modified, checked every interval. bad settings are logged and skipped,
+// the server keeps running with the current ones. the watcher can be stopped by the returned cancel func
+func (wsh *WebSocketHelper) WatchSettings(path string, interval time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func(ctx context.Context) {
+		var modified time.Time
+		if info, e := os.Stat(path); e == nil {
+			modified = info.ModTime()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				info, e := os.Stat(path)
+				if e != nil || !info.ModTime().After(modified) {
+					continue
+				}
+				modified = info.ModTime()
+				if e = wsh.ReloadSettings(path); e != nil {
+					wsh.Logger().Warn("reload settings", "path", path, "error", e)
+				}
+			}
+		}
+	}(ctx)
+	return cancel
+}
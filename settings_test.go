@@ -0,0 +1,97 @@
+package wshelper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateSettings(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	rl, cancel := wsh.EnableRateLimit()
+	defer cancel()
+	var changes []Settings
+	wsh.OnSettingsChange(func(old Settings, new Settings) {
+		changes = append(changes, old, new)
+	})
+	wsh.AddSettingsValidator(func(s Settings) error {
+		if s.MaxOnlineConn > 100000 {
+			return errors.New("too many connections for this host")
+		}
+		return nil
+	})
+
+	before := wsh.Settings()
+	for _, bad := range []Settings{
+		{MaxOnlineConn: 0, MaxPayloadBytes: 1024},
+		{MaxOnlineConn: 10, MaxPayloadBytes: 1024, UserRate: 1},
+		{MaxOnlineConn: 10, MaxPayloadBytes: 1024, HeartbeatTimeout: time.Millisecond},
+		{MaxOnlineConn: 200000, MaxPayloadBytes: 1024},
+	} {
+		if e := wsh.UpdateSettings(bad); e == nil {
+			t.Fatalf("want settings %+v rejected", bad)
+		}
+	}
+	if wsh.Settings() != before || len(changes) != 0 {
+		t.Fatal("want nothing changed by bad settings")
+	}
+
+	s := before
+	s.MaxOnlineConn = 10
+	s.MaxPayloadBytes = 2 * KB
+	s.HeartbeatTimeout = time.Minute
+	s.UserRate, s.UserBurst = 0.001, 1
+	if e := wsh.UpdateSettings(s); e != nil {
+		t.Fatal(e.Error())
+	}
+	if len(changes) != 2 || changes[0] != before || changes[1] != s {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if wsh.pool.MaxOnline() != 10 || wsh.PayloadLimitOf(SEND_ONE) != 2*KB || wsh.GetCommand(wsh.genCommandHash(HEARTBEAT)) != HEARTBEAT {
+		t.Fatal("want settings applied")
+	}
+	rl.Allow("tom", SEND_ONE)
+	if _, action := rl.Allow("tom", SEND_ONE); action != RATE_REJECT {
+		t.Fatalf("want the new user limit applied but got action '%d'", action)
+	}
+}
+
+func TestWatchSettings(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wshelper")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte("maxOnlineConnPerPool: 100\n"), 0644)
+
+	wsh := NewWsHelper(nil)
+	changed := make(chan Settings, 1)
+	wsh.OnSettingsChange(func(old Settings, new Settings) {
+		changed <- new
+	})
+	cancel := wsh.WatchSettings(path, 20*time.Millisecond)
+	defer cancel()
+
+	// a bad value is skipped
+	ioutil.WriteFile(path, []byte("maxOnlineConnPerPool: -1\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	time.Sleep(100 * time.Millisecond)
+	if wsh.Settings().MaxOnlineConn != DefaultOptions().MaxOnlineConn {
+		t.Fatalf("want the bad value skipped but got %d", wsh.Settings().MaxOnlineConn)
+	}
+
+	ioutil.WriteFile(path, []byte("maxOnlineConnPerPool: 100\nmaxPayloadBytes: 512\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(3*time.Second))
+	select {
+	case s := <-changed:
+		if s.MaxOnlineConn != 100 || s.MaxPayloadBytes != 512 {
+			t.Fatalf("unexpected settings %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("want settings reloaded")
+	}
+}
@@ -0,0 +1,216 @@
+package wshelper
+
+import (
+	"github.com/fwhezfwhez/errorx"
+	"golang.org/x/net/websocket"
+	"io"
+	"sync"
+)
+
+// attributes of a connection online, like "region": "eu" or "role": "admin"
+type Tags map[string]string
+
+// whether a connection online matches, tags are read-only
+type Predicate func(key string, tags Tags) bool
+
+// connections whose tag name is value
+func TagIs(name string, value string) Predicate {
+	return func(key string, tags Tags) bool {
+		v, ok := tags[name]
+		return ok && v == value
+	}
+}
+
+// connections having the tag name
+func HasTag(name string) Predicate {
+	return func(key string, tags Tags) bool {
+		_, ok := tags[name]
+		return ok
+	}
+}
+
+// connections matching all predicates
+func And(ps ...Predicate) Predicate {
+	return func(key string, tags Tags) bool {
+		for _, p := range ps {
+			if !p(key, tags) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// connections matching any of predicates
+func Or(ps ...Predicate) Predicate {
+	return func(key string, tags Tags) bool {
+		for _, p := range ps {
+			if p(key, tags) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// set a tag of a connection, at login or by handlers. tags are dropped when the key of the connection is removed
+func (cp *ConnectionPool) SetTag(conn *websocket.Conn, name string, value string) {
+	cp.updateTags(conn, func(tags Tags) {
+		tags[name] = value
+	})
+}
+
+// set tags of a connection, merged with the tags set
+func (cp *ConnectionPool) SetTags(conn *websocket.Conn, tags Tags) {
+	cp.updateTags(conn, func(old Tags) {
+		for name, value := range tags {
+			old[name] = value
+		}
+	})
+}
+
+// remove a tag of a connection
+func (cp *ConnectionPool) RemoveTag(conn *websocket.Conn, name string) {
+	cp.updateTags(conn, func(tags Tags) {
+		delete(tags, name)
+	})
+}
+
+// get a tag of a connection
+func (cp *ConnectionPool) Tag(conn *websocket.Conn, name string) (string, bool) {
+	v, ok := cp.tagsOf(conn)[name]
+	return v, ok
+}
+
+// get a copy of tags of a connection
+func (cp *ConnectionPool) Tags(conn *websocket.Conn) Tags {
+	tags := cp.tagsOf(conn)
+	rs := make(Tags, len(tags))
+	for name, value := range tags {
+		rs[name] = value
+	}
+	return rs
+}
+
+// tags are copied on write, so they're read without locks
+func (cp *ConnectionPool) updateTags(conn *websocket.Conn, f func(tags Tags)) {
+	cp.tagsM.Lock()
+	defer cp.tagsM.Unlock()
+	tags := cp.Tags(conn)
+	f(tags)
+	cp.tags.Store(conn, tags)
+}
+
+// the tags of a connection, read-only
+func (cp *ConnectionPool) tagsOf(conn *websocket.Conn) Tags {
+	tags, _ := cp.tags.Load(conn)
+	rs, _ := tags.(Tags)
+	return rs
+}
+
+// keys online matching the predicate
+func (cp *ConnectionPool) Select(where Predicate) []string {
+	var rs []string
+	cp.Range(func(key string, conn *websocket.Conn) bool {
+		if where(key, cp.tagsOf(conn)) {
+			rs = append(rs, key)
+		}
+		return true
+	})
+	return rs
+}
+
+// send msg to connections online matching the predicate, the number sent is returned.
+// eof is not regarded as error, since the connection is closing
+func (cp *ConnectionPool) SendWhere(where Predicate, data []byte) (int, error) {
+	return cp.sendWhere(where, nil, func(conn *websocket.Conn) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// send msg packed for each connection matching the predicate and accepted, nil accept accepts all
+func (cp *ConnectionPool) sendWhere(where Predicate, accept func(conn *websocket.Conn) bool, pack func(conn *websocket.Conn) ([]byte, error)) (int, error) {
+	var conns []*websocket.Conn
+	cp.Range(func(key string, conn *websocket.Conn) bool {
+		if (accept == nil || accept(conn)) && where(key, cp.tagsOf(conn)) {
+			conns = append(conns, conn)
+		}
+		return true
+	})
+	return cp.sendConns(conns, pack)
+}
+
+// send msg packed for each connection at the same time, the number sent is returned
+func (cp *ConnectionPool) sendConns(conns []*websocket.Conn, pack func(conn *websocket.Conn) ([]byte, error)) (int, error) {
+	var errors = make(chan error, len(conns))
+	var sent = make(chan struct{}, len(conns))
+	var wg = sync.WaitGroup{}
+	wg.Add(len(conns))
+	for _, conn := range conns {
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			data, e := pack(conn)
+			if e != nil {
+				errors <- errorx.Wrap(e)
+				return
+			}
+			if e = cp.Write(conn, data); e != nil {
+				if e != io.EOF {
+					errors <- errorx.New(e)
+				}
+				return
+			}
+			sent <- struct{}{}
+		}(conn)
+	}
+	wg.Wait()
+	close(errors)
+	var es []error
+	for e := range errors {
+		es = append(es, e)
+	}
+	if len(es) > 0 {
+		return len(sent), errorx.GroupErrors(es...)
+	}
+	return len(sent), nil
+}
+
+// pack an object and send it to connections online matching the predicate, with the serializer of each connection.
+// a REPLY of a debug-only type is sent only to connections in debug mode:
+//
+//	pool.SetTag(wshelper.ConnOf(cache), "region", "eu") // in a login handler
+//	wsh.SendWhere(wshelper.TagIs("region", "eu"), wshelper.REPLY, notice)
+func (wsh *WebSocketHelper) SendWhere(where Predicate, command int, obj interface{}) (int, error) {
+	var accept func(conn *websocket.Conn) bool
+	if command == REPLY && wsh.debugOnly(obj) {
+		accept = wsh.pool.IsDebug
+	}
+	return wsh.pool.sendWhere(where, accept, wsh.packerFor(command, func(m Marshaller) (interface{}, error) {
+		return obj, nil
+	}))
+}
+
+// pack the object of a serializer for connections, it's built and marshalled once for each serializer
+func (wsh *WebSocketHelper) packerFor(command int, objOf func(m Marshaller) (interface{}, error)) func(conn *websocket.Conn) ([]byte, error) {
+	var m sync.Mutex
+	packed := make(map[string][]byte)
+	return func(conn *websocket.Conn) ([]byte, error) {
+		serializer := wsh.SerializerOf(conn)
+		m.Lock()
+		defer m.Unlock()
+		if buf, ok := packed[serializer.TypeName()]; ok {
+			return buf, nil
+		}
+		obj, e := objOf(serializer)
+		if e != nil {
+			wsh.metricsOf().serializerError(serializer)
+			return nil, errorx.Wrap(e)
+		}
+		buf, e := wsh.PackFor(conn, command, obj)
+		if e != nil {
+			return nil, e
+		}
+		packed[serializer.TypeName()] = buf
+		return buf, nil
+	}
+}
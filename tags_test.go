@@ -0,0 +1,49 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendWhere(t *testing.T) {
+	wsh := NewWsHelper(nil)
+	handleTestLogin(wsh, func(in _json.SendOne, cache map[string]interface{}) {
+		// the region is sent as the message
+		wsh.pool.SetTags(ConnOf(cache), Tags{"region": in.Message})
+		if in.From == "admin" {
+			wsh.pool.SetTag(ConnOf(cache), "role", "admin")
+		}
+	})
+	ts := newTestServer(t, wsh)
+
+	clients := make(map[string]*testClient)
+	for user, region := range map[string]string{"tom": "eu", "bob": "us", "admin": "eu"} {
+		clients[user] = loginTest(t, wsh, ts, user, region)
+	}
+
+	keys := wsh.pool.Select(TagIs("region", "eu"))
+	sort.Strings(keys)
+	util.Assertf(strings.Join(keys, ",") == "admin,tom", t, "want admin,tom in eu but got %v", keys)
+	keys = wsh.pool.Select(And(TagIs("region", "eu"), HasTag("role")))
+	util.Assertf(strings.Join(keys, ",") == "admin", t, "want admin but got %v", keys)
+
+	sent, e := wsh.SendWhere(Or(TagIs("region", "us"), TagIs("role", "admin")), REPLY, _json.Reply{ReplyType: REPLY_NOTIFY, Notice: "hi"})
+	util.Assertf(e == nil && sent == 2, t, "want sent to 2 but got %d %v", sent, e)
+	for _, user := range []string{"bob", "admin"} {
+		reply := clients[user].Reply()
+		util.Assertf(reply.Notice == "hi", t, "bad notice to %s %+v", user, reply)
+	}
+	// tom is not matched
+	util.Assertf(clients["tom"].Silent(100*time.Millisecond), t, "tom should receive nothing")
+
+	info, _ := wsh.pool.ConnectionOf("admin")
+	util.Assertf(info.Tags["role"] == "admin", t, "want tags in info but got %v", info.Tags)
+	server, _ := wsh.pool.Get("admin")
+	wsh.pool.Remove("admin")
+	_, ok := wsh.pool.Tag(server, "role")
+	util.Assertf(!ok, t, "tags should be dropped on remove")
+}
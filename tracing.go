@@ -0,0 +1,323 @@
+package wshelper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"golang.org/x/net/websocket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a frame may start with a trace header, '@' and a w3c traceparent '00-<trace id>-<parent span id>-<flags>',
+// so that spans of the server are children of the client's. it goes before the command hash,
+// and the compression flag on a compressing connection, and is never compressed
+const (
+	TRACE_HEADER_FLAG = '@'
+	TRACE_HEADER_SIZE = 56
+)
+
+// span names of a dispatched frame, the frame span covers the rest
+const (
+	SPAN_FRAME     = "wshelper.frame"
+	SPAN_READ      = "wshelper.read"
+	SPAN_HANDLE    = "wshelper.handle"
+	SPAN_UNMARSHAL = "wshelper.unmarshal"
+	SPAN_SEND_MANY = "wshelper.send_many"
+	SPAN_WRITE     = "wshelper.write"
+)
+
+// ids of a span in hex, trace id of 32 and span id of 16
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// whether ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// a span of a tracer, ended once
+type Span interface {
+	// attributes as key-value pairs, like SetAttributes("command", 1, "bytes", 64)
+	SetAttributes(kvs ...interface{})
+	RecordError(e error)
+	SpanContext() SpanContext
+	End()
+}
+
+// a tracer starts spans, like NewRecorder() or the OTelTracer built with '-tags otel'
+type Tracer interface {
+	// start a span at 'start', as a child of the span in ctx, or of the remote parent in ctx, or a root.
+	// the returned ctx is what the tracer needs for children, StartSpan puts the span into it
+	Start(ctx context.Context, name string, start time.Time) (context.Context, Span)
+}
+
+// traces nothing, the default
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(kvs ...interface{}) {}
+func (nopSpan) RecordError(e error)              {}
+func (nopSpan) SpanContext() SpanContext         { return SpanContext{} }
+func (nopSpan) End()                             {}
+
+type tracerKey struct{}
+type spanKey struct{}
+type remoteParentKey struct{}
+
+// the tracer StartSpan uses
+func ContextWithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// the tracer in ctx, NopTracer if none
+func TracerFromContext(ctx context.Context) Tracer {
+	if t, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return t
+	}
+	return NopTracer{}
+}
+
+// put a span into ctx as the parent of spans started from it
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// the span in ctx, a no-op span if none
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
+
+// put the span of the other side, like the client's, into ctx
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey{}, sc)
+}
+
+// the span of the other side in ctx
+func RemoteParentOf(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(remoteParentKey{}).(SpanContext)
+	return sc, ok
+}
+
+// start a span by the tracer in ctx, it's a no-op without a tracer. handlers trace their own work by it:
+//
+//	ctx, span := wshelper.StartSpan(wshelper.ContextOf(cache), "dao.members")
+//	members, e := dao.Members(group)
+//	span.End()
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return startSpan(ctx, name, time.Now())
+}
+
+func startSpan(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	t := TracerFromContext(ctx)
+	if _, ok := t.(NopTracer); ok {
+		return ctx, nopSpan{}
+	}
+	ctx, span := t.Start(ctx, name, start)
+	return ContextWithSpan(ctx, span), span
+}
+
+// the parent ids of a span started from ctx, the local span goes before the remote one
+func parentOf(ctx context.Context) SpanContext {
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		return sc
+	}
+	sc, _ := RemoteParentOf(ctx)
+	return sc
+}
+
+// get the context of the frame a handler is serving, it carries the handler span
+func ContextOf(cache map[string]interface{}) context.Context {
+	if ctx, ok := cache[CACHE_CONTEXT].(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// start the span of a frame with its read span, both start when the frame arrived
+func (wsh *WebSocketHelper) startFrameSpan(conn *websocket.Conn, raw []byte, parent SpanContext, received time.Time) (context.Context, Span) {
+	ctx := ContextWithTracer(context.Background(), wsh.Tracer())
+	if parent.IsValid() {
+		ctx = ContextWithRemoteParent(ctx, parent)
+	}
+	ctx, span := startSpan(ctx, SPAN_FRAME, received)
+	span.SetAttributes("command", wsh.CommandOf(raw), "bytes", len(raw))
+	if key, ok := wsh.pool.KeyOf(conn); ok {
+		span.SetAttributes("key", key)
+	}
+	_, read := startSpan(ctx, SPAN_READ, received)
+	read.End()
+	return ctx, span
+}
+
+// set the tracer, nil means NopTracer
+func (wsh *WebSocketHelper) SetTracer(t Tracer) {
+	if t == nil {
+		t = NopTracer{}
+	}
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	wsh.options.Tracer = t
+}
+
+// get the tracer
+func (wsh *WebSocketHelper) Tracer() Tracer {
+	wsh.M.RLock()
+	defer wsh.M.RUnlock()
+	return wsh.options.Tracer
+}
+
+// prefix a frame with the trace header of a span, clients use it to link their spans with the server's
+func WithTraceHeader(frame []byte, sc SpanContext) []byte {
+	buf := make([]byte, 0, TRACE_HEADER_SIZE+len(frame))
+	buf = append(buf, TRACE_HEADER_FLAG)
+	buf = append(buf, "00-"+sc.TraceID+"-"+sc.SpanID+"-01"...)
+	return append(buf, frame...)
+}
+
+// strip off the trace header of a frame if any
+func splitTraceHeader(buf []byte) (SpanContext, []byte, error) {
+	if len(buf) == 0 || buf[0] != TRACE_HEADER_FLAG {
+		return SpanContext{}, buf, nil
+	}
+	if len(buf) < TRACE_HEADER_SIZE {
+		return SpanContext{}, nil, Errorf(ERR_BAD_REQUEST, "trace header should be '%d' bytes but got '%d'", TRACE_HEADER_SIZE, len(buf))
+	}
+	parts := strings.Split(string(buf[1:TRACE_HEADER_SIZE]), "-")
+	if len(parts) != 4 || parts[0] != "00" || !isHexID(parts[1], 32) || !isHexID(parts[2], 16) || len(parts[3]) != 2 {
+		return SpanContext{}, nil, Errorf(ERR_BAD_REQUEST, "bad trace header '%s'", buf[1:TRACE_HEADER_SIZE])
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2]}, buf[TRACE_HEADER_SIZE:], nil
+}
+
+// lower hex of length n, not all zero
+func isHexID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// a span ended by a Recorder
+type RecordedSpan struct {
+	Name string
+	SpanContext
+	// span id of the parent, empty for a root
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// a tracer keeping spans in memory, for tests
+type Recorder struct {
+	m     *sync.Mutex
+	spans []RecordedSpan
+}
+
+// new a recorder
+func NewRecorder() *Recorder {
+	return &Recorder{m: &sync.Mutex{}}
+}
+
+// start a span
+func (r *Recorder) Start(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	parent := parentOf(ctx)
+	s := &recorderSpan{r: r, m: &sync.Mutex{}}
+	s.span = RecordedSpan{
+		Name:        name,
+		SpanContext: SpanContext{TraceID: parent.TraceID, SpanID: randomID(8)},
+		ParentID:    parent.SpanID,
+		Start:       start,
+		Attributes:  make(map[string]interface{}),
+	}
+	if s.span.TraceID == "" {
+		s.span.TraceID = randomID(16)
+	}
+	return ctx, s
+}
+
+// spans ended, in the order they ended
+func (r *Recorder) Spans() []RecordedSpan {
+	r.m.Lock()
+	defer r.m.Unlock()
+	rs := make([]RecordedSpan, len(r.spans))
+	copy(rs, r.spans)
+	return rs
+}
+
+// drop spans recorded
+func (r *Recorder) Reset() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.spans = nil
+}
+
+type recorderSpan struct {
+	r     *Recorder
+	m     *sync.Mutex
+	span  RecordedSpan
+	ended bool
+}
+
+func (s *recorderSpan) SetAttributes(kvs ...interface{}) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i := 0; i < len(kvs); i += 2 {
+		key, _ := kvs[i].(string)
+		if i+1 < len(kvs) {
+			s.span.Attributes[key] = kvs[i+1]
+		} else {
+			s.span.Attributes[key] = "!MISSING"
+		}
+	}
+}
+
+func (s *recorderSpan) RecordError(e error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.span.Err = e
+}
+
+func (s *recorderSpan) SpanContext() SpanContext {
+	return s.span.SpanContext
+}
+
+func (s *recorderSpan) End() {
+	s.m.Lock()
+	if s.ended {
+		s.m.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.m.Unlock()
+
+	s.r.m.Lock()
+	defer s.r.m.Unlock()
+	s.r.spans = append(s.r.spans, span)
+}
@@ -0,0 +1,101 @@
+//go:build otel
+
+package wshelper
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// a Tracer by an opentelemetry tracer, build with '-tags otel':
+//
+//	wsh.SetTracer(wshelper.NewOTelTracer(otel.Tracer("wshelper")))
+type OTelTracer struct {
+	T trace.Tracer
+}
+
+// new an OTelTracer
+func NewOTelTracer(t trace.Tracer) OTelTracer {
+	return OTelTracer{T: t}
+}
+
+// start a span, the remote parent in ctx becomes the otel remote span context
+func (o OTelTracer) Start(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		if parent, ok := RemoteParentOf(ctx); ok {
+			if sc, ok := otelSpanContext(parent); ok {
+				ctx = trace.ContextWithRemoteSpanContext(ctx, sc)
+			}
+		}
+	}
+	ctx, span := o.T.Start(ctx, name, trace.WithTimestamp(start))
+	return ctx, otelSpan{span}
+}
+
+func otelSpanContext(parent SpanContext) (trace.SpanContext, bool) {
+	traceID, e := trace.TraceIDFromHex(parent.TraceID)
+	if e != nil {
+		return trace.SpanContext{}, false
+	}
+	spanID, e := trace.SpanIDFromHex(parent.SpanID)
+	if e != nil {
+		return trace.SpanContext{}, false
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}), true
+}
+
+type otelSpan struct {
+	s trace.Span
+}
+
+func (o otelSpan) SetAttributes(kvs ...interface{}) {
+	attrs := make([]attribute.KeyValue, 0, len(kvs)/2+1)
+	for i := 0; i < len(kvs); i += 2 {
+		key := fmt.Sprintf("%v", kvs[i])
+		if i+1 >= len(kvs) {
+			attrs = append(attrs, attribute.String(key, "!MISSING"))
+			continue
+		}
+		switch v := kvs[i+1].(type) {
+		case string:
+			attrs = append(attrs, attribute.String(key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(key, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, v))
+		default:
+			attrs = append(attrs, attribute.String(key, fmt.Sprintf("%v", v)))
+		}
+	}
+	o.s.SetAttributes(attrs...)
+}
+
+func (o otelSpan) RecordError(e error) {
+	o.s.RecordError(e)
+	o.s.SetStatus(codes.Error, e.Error())
+}
+
+func (o otelSpan) SpanContext() SpanContext {
+	sc := o.s.SpanContext()
+	if !sc.IsValid() {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: sc.TraceID().String(), SpanID: sc.SpanID().String()}
+}
+
+func (o otelSpan) End() {
+	o.s.End()
+}
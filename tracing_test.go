@@ -0,0 +1,87 @@
+package wshelper
+
+import (
+	"eyas/wshelper/model/json"
+	"eyas/wshelper/util"
+	"testing"
+	"time"
+)
+
+func TestTracing(t *testing.T) {
+	const ECHO = 1000
+	recorder := NewRecorder()
+	wsh := NewWsHelper(nil, WithTracer(recorder))
+	wsh.HandleFunc(ECHO, func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error {
+		var in _json.SendOne
+		if e := wsh.CoreFrom(cache, rawBytes, &in); e != nil {
+			return NewError(ERR_BAD_REQUEST, "bad json")
+		}
+		_, span := StartSpan(ContextOf(cache), "dao.members")
+		span.End()
+		return wsh.ReplyContext(ContextOf(cache), ConnOf(cache), REPLY, _json.Reply{ReplyType: REPLY_MESSAGE})
+	})
+	c := dialTest(t, wsh, newTestServer(t, wsh), "")
+
+	client := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+	frame := append([]byte(wsh.genCommandHash(ECHO)), `{"message":"hi"}`...)
+	c.SendFrame(WithTraceHeader(frame, client))
+	c.Reply()
+	time.Sleep(50 * time.Millisecond)
+
+	spans := make(map[string]RecordedSpan)
+	for _, span := range recorder.Spans() {
+		util.Assertf(span.TraceID == client.TraceID, t, "span '%s' not in the client's trace", span.Name)
+		spans[span.Name] = span
+	}
+	parents := map[string]string{
+		SPAN_FRAME:     client.SpanID,
+		SPAN_READ:      spans[SPAN_FRAME].SpanID,
+		SPAN_HANDLE:    spans[SPAN_FRAME].SpanID,
+		SPAN_UNMARSHAL: spans[SPAN_HANDLE].SpanID,
+		"dao.members":  spans[SPAN_HANDLE].SpanID,
+		SPAN_WRITE:     spans[SPAN_HANDLE].SpanID,
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		util.Assertf(ok, t, "want span '%s'", name)
+		util.Assertf(span.ParentID == parent, t, "span '%s' want parent '%s' but got '%s'", name, parent, span.ParentID)
+	}
+	util.Assertf(spans[SPAN_FRAME].Attributes["command"] == ECHO, t, "bad frame attributes %v", spans[SPAN_FRAME].Attributes)
+
+	// a bad trace header is replied as a bad request
+	c.SendFrame(append([]byte{TRACE_HEADER_FLAG}, frame...))
+	reply := c.Reply()
+	util.Assertf(reply.ReplyType == REPLY_ERROR, t, "want an error reply but got %+v", reply)
+}
+
+func TestTracingCompressed(t *testing.T) {
+	recorder := NewRecorder()
+	wsh := NewWsHelper(nil, WithTracer(recorder))
+	handleTestLogin(wsh, nil)
+	c := dialTest(t, wsh, newTestServer(t, wsh), "?"+COMPRESS_QUERY+"=deflate")
+
+	client := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+	body, e := Deflate{}.Compress([]byte(`{"from":"tom"}`))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	for _, frame := range [][]byte{
+		append(append([]byte(wsh.genCommandHash(TEST_LOGIN)), FLAG_RAW), `{"from":"tom"}`...),
+		append(append([]byte(wsh.genCommandHash(TEST_LOGIN)), Deflate{}.Flag()), body...),
+	} {
+		c.SendFrame(WithTraceHeader(frame, client))
+		buf := c.Receive()
+		var reply _json.Reply
+		wsh.Unmarshal(buf[33:], &reply)
+		util.Assertf(reply.ReplyType == REPLY_MESSAGE, t, "want the traced frame served but got %+v", reply)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var frames int
+	for _, span := range recorder.Spans() {
+		if span.Name == SPAN_FRAME {
+			util.Assertf(span.TraceID == client.TraceID && span.ParentID == client.SpanID, t, "frame span not in the client's trace %+v", span)
+			frames++
+		}
+	}
+	util.Assertf(frames == 2, t, "want 2 frame spans but got %d", frames)
+}
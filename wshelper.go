@@ -1,12 +1,19 @@
 package wshelper
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"eyas/wshelper/dao"
+	"eyas/wshelper/model/json"
 	"eyas/wshelper/util"
 	"fmt"
 	"github.com/fwhezfwhez/errorx"
 	"golang.org/x/net/websocket"
 	"io"
+	"log"
+	"net"
+	"reflect"
 	"strconv"
 	"sync"
 	"time"
@@ -19,6 +26,33 @@ const (
 	GB
 )
 
+// keys of the per-connection cache handed to command handlers
+const (
+	// *websocket.Conn the message comes from
+	CACHE_CONN = "conn"
+	// Marshaller negotiated by the connection
+	CACHE_SERIALIZER = "serializer"
+	// context.Context of the frame being served, get it by ContextOf
+	CACHE_CONTEXT = "context"
+	// *sync.Map shared by frames of the connection, get it by SharedOf
+	CACHE_SHARED = "shared"
+	// the core struct of the frame decoded before its handler, like by the order key of SEND_ONE, CoreFrom reuses it
+	cacheCore = "core"
+)
+
+// get the connection from the cache handed to command handlers
+func ConnOf(cache map[string]interface{}) *websocket.Conn {
+	conn, _ := cache[CACHE_CONN].(*websocket.Conn)
+	return conn
+}
+
+// get the values shared by frames of a connection from the cache handed to command handlers.
+// it's safe for handlers running at the same time when Options.Concurrency > 1, which get a copy of the cache
+func SharedOf(cache map[string]interface{}) *sync.Map {
+	shared, _ := cache[CACHE_SHARED].(*sync.Map)
+	return shared
+}
+
 type WebSocketHelper struct {
 	M *sync.RWMutex
 	// box all commands supported
@@ -31,10 +65,49 @@ type WebSocketHelper struct {
 	// a common function to handle error
 	handleE func(error)
 
-	// marshal and unmarshal message
+	// marshal and unmarshal message, the default of connections not negotiating a serializer
 	Serializer Marshaller
 	// save all connections online
 	pool *ConnectionPool
+	// chunked file transfer, nil until EnableFileTransfer
+	files *FileTransfer
+	// at-least-once delivery, nil until EnableDelivery
+	delivery *Delivery
+	// persisted messages, nil until EnableHistory
+	messages dao.MessageStore
+	// decides who may query the history of a group or a room, set by AuthorizeHistory
+	historyAuth HistoryAuthorizer
+	// topic subscriptions, nil until EnablePubSub
+	pubsub *PubSub
+
+	// marshallers connections can negotiate, by TypeName()
+	marshallers map[string]Marshaller
+	// the negotiated serializer of each connection
+	connSerializers map[*websocket.Conn]Marshaller
+	// command hash -> model struct, to re-encode messages between serializers
+	commandModels map[string]reflect.Type
+	// compressors connections can negotiate, by Name()
+	compressors map[string]Compressor
+	// command -> max body size, overriding maxPayload
+	payloadLimits map[int]int
+	// handlers of commands whose body is streamed
+	streamHandlers map[int]StreamHandler
+	// error code -> POLICY_CONTINUE or POLICY_CLOSE
+	errorPolicies map[int]int
+	// options of NewWsHelper, Settings and the logger can be changed later
+	options Options
+	// serializes UpdateSettings
+	settingsM          *sync.Mutex
+	settingsValidators []func(s Settings) error
+	settingsCallbacks  []func(old Settings, new Settings)
+	// nil until EnableMetrics
+	metrics *Metrics
+	// rate limits, nil until EnableRateLimit
+	rateLimiter *RateLimiter
+	// command -> order key, of commands handled in order when Options.Concurrency > 1
+	orderKeys map[int]OrderKeyFunc
+	// reply types known, REPLY_DEBUG and types registered by RegisterReply
+	replies *ReplyRegistry
 }
 
 type Marshaller interface {
@@ -64,19 +137,70 @@ func (j Jsoner) TypeName() string{
 
 // init a ws helper instance.
 // a serializer implementing wshelper.Marshaller should be correctly set whatever protobuf/xml/json.
-// if 'dest' is set nil, the default jsoner will be used
-func NewWsHelper(dest Marshaller) *WebSocketHelper {
+// if 'dest' is set nil, Options.Serializer or the default jsoner will be used, for protobuf use NewWsHelper(NewProtobufer()).
+// options are applied on DefaultOptions(), like NewWsHelper(nil, WithMaxPayload(1*MB), WithLogger(l)),
+// to load them from config.yaml and the environment:
+//
+//	opts, e := wshelper.LoadOptions("config.yaml")
+//	wsh := wshelper.NewWsHelper(nil, wshelper.WithOptions(opts))
+func NewWsHelper(dest Marshaller, opts ...Option) *WebSocketHelper {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if dest == nil {
+		dest = o.Serializer
+	}
+	if o.Logger == nil {
+		o.Logger = NopLogger{}
+	}
+	if o.Tracer == nil {
+		o.Tracer = NopTracer{}
+	}
+	if o.MaxPayloadBytes <= 0 {
+		o.MaxPayloadBytes = DEFAULT_MAX_PAYLOAD
+	}
 	wsh := &WebSocketHelper{
-		pool:        NewConnectionPool(),
+		pool:        NewShardedConnectionPool(o.PoolShards),
 		M:           &sync.RWMutex{},
 		Commands:    make([]int, 0, 10),
 		commandHash: make(map[string]int, 0),
 		handleE:     Panic,
+
+		commandHandleMapper: make(map[int]func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error),
+
+		marshallers:     make(map[string]Marshaller),
+		connSerializers: make(map[*websocket.Conn]Marshaller),
+		commandModels:   make(map[string]reflect.Type),
+		compressors:     make(map[string]Compressor),
+		payloadLimits:   make(map[int]int),
+		streamHandlers:  make(map[int]StreamHandler),
+		errorPolicies:   make(map[int]int),
+		orderKeys:       make(map[int]OrderKeyFunc),
+		replies:         NewReplyRegistry(),
+		settingsM:       &sync.Mutex{},
 	}
 	if dest == nil {
 		dest = Jsoner{}
 	}
+	o.Serializer = dest
+	wsh.options = o
 	wsh.Serializer = dest
+	wsh.RegisterMarshaller(Jsoner{})
+	wsh.RegisterMarshaller(dest)
+	wsh.SetCommandModel(SEND_ONE, _json.SendOne{})
+	wsh.SetCommandModel(REPLY, _json.Reply{})
+	wsh.SetCommandModel(RELIABLE_MESSAGE, _json.Envelope{})
+	wsh.SetCommandModel(OFFLINE_MESSAGE, _json.OfflineMessage{})
+	wsh.SetOrdered(SEND_ONE, wsh.sendOneOrderKey)
+	wsh.RegisterCompressor(Deflate{})
+	wsh.RegisterCompressor(Gzip{})
+	wsh.pool.SetCompressThreshold(o.CompressThreshold)
+	wsh.pool.SetMaxOnline(o.MaxOnlineConn)
+	wsh.pool.SetLogger(o.Logger)
+	if o.HeartbeatTimeout > 0 {
+		wsh.HandleFunc(HEARTBEAT, wsh.handleHeartbeat)
+	}
 	return wsh
 }
 
@@ -90,13 +214,14 @@ func (wsh *WebSocketHelper) Unmarshal(src []byte, dest interface{}) error {
 	return wsh.Serializer.Unmarshal(src, dest)
 }
 
-// set marshaller
+// set marshaller, the default of connections not negotiating a serializer, it's registered to be negotiable too.
 // I assume you're aware of the danger of changing marshaller while server is on .
 // It's best set it right before the ws server has listened on
 func (wsh *WebSocketHelper) SetMarshaller(dest Marshaller) {
 	wsh.M.Lock()
 	defer wsh.M.Unlock()
 	wsh.Serializer = dest
+	wsh.marshallers[dest.TypeName()] = dest
 }
 
 // set error handler
@@ -124,6 +249,19 @@ func (wsh *WebSocketHelper) SetCommands(commands ...int) {
 	}
 }
 
+// register a handler for a command, the command will be added into Commands if not set yet.
+// handlers should be registered right on the init stage, before the ws server has listened on
+func (wsh *WebSocketHelper) HandleFunc(command int, f func(pool *ConnectionPool, rawBytes []byte, cache map[string]interface{}) error) {
+	wsh.M.Lock()
+	defer wsh.M.Unlock()
+	hash := wsh.genCommandHash(command)
+	if _, ok := wsh.commandHash[hash]; !ok {
+		wsh.Commands = append(wsh.Commands, command)
+		wsh.commandHash[hash] = command
+	}
+	wsh.commandHandleMapper[command] = f
+}
+
 // get a msg command from its hash
 func (wsh *WebSocketHelper) GetCommand(hash string) int {
 	wsh.M.RLock()
@@ -138,9 +276,21 @@ func (wsh *WebSocketHelper) ListCommandsHash() map[string]int {
 	return wsh.commandHash
 }
 
-// online a user
+// online a user, messages saved while the user was offline will be delivered in order,
+// and messages not acked by the user will be resent. failures are logged, what's left is delivered on the next Online
 func (wsh *WebSocketHelper) Online(key string, conn *websocket.Conn) {
 	wsh.pool.Add(key, conn)
+	if e := wsh.DeliverOffline(key); e != nil {
+		wsh.Logger().Warn("deliver offline messages", "key", key, "error", e)
+	}
+	wsh.M.RLock()
+	d := wsh.delivery
+	wsh.M.RUnlock()
+	if d != nil {
+		if e := d.Resend(key); e != nil {
+			wsh.Logger().Warn("resend messages not acked", "key", key, "error", e)
+		}
+	}
 }
 
 // offline a user
@@ -150,11 +300,9 @@ func (wsh *WebSocketHelper) Offline(key string, conn *websocket.Conn) {
 
 // bind a message []byte to a struct 'dest' and the command value to 'command'
 func (wsh *WebSocketHelper) Bind(conn *websocket.Conn, command *int, dest interface{}) error {
-	var receive []byte
-
-	er := websocket.Message.Receive(conn, &receive)
+	receive, er := wsh.pool.Read(conn)
 	if er != nil {
-		if er == io.EOF {
+		if _, ok := er.(*Error); ok || er == io.EOF || er == websocket.ErrFrameTooLarge {
 			return er
 		}
 		return errorx.New(er)
@@ -168,79 +316,135 @@ func (wsh *WebSocketHelper) Bind(conn *websocket.Conn, command *int, dest interf
 	if *command == 0 {
 		return errorx.NewFromStringf("unknown command '%d'", *command)
 	}
-	return wsh.Unmarshal(receive[32:], dest)
+	return wsh.SerializerOf(conn).Unmarshal(receive[32:], dest)
 }
 
 // get a raw bytes of a request
 func (wsh *WebSocketHelper) RawBytesOf(conn *websocket.Conn) ([]byte, error) {
-	var buf []byte
-	er := websocket.Message.Receive(conn, &buf)
+	buf, _, _, er := wsh.readFrame(conn)
+	return buf, er
+}
+
+// read a frame, its trace header is stripped off and returned as the parent.
+// received is when the frame arrived, before it's decoded
+func (wsh *WebSocketHelper) readFrame(conn *websocket.Conn) (buf []byte, parent SpanContext, received time.Time, er error) {
+	var msg []byte
+	if er = websocket.Message.Receive(conn, &msg); er == nil {
+		received = time.Now()
+		// the trace header goes before the compression flag, it's never compressed
+		if parent, msg, er = splitTraceHeader(msg); er != nil {
+			return nil, parent, received, er
+		}
+		buf, er = wsh.pool.decode(conn, msg)
+	}
 	if er != nil {
-		if er == io.EOF {
-			return nil, er
+		// closed by the server, e.g. kicked
+		if errors.Is(er, net.ErrClosed) {
+			return nil, parent, received, io.EOF
 		}
-		return nil, errorx.New(er)
+		if _, ok := er.(*Error); ok || er == io.EOF || er == websocket.ErrFrameTooLarge || isTimeout(er) {
+			return nil, parent, received, er
+		}
+		return nil, parent, received, errorx.New(er)
 	}
-
 	if len(buf) < 32 {
-		return nil,errorx.NewFromStringf("required message  more than 32 bit but got '%s' length '%d'", string(buf), len(buf))
+		return nil, parent, received, Errorf(ERR_BAD_REQUEST, "required message more than 32 bit but got length '%d'", len(buf))
 	}
 	command := wsh.GetCommand(string(buf[:32]))
 
 	if command == 0 {
-		return nil, errorx.NewFromStringf("unknown command '%d'", command)
+		return nil, parent, received, NewError(ERR_UNKNOWN_COMMAND, "unknown command")
 	}
-	return buf, nil
+	return buf, parent, received, nil
 }
 
-// get raw bytes of a request,
-// rs is the result per command,
-// buf is a buffer per read,
-// startFrom is the byte number calculated,
-// maxSize is the limit max size of body
-func (wsh *WebSocketHelper) SafeRawBytesOf(rs []byte, buf []byte, startFrom *int, conn *websocket.Conn, maxSize int) ([]byte, error) {
-	if rs == nil {
-		rs = make([]byte, 0, 512)
-	}
-
-	if buf == nil {
-		buf = make([]byte, 512)
-	}
-	n, e := conn.Read(buf)
-	if e != nil {
-		if e == io.EOF {
-			return nil, e
+// serve a message read by the dispatcher
+func (wsh *WebSocketHelper) serve(conn *websocket.Conn, raw []byte, cache map[string]interface{}) error {
+	command := wsh.CommandOf(raw)
+	mt := wsh.metricsOf()
+	mt.frameIn(command, len(raw))
+	stream, isStream := wsh.streamHandlerOf(command)
+	if er := wsh.limitRate(conn, command); er != nil {
+		if isStream && er.(*Error).Policy != POLICY_CLOSE {
+			if e := wsh.discardStream(conn, raw); e != nil {
+				return e
+			}
 		}
-		return nil, errorx.New(e)
+		return er
 	}
-
-	if len(buf[:n]) < 32 {
-		return nil,errorx.NewFromStringf("required message  more than 32 bit but got '%s' length '%d'", string(buf), len(buf))
+	if isStream {
+		start := time.Now()
+		defer func() { mt.observe(command, time.Since(start)) }()
+		return wsh.serveStream(stream, conn, raw, cache)
 	}
-	command := wsh.GetCommand(string(buf[:32]))
-
-	if command == 0 {
-		return nil, errorx.NewFromStringf("unknown command '%d'", command)
+	if limit := wsh.PayloadLimitOf(command); len(raw)-32 > limit {
+		return errPayloadTooLarge(command, int64(len(raw)-32), limit)
 	}
-
-	*startFrom += n
-	if *startFrom > maxSize {
-		return nil, errorx.NewFromString(fmt.Sprintf("receive size '%d' bigger than the max '%d'", *startFrom, maxSize))
+	// handlers may be added at runtime, like HEARTBEAT by UpdateSettings
+	wsh.M.RLock()
+	handler, ok := wsh.commandHandleMapper[command]
+	wsh.M.RUnlock()
+	if !ok {
+		return nil
+	}
+	ctx, span := StartSpan(ContextOf(cache), SPAN_HANDLE)
+	cache[CACHE_CONTEXT] = ctx
+	start := time.Now()
+	defer func() { mt.observe(command, time.Since(start)) }()
+	er := handler(wsh.pool, raw, cache)
+	if er != nil {
+		span.RecordError(er)
 	}
-	rs = append(rs, buf[:n]...)
-	return rs, nil
+	span.End()
+	return er
 }
 
 // get the command from the raw bytes
 func (wsh *WebSocketHelper) CommandOf(buf []byte) int {
+	buf, _ = splitDebugFlag(buf)
 	if len(buf) < 32 {
 		panic(errorx.NewFromStringf("want buf more than 32 bit but got '%d'", len(buf)))
 	}
 	return wsh.GetCommand(string(buf[:32]))
 }
 
+// pack an object into a message with the command hash as its header
+func (wsh *WebSocketHelper) Pack(command int, obj interface{}) ([]byte, error) {
+	obj, debug := wsh.packDebug(command, obj)
+	body, e := wsh.Marshal(obj)
+	if e != nil {
+		return nil, errorx.New(e)
+	}
+	return packFrame(wsh.genCommandHash(command), body, debug), nil
+}
+
+// pack an object with the serializer of the connection and send it back through the connection
+func (wsh *WebSocketHelper) Reply(conn *websocket.Conn, command int, obj interface{}) error {
+	return wsh.ReplyContext(context.Background(), conn, command, obj)
+}
+
+// Reply in a span of the frame ctx, handlers pass wshelper.ContextOf(cache).
+// a REPLY should be of a registered type, it's skipped if it's debug-only and the connection is not in debug mode
+func (wsh *WebSocketHelper) ReplyContext(ctx context.Context, conn *websocket.Conn, command int, obj interface{}) error {
+	if reply, ok := replyOf(obj); ok && command == REPLY {
+		kind, e := wsh.replies.check(reply)
+		if e != nil {
+			return e
+		}
+		if kind.DebugOnly && !wsh.pool.IsDebug(conn) {
+			return nil
+		}
+	}
+	buf, e := wsh.PackFor(conn, command, obj)
+	if e != nil {
+		return e
+	}
+	return wsh.pool.WriteContext(ctx, conn, buf)
+}
+
 // get the core struct from the raw bytes
 func (wsh *WebSocketHelper) CoreOf(buf []byte, dest interface{}) error {
+	buf, _ = splitDebugFlag(buf)
 	return wsh.Unmarshal(buf[32:], dest)
 }
 
@@ -258,6 +462,9 @@ func (wsh *WebSocketHelper) CoreOf(buf []byte, dest interface{}) error {
 //     }
 // }
 //
+// to let each connection negotiate its serializer by Sec-WebSocket-Protocol or '?serializer=', serve wsh.Server(f) instead:
+//     http.Handle("/test-ws/", wsh.Server(f))
+//
 // a wsHelper instance serves only one url.
 // it does not support dispatcher two or more url like:
 //	http.Handle("/test-ws1/", websocket.Handler(wsh.Dispatcher(f)))
@@ -269,39 +476,85 @@ func (wsh *WebSocketHelper) Dispatcher(handleE func(error)) func(conn *websocket
 	return func(conn *websocket.Conn) {
 		defer func(){
 			if e:= recover(); e!=nil {
-				logger.Println(fmt.Sprintf("recover from '%v'", e))
+				wsh.Logger().Error("recover from panic", "panic", fmt.Sprintf("%v", e), "remote", conn.RemoteAddr())
 			}
 		}()
 		defer conn.Close()
-		// conn.SetDeadline(v.GetInt("deadline") *time.Second))
-		// conn.MaxPayloadBytes = v.GetInt(maxPayloadBytes)
-
-		conn.SetDeadline(time.Now().Add(10 * 60 * 60 * time.Second))
-		conn.MaxPayloadBytes = 1 * GB
-		var er error
-		var raw []byte
-		var cache map[string]interface{}
+		mt := wsh.metricsOf()
+		mt.connect()
+		defer mt.disconnect()
+		deadline := time.Now().Add(wsh.Options().Deadline)
+		conn.SetDeadline(deadline)
+		serializer := wsh.negotiate(conn)
+		wsh.setSerializer(conn, serializer)
+		defer wsh.setSerializer(conn, nil)
+		compressor, er := wsh.negotiateCompressor(conn)
+		if er != nil {
+			handleE(er)
+			return
+		}
+		var compressorName string
+		if compressor != nil {
+			compressorName = compressor.Name()
+			wsh.pool.SetCompressor(conn, compressor)
+			defer wsh.pool.SetCompressor(conn, nil)
+		}
+		stats := wsh.pool.track(conn, serializer.TypeName(), compressorName)
+		defer wsh.pool.untrack(conn)
+		defer wsh.unsubscribeAll(conn)
+
+		// cache lives as long as the connection, handlers can share values via it if frames are handled one by one,
+		// or via SharedOf(cache) whatever Options.Concurrency is
+		var cache = map[string]interface{}{
+			CACHE_CONN:       conn,
+			CACHE_SERIALIZER: serializer,
+			CACHE_SHARED:     &sync.Map{},
+		}
+		// frames are handled by workers if Options.Concurrency > 1, they're waited before the connection is released
+		var workers *connWorkers
+		if n := wsh.Options().Concurrency; n > 1 {
+			workers = newConnWorkers(n)
+			defer workers.wait()
+		}
 		for {
-			raw, er = wsh.RawBytesOf(conn)
-			if er != nil {
-				if er == io.EOF {
-					return
+			// settings may change while the connection is online
+			opts := wsh.Options()
+			// frames larger than any command allows are dropped by the codec, the rest are checked by command below
+			conn.MaxPayloadBytes = wsh.framePayloadLimit()
+			if opts.HeartbeatTimeout > 0 {
+				readDeadline := time.Now().Add(opts.HeartbeatTimeout)
+				if readDeadline.After(deadline) {
+					readDeadline = deadline
 				}
-				handleE(er)
+				conn.SetReadDeadline(readDeadline)
+			}
+			raw, parent, received, er := wsh.readFrame(conn)
+			if isTimeout(er) {
+				wsh.Logger().Debug("connection timeout", "remote", conn.RemoteAddr())
 				return
 			}
-			command := wsh.CommandOf(raw)
-			// the command mapper should be set right on the init stage,thus,no need to add lock
-			handler, ok :=wsh.commandHandleMapper[command]
-			if !ok {
-				continue
+			if er == websocket.ErrFrameTooLarge {
+				er = errPayloadTooLarge(0, 0, conn.MaxPayloadBytes)
 			}
-			er = handler(wsh.pool, raw, cache)
-			if er != nil {
-				if er == io.EOF {
-					return
+			if er == nil {
+				stats.in(len(raw))
+				ctx, span := wsh.startFrameSpan(conn, raw, parent, received)
+				cache[CACHE_CONTEXT] = ctx
+				// streams are read from the connection, so they're served by the reader
+				if _, isStream := wsh.streamHandlerOf(wsh.CommandOf(raw)); workers != nil && !isStream {
+					wsh.serveAsync(workers, conn, raw, cache, span, handleE)
+					delete(cache, CACHE_CONTEXT)
+					continue
 				}
-				handleE(er)
+				er = wsh.serve(conn, raw, cache)
+				if er != nil {
+					span.RecordError(er)
+				}
+				span.End()
+				delete(cache, CACHE_CONTEXT)
+			}
+			// typed errors are replied and the connection goes on by their policy
+			if er != nil && !wsh.handleError(conn, er, handleE) {
 				return
 			}
 		}
@@ -313,7 +566,8 @@ func Panic(e error) {
 	panic(e)
 }
 
-// log to file
+// log an error by the stdlib log.
+// Deprecated: use wsh.LogError, logging by the logger of wsh
 func LogToFile(e error){
-    logger.Println(e.Error())
+    log.Println(e.Error())
 }
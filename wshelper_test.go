@@ -6,7 +6,9 @@ import (
 	"testing"
 )
 func TestConfig(t *testing.T) {
-	util.Assertf(v.Get("maxOnlineConnPerPool") != nil, t, "no such field 'maxOnlineConnPerPool', add it in config.yaml")
+	opts, e := LoadOptions("config.yaml")
+	util.Assertf(e == nil, t, "load config.yaml: %v", e)
+	util.Assertf(opts.MaxOnlineConn == 50000, t, "want field 'maxOnlineConnPerPool' 50000 in config.yaml but got %d", opts.MaxOnlineConn)
 }
 
 func TestWebSocketHelper_SetCommands_ListCommands(t *testing.T) {